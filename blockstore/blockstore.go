@@ -0,0 +1,498 @@
+// Package blockstore keeps the blocks of many files once, keyed by their
+// strong sums, so that any set of previously seen files can serve as the basis
+// of a delta.
+//
+// Importing a file stores its blocks, and a manifest which is the librsync
+// signature of the file with full-length strong sums. The signature of a basis
+// made of several files is the concatenation of their manifests, so deltas
+// against it are generated as usual with librsync.Delta. Patch then reads the
+// data copied from the basis from the blocks in the store.
+//
+// In such a basis, block i starts at offset i*BlockLen. The last block of each
+// file may be shorter, leaving gaps that a delta can't copy from. Deltas of
+// gzip files or using filters, which need to read the whole basis, aren't
+// supported.
+package blockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/balena-os/librsync-go"
+)
+
+const (
+	configName   = "config.json"
+	blocksDir    = "blocks"
+	manifestsDir = "manifests"
+	tempPrefix   = "tmp."
+)
+
+// Size of the header of signatures: magic number, block length and strong
+// sum length.
+const signatureHeaderSize = 12
+
+var (
+	ErrNotAStore     = errors.New("blockstore: not a block store")
+	ErrBlockNotFound = errors.New("blockstore: block not found")
+	ErrCorruptBlock  = errors.New("blockstore: block doesn't match its sum")
+)
+
+// Options controls how files are split into blocks.
+type Options struct {
+	BlockLen uint32 `json:"block_len"`
+
+	// SigType must be BLAKE2_SIG_MAGIC: blocks are keyed by their strong
+	// sums, so the hash must be collision resistant.
+	SigType librsync.MagicNumber `json:"sig_type"`
+}
+
+// DefaultOptions are the options used by Create if none are given.
+var DefaultOptions = Options{
+	BlockLen: 2048,
+	SigType:  librsync.BLAKE2_SIG_MAGIC,
+}
+
+// Store is a block store in a directory. It can be used by several goroutines
+// and processes at once, except for GC.
+type Store struct {
+	dir  string
+	opts Options
+}
+
+// Create creates an empty block store in dir, which is created if needed.
+// opts may be nil.
+func Create(dir string, opts *Options) (*Store, error) {
+	if opts == nil {
+		opts = &DefaultOptions
+	}
+	s := &Store{dir: dir, opts: *opts}
+	if _, err := s.strongLen(); err != nil {
+		return nil, err
+	}
+
+	for _, d := range []string{blocksDir, manifestsDir} {
+		err := os.MkdirAll(filepath.Join(dir, d), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := os.Stat(filepath.Join(dir, configName))
+	if err == nil {
+		return nil, fmt.Errorf("blockstore: %s already contains a store", dir)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data, err := json.Marshal(s.opts)
+	if err != nil {
+		return nil, err
+	}
+	return s, s.writeFile(filepath.Join(dir, configName), data)
+}
+
+// Open opens the block store in dir.
+func Open(dir string) (*Store, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, configName))
+	if os.IsNotExist(err) {
+		return nil, ErrNotAStore
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir}
+	err = json.Unmarshal(data, &s.opts)
+	if err != nil {
+		return nil, fmt.Errorf("blockstore: invalid config: %w", err)
+	}
+	if _, err := s.strongLen(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Options returns the options the store was created with.
+func (s *Store) Options() Options {
+	return s.opts
+}
+
+// strongLen returns the length of the strong sums used as keys: the full
+// length of the hash. MD4 isn't accepted, as colliding blocks could be made to
+// replace each other.
+func (s *Store) strongLen() (uint32, error) {
+	switch s.opts.SigType {
+	case librsync.BLAKE2_SIG_MAGIC:
+		return librsync.BLAKE2_SUM_LENGTH, nil
+	case librsync.MD4_SIG_MAGIC:
+		return 0, fmt.Errorf("blockstore: MD4 sums can't be used as keys, use BLAKE2")
+	}
+	return 0, fmt.Errorf("blockstore: invalid sigType %#x", s.opts.SigType)
+}
+
+// Import stores the blocks of the file read from r, and its manifest under the
+// given name, replacing any manifest with the same name. It returns the
+// manifest.
+func (s *Store) Import(name string, r io.Reader) (*librsync.SignatureType, error) {
+	path, err := s.manifestPath(name)
+	if err != nil {
+		return nil, err
+	}
+	strongLen, _ := s.strongLen()
+
+	manifest := &bytes.Buffer{}
+	bw := &blockWriter{s: s, buf: make([]byte, 0, s.opts.BlockLen)}
+	sig, err := librsync.Signature(io.TeeReader(r, bw), manifest, s.opts.BlockLen, strongLen, s.opts.SigType)
+	if err == nil {
+		err = bw.flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return sig, s.writeFile(path, manifest.Bytes())
+}
+
+// Manifests returns the names of the imported files.
+func (s *Store) Manifests() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, manifestsDir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), tempPrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// Manifest returns the manifest of an imported file.
+func (s *Store) Manifest(name string) (*librsync.SignatureType, error) {
+	path, err := s.manifestPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return librsync.ReadSignatureFile(path)
+}
+
+// Remove removes the manifest of an imported file. Its blocks are removed by
+// GC, if they aren't used by other files.
+func (s *Store) Remove(name string) error {
+	path, err := s.manifestPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// WriteBasis writes to w the signature of the basis made of the given imported
+// files, in order.
+func (s *Store) WriteBasis(w io.Writer, names ...string) error {
+	strongLen, _ := s.strongLen()
+	for _, v := range []interface{}{s.opts.SigType, s.opts.BlockLen, strongLen} {
+		err := binary.Write(w, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		path, err := s.manifestPath(name)
+		if err != nil {
+			return err
+		}
+		err = copyBlockSums(w, path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlockSums copies the block sums of the manifest at path to w.
+func copyBlockSums(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(signatureHeaderSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Basis returns the signature of the basis made of the given imported files,
+// in order.
+func (s *Store) Basis(names ...string) (*librsync.SignatureType, error) {
+	buf := &bytes.Buffer{}
+	err := s.WriteBasis(buf, names...)
+	if err != nil {
+		return nil, err
+	}
+	return librsync.ReadSignature(buf)
+}
+
+// Patch is like librsync.PatchWithOptions, but reads the data copied from the
+// basis from the blocks in the store. basis is the signature of the basis the
+// delta was generated against, as returned by Basis.
+func (s *Store) Patch(basis *librsync.SignatureType, delta io.Reader, out io.Writer, opts librsync.PatchOptions) error {
+	r, err := s.NewBasisReader(basis)
+	if err != nil {
+		return err
+	}
+	return librsync.PatchWithOptions(r, delta, out, opts)
+}
+
+// NewBasisReader returns a ReadSeeker of the basis with the given signature,
+// reading its blocks from the store. Reading from the gap after a short block
+// returns an error.
+func (s *Store) NewBasisReader(basis *librsync.SignatureType) (io.ReadSeeker, error) {
+	strongLen, _ := s.strongLen()
+	if basis.SigType != s.opts.SigType || basis.BlockLen != s.opts.BlockLen || basis.StrongLen != strongLen {
+		return nil, fmt.Errorf("blockstore: basis signature doesn't match the store options")
+	}
+	return &basisReader{s: s, sig: basis, idx: -1}, nil
+}
+
+// GC removes the blocks not used by any manifest, and returns how many were
+// removed. No other operation may run on the store meanwhile.
+func (s *Store) GC() (int, error) {
+	names, err := s.Manifests()
+	if err != nil {
+		return 0, err
+	}
+	used := map[string]bool{}
+	for _, name := range names {
+		sig, err := s.Manifest(name)
+		if err != nil {
+			return 0, err
+		}
+		for _, sum := range sig.StrongSigs {
+			used[hex.EncodeToString(sum)] = true
+		}
+	}
+
+	removed := 0
+	err = filepath.Walk(filepath.Join(s.dir, blocksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || used[info.Name()] {
+			return err
+		}
+		err = os.Remove(path)
+		if err == nil {
+			removed++
+		}
+		return err
+	})
+	return removed, err
+}
+
+// ReadBlock returns the block with the given strong sum, checking it.
+func (s *Store) ReadBlock(sum []byte) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.blockPath(sum))
+	if os.IsNotExist(err) {
+		return nil, ErrBlockNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	got, err := librsync.CalcStrongSum(data, s.opts.SigType, uint32(len(sum)))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(got, sum) {
+		return nil, ErrCorruptBlock
+	}
+	return data, nil
+}
+
+// writeBlock stores a block, unless it is already there.
+func (s *Store) writeBlock(data []byte) error {
+	strongLen, _ := s.strongLen()
+	sum, err := librsync.CalcStrongSum(data, s.opts.SigType, strongLen)
+	if err != nil {
+		return err
+	}
+
+	path := s.blockPath(sum)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(path, data)
+}
+
+// blockPath returns the path of a block, in a subdirectory named after the
+// first byte of its sum to keep directories small.
+func (s *Store) blockPath(sum []byte) string {
+	key := hex.EncodeToString(sum)
+	return filepath.Join(s.dir, blocksDir, key[:2], key)
+}
+
+func (s *Store) manifestPath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.HasPrefix(name, tempPrefix) {
+		return "", fmt.Errorf("blockstore: invalid manifest name %q", name)
+	}
+	return filepath.Join(s.dir, manifestsDir, name), nil
+}
+
+// writeFile atomically writes data to path.
+func (s *Store) writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of the directory dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// blockWriter stores the blocks of the data written to it.
+type blockWriter struct {
+	s   *Store
+	buf []byte
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(b.buf[len(b.buf):cap(b.buf)], p)
+		b.buf = b.buf[:len(b.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(b.buf) == cap(b.buf) {
+			err := b.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush stores the pending block, if any.
+func (b *blockWriter) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	err := b.s.writeBlock(b.buf)
+	b.buf = b.buf[:0]
+	return err
+}
+
+// basisReader reads a basis from the blocks of a store.
+type basisReader struct {
+	s   *Store
+	sig *librsync.SignatureType
+	pos int64
+
+	// The last block read, and its index.
+	block []byte
+	idx   int
+}
+
+func (b *basisReader) load(idx int) error {
+	if idx == b.idx {
+		return nil
+	}
+	data, err := b.s.ReadBlock(b.sig.StrongSum(idx))
+	if err != nil {
+		return fmt.Errorf("block %d: %w", idx, err)
+	}
+	b.block, b.idx = data, idx
+	return nil
+}
+
+func (b *basisReader) Read(p []byte) (int, error) {
+	blockLen := int64(b.sig.BlockLen)
+	idx := b.pos / blockLen
+	if idx >= int64(b.sig.NumBlocks()) {
+		return 0, io.EOF
+	}
+	err := b.load(int(idx))
+	if err != nil {
+		return 0, err
+	}
+
+	off := b.pos % blockLen
+	if off >= int64(len(b.block)) {
+		if idx == int64(b.sig.NumBlocks())-1 {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("blockstore: read past the end of block %d", idx)
+	}
+	n := copy(p, b.block[off:])
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *basisReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		n := b.sig.NumBlocks()
+		end := int64(0)
+		if n > 0 {
+			err := b.load(n - 1)
+			if err != nil {
+				return b.pos, err
+			}
+			end = int64(n-1)*int64(b.sig.BlockLen) + int64(len(b.block))
+		}
+		offset += end
+	default:
+		return b.pos, fmt.Errorf("blockstore: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return b.pos, fmt.Errorf("blockstore: negative position %d", offset)
+	}
+	b.pos = offset
+	return offset, nil
+}
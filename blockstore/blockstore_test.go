@@ -0,0 +1,176 @@
+package blockstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/balena-os/librsync-go"
+)
+
+func randomData(rnd *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	rnd.Read(data)
+	return data
+}
+
+func countBlocks(t *testing.T, dir string) int {
+	n := 0
+	err := filepath.Walk(filepath.Join(dir, blocksDir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return n
+}
+
+func delta(t *testing.T, sig *librsync.SignatureType, data []byte) []byte {
+	out := &bytes.Buffer{}
+	require.NoError(t, librsync.DeltaBuff(sig, bytes.NewReader(data), out, make([]byte, 0, librsync.OUTPUT_BUFFER_SIZE)))
+	return out.Bytes()
+}
+
+func TestBlockStore(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	rnd := rand.New(rand.NewSource(1))
+
+	dir := t.TempDir()
+	s, err := Create(dir, &Options{BlockLen: 1024, SigType: librsync.BLAKE2_SIG_MAGIC})
+	r.NoError(err)
+
+	// Two files sharing most of their blocks, neither a multiple of the
+	// block length.
+	shared := randomData(rnd, 64*1024)
+	a1 := append(append([]byte{}, shared...), randomData(rnd, 3000)...)
+	a2 := append(randomData(rnd, 2048), shared...)
+	a2 = append(a2, 100)
+
+	_, err = s.Import("a1", bytes.NewReader(a1))
+	r.NoError(err)
+	_, err = s.Import("a2", bytes.NewReader(a2))
+	r.NoError(err)
+	a.Equal(64+3+2+1, countBlocks(t, dir))
+
+	s, err = Open(dir)
+	r.NoError(err)
+	names, err := s.Manifests()
+	r.NoError(err)
+	a.Equal([]string{"a1", "a2"}, names)
+
+	// A new file made of pieces of both is patched from the store.
+	target := append(append([]byte{}, a2[:2048]...), a1[30000:]...)
+	target = append(target, randomData(rnd, 500)...)
+	basis, err := s.Basis("a1", "a2")
+	r.NoError(err)
+	d := delta(t, basis, target)
+	a.Less(len(d), 3000)
+
+	out := &bytes.Buffer{}
+	r.NoError(s.Patch(basis, bytes.NewReader(d), out, librsync.PatchOptions{}))
+	a.Equal(target, out.Bytes())
+
+	// The signature written by WriteBasis is the same.
+	buf := &bytes.Buffer{}
+	r.NoError(s.WriteBasis(buf, "a1", "a2"))
+	sig, err := librsync.ReadSignature(buf)
+	r.NoError(err)
+	a.Equal(basis, sig)
+
+	// Removing a file keeps the blocks used by the other one.
+	r.NoError(s.Remove("a1"))
+	removed, err := s.GC()
+	r.NoError(err)
+	a.Equal(3, removed)
+	a.Equal(64+2+1, countBlocks(t, dir))
+
+	basis, err = s.Basis("a2")
+	r.NoError(err)
+	out.Reset()
+	r.NoError(s.Patch(basis, bytes.NewReader(delta(t, basis, a1)), out, librsync.PatchOptions{}))
+	a.Equal(a1, out.Bytes())
+}
+
+func TestBlockStoreErrors(t *testing.T) {
+	r := require.New(t)
+	rnd := rand.New(rand.NewSource(2))
+
+	dir := t.TempDir()
+	_, err := Open(dir)
+	r.Equal(ErrNotAStore, err)
+
+	s, err := Create(dir, nil)
+	r.NoError(err)
+	_, err = Create(dir, nil)
+	r.Error(err)
+	_, err = Create(t.TempDir(), &Options{BlockLen: 1024, SigType: librsync.MD4_SIG_MAGIC})
+	r.Error(err)
+
+	for _, name := range []string{"", ".", "../x", "a/b", "tmp.1"} {
+		_, err = s.Import(name, bytes.NewReader(nil))
+		r.Error(err, name)
+	}
+
+	data := randomData(rnd, 16*1024)
+	basis, err := s.Import("data", bytes.NewReader(data))
+	r.NoError(err)
+	d := delta(t, basis, data)
+
+	// A corrupt block.
+	path := s.blockPath(basis.StrongSigs[3])
+	r.NoError(ioutil.WriteFile(path, []byte("x"), 0644))
+	err = s.Patch(basis, bytes.NewReader(d), ioutil.Discard, librsync.PatchOptions{})
+	r.ErrorIs(err, ErrCorruptBlock)
+
+	// A missing block.
+	r.NoError(os.Remove(path))
+	err = s.Patch(basis, bytes.NewReader(d), ioutil.Discard, librsync.PatchOptions{})
+	r.ErrorIs(err, ErrBlockNotFound)
+
+	// A signature that doesn't match the store.
+	other := *basis
+	other.StrongLen = 8
+	err = s.Patch(&other, bytes.NewReader(d), ioutil.Discard, librsync.PatchOptions{})
+	r.Error(err)
+}
+
+func TestBasisReaderGap(t *testing.T) {
+	r := require.New(t)
+	rnd := rand.New(rand.NewSource(3))
+
+	dir := t.TempDir()
+	s, err := Create(dir, &Options{BlockLen: 1024, SigType: librsync.BLAKE2_SIG_MAGIC})
+	r.NoError(err)
+	_, err = s.Import("a", bytes.NewReader(randomData(rnd, 1500)))
+	r.NoError(err)
+	_, err = s.Import("b", bytes.NewReader(randomData(rnd, 1500)))
+	r.NoError(err)
+
+	basis, err := s.Basis("a", "b")
+	r.NoError(err)
+	br, err := s.NewBasisReader(basis)
+	r.NoError(err)
+
+	// The short block of a is followed by a gap.
+	end, err := br.Seek(0, io.SeekEnd)
+	r.NoError(err)
+	r.Equal(int64(3*1024+476), end)
+
+	_, err = br.Seek(1400, io.SeekStart)
+	r.NoError(err)
+	buf := make([]byte, 200)
+	n, err := br.Read(buf)
+	r.NoError(err)
+	r.Equal(100, n)
+	_, err = br.Read(buf)
+	r.Error(err)
+}
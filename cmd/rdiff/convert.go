@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/balena-os/librsync-go/vcdiff"
+)
+
+func CommandConvert(c *cli.Context) {
+	if len(c.Args()) > 2 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-2)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing input file")
+	}
+
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing output file")
+	}
+
+	input, err := os.Open(c.Args().Get(0))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(c.Args().Get(1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer output.Close()
+
+	switch c.String("to") {
+	case "vcdiff":
+		opts := &vcdiff.Options{WindowSize: uint64(c.Uint("window-size"))}
+		err = vcdiff.FromDelta(input, output, opts)
+	case "rdiff":
+		err = vcdiff.ToDelta(input, output)
+	default:
+		logrus.Fatalf("Invalid output format: %v", c.String("to"))
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
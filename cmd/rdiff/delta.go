@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
 	"os"
 
 	"github.com/balena-os/librsync-go"
@@ -25,11 +29,6 @@ func CommandDelta(c *cli.Context) {
 		logrus.Fatalf("Missing delta file")
 	}
 
-	signature, err := librsync.ReadSignatureFile(c.Args().Get(0))
-	if err != nil {
-		logrus.Fatal(err)
-	}
-
 	newfile, err := os.Open(c.Args().Get(1))
 	if err != nil {
 		logrus.Fatal(err)
@@ -42,8 +41,99 @@ func CommandDelta(c *cli.Context) {
 	}
 	defer delta.Close()
 
-	err = librsync.Delta(signature, newfile, delta)
+	output, finish := signOutput(c, c.Args().Get(2), delta)
+
+	sigFile, err := os.Open(c.Args().Get(0))
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	defer sigFile.Close()
+
+	var sigReader io.Reader = bufio.NewReader(sigFile)
+	if verifier, detached := verifyOptions(c); verifier != nil {
+		verified, err := librsync.VerifyStream(sigFile, verifier, detached)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer verified.Close()
+		sigReader = bufio.NewReader(verified)
+	}
+
+	var stats librsync.DeltaStats
+	opts := librsync.DeltaOptions{
+		TargetCopies:  c.Bool("target-copies"),
+		Fill:          c.Bool("fill"),
+		OrderedCopies: c.Bool("ordered-copies"),
+		Filter:        parseFilter(c.String("filter")),
+		Stats:         &stats,
+	}
+
+	if c.Bool("compress") {
+		switch c.String("codec") {
+		case "flate":
+			opts.LiteralCodec = &librsync.FlateCodec{Level: flate.BestCompression}
+		case "gzip":
+			opts.LiteralCodec = &librsync.GzipCodec{Level: gzip.BestCompression}
+		default:
+			logrus.Fatalf("Invalid codec: %v", c.String("codec"))
+		}
+	}
+
+	switch {
+	case c.Bool("tar") && c.Bool("gzip"):
+		logrus.Fatalf("--tar and --gzip can't be used together")
+	case c.Bool("tar") && c.Bool("mmap"):
+		logrus.Fatalf("--tar and --mmap can't be used together")
+	case c.Bool("tar"):
+		var signature *librsync.TarSignatureType
+		signature, err = librsync.ReadTarSignature(sigReader)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		err = librsync.TarDelta(signature, newfile, output, opts)
+	default:
+		var signature *librsync.SignatureType
+		if c.Bool("mmap") {
+			signature, err = mappedSignature(c, c.Args().Get(0))
+		} else {
+			signature, err = librsync.ReadSignature(sigReader)
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if c.Bool("gzip") {
+			err = librsync.GzipDelta(signature, newfile, output, opts)
+		} else {
+			err = librsync.DeltaWithOptions(signature, newfile, output, opts)
+		}
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	finish()
+
+	if c.Bool("statistics") {
+		logrus.Infof("literal: %d cmds, %d bytes, %d stored bytes (compression ratio %.2f)",
+			stats.LitCmds, stats.LitBytes, stats.LitStoredBytes, stats.LitCompressionRatio())
+		logrus.Infof("copy: %d cmds, %d bytes", stats.CopyCmds, stats.CopyBytes)
+		if opts.TargetCopies {
+			logrus.Infof("target copy: %d cmds, %d bytes", stats.TargetCopyCmds, stats.TargetCopyBytes)
+		}
+		if opts.Fill {
+			logrus.Infof("fill: %d cmds, %d bytes", stats.FillCmds, stats.FillBytes)
+		}
+	}
+}
+
+// mappedSignature reads the signature at path from memory. The file is left
+// mapped until the program exits.
+func mappedSignature(c *cli.Context, path string) (*librsync.SignatureType, error) {
+	if verifier, _ := verifyOptions(c); verifier != nil {
+		logrus.Fatalf("--mmap can't be used with a signed signature")
+	}
+	m, err := librsync.MapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return librsync.ReadSignatureMapped(m)
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// Keys are PEM files as created by:
+//
+//	openssl genpkey -algorithm ed25519 -out key.pem
+//	openssl pkey -in key.pem -pubout -out key.pub.pem
+
+func readPEM(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block.Bytes, nil
+}
+
+func loadSigner(path string) (librsync.Signer, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return librsync.Ed25519Signer{Key: priv}, nil
+}
+
+func loadVerifier(paths []string) (librsync.Verifier, error) {
+	var keys []ed25519.PublicKey
+	for _, path := range paths {
+		der, err := readPEM(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 key", path)
+		}
+		keys = append(keys, pub)
+	}
+	return librsync.NewEd25519PublicKeys(keys...), nil
+}
+
+// signOutput returns the writer to write the output file at path to, signing
+// it if requested with --sign-key, and a function to call once it is written.
+func signOutput(c *cli.Context, path string, f *os.File) (io.Writer, func()) {
+	if c.String("sign-key") == "" {
+		return f, func() {}
+	}
+	signer, err := loadSigner(c.String("sign-key"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if c.String("detached") == "" {
+		sw, err := librsync.NewSignedWriter(f, signer)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return sw, func() {
+			if err := sw.Close(); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+	}
+
+	return f, func() {
+		written, err := os.Open(path)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer written.Close()
+
+		sig, err := librsync.DetachedSignature(written, signer)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		err = ioutil.WriteFile(c.String("detached"), sig, 0644)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+}
+
+// verifyOptions returns the Verifier and the detached signature, if any, to
+// check the input file with, as given by --verify-key and --verify-detached.
+// The Verifier is nil if no key is given.
+func verifyOptions(c *cli.Context) (librsync.Verifier, []byte) {
+	if len(c.StringSlice("verify-key")) == 0 {
+		if c.String("verify-detached") != "" {
+			logrus.Fatalf("--verify-detached requires --verify-key")
+		}
+		return nil, nil
+	}
+
+	verifier, err := loadVerifier(c.StringSlice("verify-key"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var detached []byte
+	if c.String("verify-detached") != "" {
+		detached, err = ioutil.ReadFile(c.String("verify-detached"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	return verifier, detached
+}
@@ -5,8 +5,53 @@ import (
 	"os"
 
 	"github.com/urfave/cli"
+
+	"github.com/balena-os/librsync-go/vcdiff"
 )
 
+var signFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "sign-key",
+		Usage: "Sign the output with this ed25519 private key, in PEM format (librsync-go extension)",
+	},
+	cli.StringFlag{
+		Name:  "detached",
+		Usage: "Write the signature of the output to this file, instead of embedding it",
+	},
+}
+
+var verifyFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "verify-key",
+		Usage: "Check that the input was signed with this ed25519 public key, in PEM format; can be repeated",
+	},
+	cli.StringFlag{
+		Name:  "verify-detached",
+		Usage: "Detached signature of the input, instead of an embedded one",
+	},
+}
+
+var syncFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "command, e",
+		Usage: "Talk to the standard input and output of this shell command, e.g. \"ssh host rdiff sync send FILE\"",
+	},
+	cli.StringFlag{
+		Name:  "hash, H",
+		Value: "blake2,md4",
+		Usage: "Hash algorithms proposed by the receiver or allowed by the sender, in order of preference",
+	},
+	cli.UintFlag{
+		Name:  "block-size, b",
+		Value: 2048,
+		Usage: "Signature block size (receiver)",
+	},
+	cli.UintFlag{
+		Name:  "sum-size, S",
+		Usage: "Set signature strength (receiver), defaults to the full hash",
+	},
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "rdiff"
@@ -21,7 +66,7 @@ func main() {
 			Usage:     "creates a signature of the input file",
 			ArgsUsage: "BASIS SIGNATURE",
 			Action:    CommandSignature,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.UintFlag{
 					Name:  "block-size, b",
 					Value: 2048,
@@ -37,19 +82,173 @@ func main() {
 					Value: "blake2",
 					Usage: "Hash algorithm: blake2, md4",
 				},
-			},
+				cli.BoolFlag{
+					Name:  "tar",
+					Usage: "Sign the entries of a tar archive (librsync-go extension)",
+				},
+				cli.BoolFlag{
+					Name:  "gzip",
+					Usage: "Sign the decompressed contents of a gzip file (librsync-go extension)",
+				},
+				cli.StringFlag{
+					Name:  "filter",
+					Usage: "Filter executable code before signing it: x86, arm64 (librsync-go extension)",
+				},
+			}, signFlags...),
 		},
 		{
 			Name:      "delta",
 			Usage:     "calculates the binary diff between old and new files",
 			ArgsUsage: "SIGNATURE NEWFILE DELTA",
 			Action:    CommandDelta,
+			Flags: append(append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "tar",
+					Usage: "Diff the entries of a tar archive, using a signature created with --tar",
+				},
+				cli.BoolFlag{
+					Name:  "gzip",
+					Usage: "Diff the decompressed contents of a gzip file, using a signature created with --gzip",
+				},
+				cli.StringFlag{
+					Name:  "filter",
+					Usage: "Filter executable code before diffing it, using a signature created with the same --filter",
+				},
+				cli.BoolFlag{
+					Name:  "target-copies",
+					Usage: "Copy repeated data from the new file itself (librsync-go extension)",
+				},
+				cli.BoolFlag{
+					Name:  "fill",
+					Usage: "Encode runs of a single byte compactly (librsync-go extension)",
+				},
+				cli.BoolFlag{
+					Name:  "ordered-copies",
+					Usage: "Copy from the basis in order only, so that it can be streamed when patching",
+				},
+				cli.BoolFlag{
+					Name:  "compress, z",
+					Usage: "Compress literal data (librsync-go extension)",
+				},
+				cli.StringFlag{
+					Name:  "codec",
+					Value: "flate",
+					Usage: "Codec used by --compress: flate, gzip",
+				},
+				cli.BoolFlag{
+					Name:  "statistics, s",
+					Usage: "Show delta statistics",
+				},
+				cli.BoolFlag{
+					Name:  "mmap",
+					Usage: "Map SIGNATURE in memory instead of reading it, where possible",
+				},
+			}, signFlags...), verifyFlags...),
 		},
 		{
 			Name:      "patch",
 			Usage:     "uses the delta file and old file to produce the new file",
-			ArgsUsage: "BASIS DELTA NEWFILE",
+			ArgsUsage: "BASIS|- DELTA NEWFILE",
 			Action:    CommandPatch,
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "sparse",
+					Usage: "Create holes in NEWFILE for runs of zeros",
+				},
+				cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "Only write the parts of an existing NEWFILE which change, e.g. to reduce flash wear",
+				},
+				cli.UintFlag{
+					Name:  "window",
+					Usage: "Bytes of the basis kept to copy again when it is read from the standard input",
+				},
+				cli.BoolFlag{
+					Name:  "mmap",
+					Usage: "Map BASIS in memory instead of reading it, where possible",
+				},
+			}, verifyFlags...),
+		},
+		{
+			Name:      "convert",
+			Usage:     "converts a delta between the rdiff and VCDIFF formats",
+			ArgsUsage: "INPUT OUTPUT",
+			Action:    CommandConvert,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "to",
+					Value: "vcdiff",
+					Usage: "Output format: vcdiff, rdiff",
+				},
+				cli.UintFlag{
+					Name:  "window-size",
+					Value: vcdiff.DefaultWindowSize,
+					Usage: "Maximum target bytes per VCDIFF window",
+				},
+			},
+		},
+		{
+			Name:  "store",
+			Usage: "keeps versions of a file, as the newest one and reverse deltas",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "adds FILE as the newest version, creating STORE if needed",
+					ArgsUsage: "STORE FILE",
+					Action:    CommandStoreAdd,
+					Flags: []cli.Flag{
+						cli.UintFlag{
+							Name:  "block-size, b",
+							Value: 2048,
+							Usage: "Signature block size, when creating the store",
+						},
+					},
+				},
+				{
+					Name:      "list",
+					Usage:     "lists the versions in STORE",
+					ArgsUsage: "STORE",
+					Action:    CommandStoreList,
+				},
+				{
+					Name:      "restore",
+					Usage:     "writes the version with the given ID, or the latest one, to OUTPUT",
+					ArgsUsage: "STORE ID|latest OUTPUT",
+					Action:    CommandStoreRestore,
+				},
+				{
+					Name:      "prune",
+					Usage:     "removes old versions, always keeping the latest one",
+					ArgsUsage: "STORE",
+					Action:    CommandStorePrune,
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "older-than",
+							Usage: "Remove the versions added before this long ago, e.g. 720h",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "sync",
+			Usage: "updates a file on another host over stdin/stdout, e.g. through ssh",
+			Subcommands: []cli.Command{
+				{
+					Name:      "send",
+					Usage:     "sends the delta to NEWFILE, against the basis of the receiver",
+					ArgsUsage: "NEWFILE",
+					Action:    CommandSyncSend,
+					Flags:     syncFlags,
+				},
+				{
+					Name:      "receive",
+					Usage:     "sends the signature of BASIS and patches it into NEWFILE",
+					ArgsUsage: "BASIS NEWFILE",
+					Action:    CommandSyncReceive,
+					Flags:     syncFlags,
+				},
+			},
 		},
 	}
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	_ "io/ioutil"
 	"os"
 
@@ -26,11 +27,25 @@ func CommandPatch(c *cli.Context) {
 		logrus.Fatalf("Missing newfile file")
 	}
 
-	basis, err := os.Open(c.Args().Get(0))
-	if err != nil {
-		logrus.Fatal(err)
+	// The basis is streamed from the standard input if it is "-".
+	var src librsync.BlockSource
+	if c.Args().Get(0) == "-" {
+		src = librsync.NewStreamSource(bufio.NewReader(os.Stdin), int(c.Uint("window")))
+	} else if c.Bool("mmap") {
+		basis, err := librsync.MapFile(c.Args().Get(0))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer basis.Close()
+		src = basis
+	} else {
+		basis, err := os.Open(c.Args().Get(0))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer basis.Close()
+		src = librsync.NewReadSeekerSource(basis)
 	}
-	defer basis.Close()
 
 	delta, err := os.Open(c.Args().Get(1))
 	if err != nil {
@@ -38,13 +53,42 @@ func CommandPatch(c *cli.Context) {
 	}
 	defer delta.Close()
 
-	newfile, err := os.OpenFile(c.Args().Get(2), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	// Opened for reading too, so that target copies can read it back, and
+	// kept if overwriting.
+	flags := os.O_CREATE | os.O_RDWR
+	if !c.Bool("overwrite") {
+		flags |= os.O_TRUNC
+	}
+	newfile, err := os.OpenFile(c.Args().Get(2), flags, os.FileMode(0600))
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	defer newfile.Close()
 
-	if err := librsync.Patch(basis, delta, newfile); err != nil {
+	opts := librsync.PatchOptions{
+		Sparse: c.Bool("sparse"),
+	}
+	opts.Verifier, opts.DetachedSignature = verifyOptions(c)
+
+	if !c.Bool("overwrite") {
+		if err := librsync.PatchFromSource(src, delta, newfile, opts); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	if opts.Sparse {
+		logrus.Fatalf("--sparse and --overwrite can't be used together")
+	}
+	out := librsync.NewOverwriter(newfile)
+	if err := librsync.PatchFromSource(src, delta, out, opts); err != nil {
 		logrus.Fatal(err)
 	}
+	// Block devices can't be truncated, and have the right size anyway.
+	if info, err := newfile.Stat(); err == nil && info.Mode().IsRegular() {
+		if err := newfile.Truncate(out.Size()); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	logrus.Infof("wrote %d of %d bytes", out.Written(), out.Size())
 }
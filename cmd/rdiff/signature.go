@@ -46,8 +46,39 @@ func CommandSignature(c *cli.Context) {
 	}
 	defer signature.Close()
 
-	_, err = librsync.Signature(basis, signature, uint32(c.Uint("block-size")), uint32(c.Uint("sum-size")), sigType)
+	output, finish := signOutput(c, c.Args().Get(1), signature)
+	filter := parseFilter(c.String("filter"))
+
+	switch {
+	case c.Bool("tar") && c.Bool("gzip"):
+		logrus.Fatalf("--tar and --gzip can't be used together")
+	case filter != nil && (c.Bool("tar") || c.Bool("gzip")):
+		logrus.Fatalf("--filter can't be used with --tar or --gzip")
+	case c.Bool("tar"):
+		_, err = librsync.TarSignature(basis, output, uint32(c.Uint("block-size")), uint32(c.Uint("sum-size")), sigType)
+	case c.Bool("gzip"):
+		_, err = librsync.GzipSignature(basis, output, uint32(c.Uint("block-size")), uint32(c.Uint("sum-size")), sigType)
+	case filter != nil:
+		_, err = librsync.FilteredSignature(filter, basis, output, uint32(c.Uint("block-size")), uint32(c.Uint("sum-size")), sigType)
+	default:
+		_, err = librsync.Signature(basis, output, uint32(c.Uint("block-size")), uint32(c.Uint("sum-size")), sigType)
+	}
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	finish()
+}
+
+// parseFilter returns the filter selected by --filter, or nil.
+func parseFilter(name string) librsync.Filter {
+	switch name {
+	case "":
+		return nil
+	case "x86":
+		return librsync.X86Filter{}
+	case "arm64":
+		return librsync.ARM64Filter{}
+	}
+	logrus.Fatalf("Invalid filter: %v", name)
+	return nil
 }
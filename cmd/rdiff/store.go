@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/balena-os/librsync-go/store"
+)
+
+// openStore opens the store given as first argument, creating it if create
+// is set and it doesn't exist yet.
+func openStore(c *cli.Context, create bool) *store.Store {
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing store directory")
+	}
+
+	s, err := store.Open(c.Args().Get(0))
+	if err == store.ErrNotAStore && create {
+		opts := store.DefaultOptions
+		opts.BlockLen = uint32(c.Uint("block-size"))
+		s, err = store.Create(c.Args().Get(0), &opts)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return s
+}
+
+func CommandStoreAdd(c *cli.Context) {
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing file")
+	}
+	s := openStore(c, true)
+
+	f, err := os.Open(c.Args().Get(1))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer f.Close()
+
+	v, err := s.Add(bufio.NewReader(f), time.Now())
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Added version %d", v.ID)
+}
+
+func CommandStoreList(c *cli.Context) {
+	s := openStore(c, false)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tSIZE\tSHA256")
+	for _, v := range s.Versions() {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", v.ID, v.Time.Format(time.RFC3339), v.Size, v.SHA256)
+	}
+	w.Flush()
+}
+
+func CommandStoreRestore(c *cli.Context) {
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing version")
+	}
+	if c.Args().Get(2) == "" {
+		logrus.Fatalf("Missing output file")
+	}
+	s := openStore(c, false)
+
+	var id uint64
+	if c.Args().Get(1) == "latest" {
+		v, ok := s.Latest()
+		if !ok {
+			logrus.Fatalf("The store is empty")
+		}
+		id = v.ID
+	} else {
+		var err error
+		id, err = strconv.ParseUint(c.Args().Get(1), 10, 64)
+		if err != nil {
+			logrus.Fatalf("Invalid version: %v", c.Args().Get(1))
+		}
+	}
+
+	out, err := os.OpenFile(c.Args().Get(2), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	err = s.Restore(id, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func CommandStorePrune(c *cli.Context) {
+	if c.Duration("older-than") <= 0 {
+		logrus.Fatalf("Missing --older-than")
+	}
+	s := openStore(c, false)
+
+	pruned, err := s.Prune(time.Now().Add(-c.Duration("older-than")))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err := s.Clean(); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Removed %d versions", len(pruned))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/balena-os/librsync-go"
+	"github.com/balena-os/librsync-go/syncproto"
+)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// syncConn returns the connection to the other end of a sync session: the
+// standard input and output, or those of the command given with --command.
+func syncConn(c *cli.Context) (io.ReadWriter, func() error) {
+	if c.String("command") == "" {
+		return readWriter{os.Stdin, os.Stdout}, func() error { return nil }
+	}
+
+	cmd := exec.Command("sh", "-c", c.String("command"))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	return readWriter{stdout, stdin}, func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}
+}
+
+func syncOptions(c *cli.Context) syncproto.Options {
+	opts := syncproto.Options{
+		BlockLen:  uint32(c.Uint("block-size")),
+		StrongLen: uint32(c.Uint("sum-size")),
+	}
+	for _, hash := range strings.Split(c.String("hash"), ",") {
+		switch hash {
+		case "blake2":
+			opts.Hashes = append(opts.Hashes, librsync.BLAKE2_SIG_MAGIC)
+		case "md4":
+			opts.Hashes = append(opts.Hashes, librsync.MD4_SIG_MAGIC)
+		default:
+			logrus.Fatalf("Invalid hash type: %v", hash)
+		}
+	}
+	return opts
+}
+
+func CommandSyncSend(c *cli.Context) {
+	if len(c.Args()) > 1 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-1)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing newfile file")
+	}
+
+	opts := syncOptions(c)
+
+	newfile, err := os.Open(c.Args().Get(0))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer newfile.Close()
+
+	conn, wait := syncConn(c)
+	err = syncproto.Send(conn, newfile, opts)
+	if werr := wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func CommandSyncReceive(c *cli.Context) {
+	if len(c.Args()) > 2 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-2)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing basis file")
+	}
+
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing newfile file")
+	}
+
+	opts := syncOptions(c)
+
+	basis, err := os.Open(c.Args().Get(0))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer basis.Close()
+
+	newfile, err := os.OpenFile(c.Args().Get(1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer newfile.Close()
+
+	conn, wait := syncConn(c)
+	err = syncproto.Receive(conn, basis, newfile, opts)
+	if werr := wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package librsync
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// LiteralCodec compresses the data of LITERAL commands in deltas generated
+// with DeltaOptions.LiteralCodec.
+//
+// The codec used by a delta is recorded in its header by ID, so codecs must be
+// registered with RegisterLiteralCodec before patching the deltas using them.
+type LiteralCodec interface {
+	// ID identifies the codec in delta headers. IDs up to 127 are reserved for
+	// librsync-go.
+	ID() uint8
+
+	// NewWriter returns a WriteCloser compressing data into w. Close must
+	// flush any pending data, but not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a ReadCloser decompressing data read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+const (
+	FLATE_CODEC_ID uint8 = iota + 1
+	GZIP_CODEC_ID
+)
+
+var (
+	literalCodecsMu sync.RWMutex
+	literalCodecs   = map[uint8]LiteralCodec{}
+)
+
+func init() {
+	RegisterLiteralCodec(&FlateCodec{Level: flate.DefaultCompression})
+	RegisterLiteralCodec(&GzipCodec{Level: gzip.DefaultCompression})
+}
+
+// RegisterLiteralCodec makes a codec available to Patch, replacing any codec
+// previously registered with the same ID.
+func RegisterLiteralCodec(c LiteralCodec) {
+	literalCodecsMu.Lock()
+	defer literalCodecsMu.Unlock()
+	literalCodecs[c.ID()] = c
+}
+
+func literalCodec(id uint8) (LiteralCodec, error) {
+	literalCodecsMu.RLock()
+	defer literalCodecsMu.RUnlock()
+	c, ok := literalCodecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown literal codec %d", id)
+	}
+	return c, nil
+}
+
+// copyCompressedLiteral writes to out the size bytes of literal data stored
+// compressed in the next zsize bytes of r.
+func copyCompressedLiteral(out io.Writer, r io.Reader, codec LiteralCodec, size, zsize int64) (int64, error) {
+	zr := io.LimitReader(r, zsize)
+	dr, err := codec.NewReader(zr)
+	if err != nil {
+		return 0, err
+	}
+	defer dr.Close()
+
+	n, err := io.CopyN(out, dr, size)
+	if err != nil {
+		return n, err
+	}
+
+	// Skip whatever the decompressor didn't need to read.
+	_, err = io.Copy(ioutil.Discard, zr)
+	return n, err
+}
+
+// FlateCodec compresses literals with raw DEFLATE.
+type FlateCodec struct {
+	// Compression level, as in compress/flate. Zero selects
+	// flate.DefaultCompression rather than flate.NoCompression, so that the
+	// zero value compresses.
+	Level int
+
+	writers sync.Pool
+}
+
+func (c *FlateCodec) ID() uint8 {
+	return FLATE_CODEC_ID
+}
+
+func (c *FlateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	// Flate writers are expensive to create, and we create one per LITERAL
+	// command.
+	if fw, ok := c.writers.Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return &pooledFlateWriter{fw, &c.writers}, nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledFlateWriter{fw, &c.writers}, nil
+}
+
+func (c *FlateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type pooledFlateWriter struct {
+	*flate.Writer
+	pool *sync.Pool
+}
+
+func (w *pooledFlateWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// GzipCodec compresses literals with gzip. It is slightly larger than
+// FlateCodec, but each literal can be inspected with standard tools.
+type GzipCodec struct {
+	// Compression level, as in compress/gzip. Zero selects
+	// gzip.DefaultCompression rather than gzip.NoCompression.
+	Level int
+}
+
+func (c *GzipCodec) ID() uint8 {
+	return GZIP_CODEC_ID
+}
+
+func (c *GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (c *GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
@@ -0,0 +1,154 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDeltaAndPatchCompressedLiterals is like TestDeltaAndPatch, but with
+// compressed literals.
+func TestDeltaAndPatchCompressedLiterals(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	codecs := []LiteralCodec{&FlateCodec{Level: 9}, &GzipCodec{Level: 1}}
+
+	for _, codec := range codecs {
+		for _, tt := range allTestCases {
+			t.Run(tt, func(t *testing.T) {
+				file, _, _, _, err := argsFromTestName(tt)
+				r.NoError(err)
+
+				sig, err := ReadSignatureFile("testdata/" + tt + ".signature")
+				r.NoError(err)
+
+				newFile, err := os.Open("testdata/" + file + ".new")
+				r.NoError(err)
+				deltaBuffer := &bytes.Buffer{}
+
+				err = DeltaWithOptions(sig, newFile, deltaBuffer, DeltaOptions{LiteralCodec: codec})
+				r.NoError(err)
+
+				baseFile, err := os.Open("testdata/" + file + ".old")
+				r.NoError(err)
+
+				output := &bytes.Buffer{}
+				err = Patch(baseFile, deltaBuffer, output)
+				r.NoError(err)
+
+				wantNewFile, err := ioutil.ReadFile("testdata/" + file + ".new")
+				r.NoError(err)
+
+				gotNewFile, err := ioutil.ReadAll(output)
+				r.NoError(err)
+
+				a.Equal(wantNewFile, gotNewFile)
+			})
+		}
+	}
+}
+
+func TestCompressedLiteralsStats(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000))
+	newData := append([]byte(strings.Repeat("lorem ipsum dolor sit amet\n", 1000)), old...)
+	sig := signature(t, bytes.NewReader(old))
+
+	var plainStats DeltaStats
+	plain := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(newData), plain, DeltaOptions{Stats: &plainStats}))
+	a.Equal(plainStats.LitBytes, plainStats.LitStoredBytes)
+	a.Equal(1.0, plainStats.LitCompressionRatio())
+
+	// The zero values compress too.
+	for i, codec := range []LiteralCodec{&FlateCodec{Level: 9}, &FlateCodec{}, &GzipCodec{}} {
+		var stats DeltaStats
+		delta := &bytes.Buffer{}
+		r.NoError(DeltaWithOptions(sig, bytes.NewReader(newData), delta, DeltaOptions{
+			LiteralCodec: codec,
+			Stats:        &stats,
+		}))
+
+		a.Equal(plainStats.LitBytes, stats.LitBytes)
+		a.Equal(plainStats.CopyBytes, stats.CopyBytes)
+		a.Greater(stats.LitCompressionRatio(), 10.0, "codec %d", i)
+		a.Less(delta.Len(), plain.Len()/10)
+
+		output := &bytes.Buffer{}
+		r.NoError(Patch(bytes.NewReader(old), delta, output))
+		a.Equal(newData, output.Bytes())
+	}
+}
+
+// xorCodec is a toy codec used to test custom codecs.
+type xorCodec struct{}
+
+func (xorCodec) ID() uint8 { return 200 }
+
+func (xorCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return &xorWriter{w}, nil
+}
+
+func (xorCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&xorReader{r}), nil
+}
+
+// Makes the data "compressible" by dropping every other byte, which must be
+// zero.
+type xorWriter struct{ w io.Writer }
+
+func (x *xorWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += 2 {
+		if _, err := x.w.Write([]byte{p[i] ^ 0xff}); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (x *xorWriter) Close() error { return nil }
+
+type xorReader struct{ r io.Reader }
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	if len(p) < 2 {
+		return 0, io.ErrShortBuffer
+	}
+	buf := make([]byte, len(p)/2)
+	n, err := x.r.Read(buf)
+	for i := 0; i < n; i++ {
+		p[2*i] = buf[i] ^ 0xff
+		p[2*i+1] = 0
+	}
+	return 2 * n, err
+}
+
+func TestCustomLiteralCodec(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	newData := bytes.Repeat([]byte{7, 0}, 1000)
+	sig := signature(t, bytes.NewReader(nil))
+
+	delta := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(newData), delta, DeltaOptions{LiteralCodec: xorCodec{}}))
+	a.Less(delta.Len(), len(newData))
+
+	// Not registered yet
+	err := Patch(bytes.NewReader(nil), bytes.NewReader(delta.Bytes()), &bytes.Buffer{})
+	a.Error(err)
+
+	RegisterLiteralCodec(xorCodec{})
+	output := &bytes.Buffer{}
+	r.NoError(Patch(bytes.NewReader(nil), bytes.NewReader(delta.Bytes()), output))
+	a.Equal(newData, output.Bytes())
+}
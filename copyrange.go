@@ -0,0 +1,32 @@
+package librsync
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// errCopyRangeUnsupported is returned when data can't be copied between files
+// by the kernel, because of the platform, the filesystems or the files.
+var errCopyRangeUnsupported = errors.New("copying file ranges not supported")
+
+// copyRangeFiles returns the files read by src and written by out, if both are
+// regular files, so that COPY commands can be done with copyFileRange.
+func copyRangeFiles(src BlockSource, out io.Writer) (base, dst *os.File) {
+	switch s := src.(type) {
+	case *readSeekerSource:
+		base, _ = s.rs.(*os.File)
+	case readerAtSource:
+		base, _ = s.ReaderAt.(*os.File)
+	}
+	dst, _ = out.(*os.File)
+	if base == nil || dst == nil || !isRegular(base) || !isRegular(dst) {
+		return nil, nil
+	}
+	return base, dst
+}
+
+func isRegular(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package librsync
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Maximum number of bytes copied by a single copy_file_range call.
+const maxCopyRange = 1 << 30
+
+// copyFileRange copies the n bytes of src at off to the current offset of dst,
+// within the kernel, which may share the data between the files instead of
+// copying it. It returns the number of bytes copied, and
+// errCopyRangeUnsupported if the remaining ones must be copied otherwise.
+func copyFileRange(dst, src *os.File, off, n int64) (int64, error) {
+	var written int64
+	for written < n {
+		size := n - written
+		if size > maxCopyRange {
+			size = maxCopyRange
+		}
+		roff := off + written
+		c, err := unix.CopyFileRange(int(src.Fd()), &roff, int(dst.Fd()), nil, int(size), 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) ||
+			errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EBADF) {
+			return written, errCopyRangeUnsupported
+		}
+		if err != nil {
+			return written, err
+		}
+		if c == 0 {
+			// The basis is too short.
+			return written, io.ErrUnexpectedEOF
+		}
+		written += int64(c)
+	}
+	return written, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package librsync
+
+import "os"
+
+func copyFileRange(dst, src *os.File, off, n int64) (int64, error) {
+	return 0, errCopyRangeUnsupported
+}
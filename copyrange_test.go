@@ -0,0 +1,116 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTemp writes data to a new file in dir, and returns it open.
+func writeTemp(t errorI, dir, name string, data []byte) *os.File {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Error(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	return f
+}
+
+// TestPatchFiles checks patching between files, where copies are done by the
+// kernel when possible.
+func TestPatchFiles(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	dir := t.TempDir()
+
+	// Target copies read back data copied by the kernel.
+	for name, opts := range deltaOptionSets("plain", "target-copies") {
+		t.Run(name, func(t *testing.T) {
+			old, new, delta := makeImage(t, 4*1024*1024, opts)
+			base := writeTemp(t, dir, "old", old)
+			defer base.Close()
+			out, err := os.Create(filepath.Join(dir, "new"))
+			r.NoError(err)
+			defer out.Close()
+
+			r.NoError(Patch(base, bytes.NewReader(delta), out))
+			got, err := ioutil.ReadFile(out.Name())
+			r.NoError(err)
+			a.True(bytes.Equal(new, got))
+		})
+	}
+
+	// The output is written from its current offset.
+	old, new, delta := makeImage(t, 1024*1024, DeltaOptions{})
+	base := writeTemp(t, dir, "old", old)
+	defer base.Close()
+	out := writeTemp(t, dir, "new", []byte("header"))
+	defer out.Close()
+	_, err := out.Seek(0, io.SeekEnd)
+	r.NoError(err)
+	r.NoError(Patch(base, bytes.NewReader(delta), out))
+	got, err := ioutil.ReadFile(out.Name())
+	r.NoError(err)
+	a.True(bytes.Equal(append([]byte("header"), new...), got))
+
+	// The basis is too short.
+	short := writeTemp(t, dir, "short", old[:len(old)/2])
+	defer short.Close()
+	r.NoError(out.Truncate(0))
+	_, err = out.Seek(0, io.SeekStart)
+	r.NoError(err)
+	r.Error(Patch(short, bytes.NewReader(delta), out))
+}
+
+func benchmarkPatchFiles(b *testing.B, size int, copyRange bool) {
+	old, new, delta := makeImage(b, size, DeltaOptions{})
+	dir := b.TempDir()
+	base := writeTemp(b, dir, "old", old)
+	defer base.Close()
+	out, err := os.Create(filepath.Join(dir, "new"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	// Hiding the files makes copies go through memory.
+	var baseRS io.ReadSeeker = base
+	var outW io.Writer = out
+	if !copyRange {
+		baseRS, outW = readWriteSeekerOnly{base}, readWriteSeekerOnly{out}
+	}
+
+	b.SetBytes(int64(len(new)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err = out.Truncate(0)
+		if err == nil {
+			_, err = out.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			err = Patch(baseRS, bytes.NewReader(delta), outW)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPatchFiles256MB(b *testing.B) {
+	benchmarkPatchFiles(b, 256*1024*1024, true)
+}
+
+func BenchmarkPatchFilesNoCopyRange256MB(b *testing.B) {
+	benchmarkPatchFiles(b, 256*1024*1024, false)
+}
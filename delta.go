@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
@@ -15,6 +16,131 @@ func Delta(sig *SignatureType, i io.Reader, output io.Writer) error {
 	return DeltaBuff(sig, i, output, buff)
 }
 
+// DeltaOptions selects the librsync-go extensions used by DeltaWithOptions.
+// The zero value generates plain librsync deltas.
+type DeltaOptions struct {
+	// LitBuff is the literal buffer, with the same requirements as in
+	// DeltaBuff. If nil, a new buffer is allocated.
+	LitBuff []byte
+
+	// TargetCopies allows the delta to copy data from the part of the new
+	// file that precedes it, so that content repeated in the new file but
+	// absent from the basis is sent only once. Deltas generated this way can
+	// only be applied by librsync-go.
+	//
+	// Every block of the new file is indexed, which takes about 100 bytes of
+	// memory per block, unless MaxTargetBlocks is set. When patching, the
+	// output is read back if it implements io.ReaderAt, and is otherwise kept
+	// in memory.
+	TargetCopies bool
+
+	// MaxTargetBlocks, if not zero, limits the number of blocks of the new
+	// file indexed for TargetCopies, and thus the memory used. Data repeated
+	// from later blocks is then sent again.
+	MaxTargetBlocks int
+
+	// LiteralCodec, if not nil, is used to compress literal data. Deltas
+	// generated this way can only be applied by librsync-go, with the codec
+	// registered with RegisterLiteralCodec.
+	LiteralCodec LiteralCodec
+
+	// Fill encodes long runs of a single byte value (like zeros in disk
+	// images) that are not found in the basis as FILL commands, instead of as
+	// literal data. Deltas generated this way can only be applied by
+	// librsync-go.
+	Fill bool
+
+	// OrderedCopies makes the positions of the COPY commands increase, each
+	// one copying data after the previous one, so that the delta can be
+	// applied from a basis read sequentially, see NewStreamSource. The delta
+	// may be larger, as blocks found before the previous copy are sent as
+	// literals.
+	OrderedCopies bool
+
+	// Filter, if not nil, transforms the input before diffing it, against a
+	// signature created by FilteredSignature with the same filter. Deltas
+	// generated this way can only be applied by librsync-go, with the filter
+	// registered with RegisterFilter.
+	Filter Filter
+
+	// Stats, if not nil, receives statistics about the generated delta.
+	Stats *DeltaStats
+
+	// Checkpoint, if not nil, is called by DeltaWithOptions with the state of
+	// the delta generation every CheckpointInterval bytes of input, or 64MiB
+	// if zero, so that ResumeDelta can continue it after an interruption. The
+	// delta written so far should be persisted with the checkpoint; an error
+	// aborts the delta. Checkpoints can't be made with a Filter.
+	Checkpoint         func(*DeltaCheckpoint) error
+	CheckpointInterval int64
+}
+
+// header returns the header of deltas using the extensions enabled by opts.
+func (opts *DeltaOptions) header() deltaHeader {
+	header := deltaHeader{magic: DELTA_MAGIC}
+	if opts.TargetCopies {
+		header.flags |= DELTA_FLAG_TARGET_COPY
+	}
+	if opts.LiteralCodec != nil {
+		header.flags |= DELTA_FLAG_COMPRESSED_LITERALS
+		header.codec = opts.LiteralCodec.ID()
+	}
+	if opts.Fill {
+		header.flags |= DELTA_FLAG_FILL
+	}
+	if opts.Filter != nil {
+		header.flags |= DELTA_FLAG_FILTER
+		header.filter = opts.Filter.ID()
+	}
+	if header.flags != 0 {
+		header.magic = DELTA_EXT_MAGIC
+	}
+	return header
+}
+
+// litBuff returns the literal buffer to use, checking the one in opts.
+func (opts *DeltaOptions) litBuff() ([]byte, error) {
+	litBuff := opts.LitBuff
+	if litBuff == nil {
+		litBuff = make([]byte, 0, OUTPUT_BUFFER_SIZE)
+	}
+	if len(litBuff) != 0 || cap(litBuff) != int(OUTPUT_BUFFER_SIZE) {
+		return nil, fmt.Errorf("bad literal buffer")
+	}
+	return litBuff, nil
+}
+
+// newMatch returns a match encoding commands with the extensions enabled by
+// opts.
+func (opts *DeltaOptions) newMatch(output io.Writer, litBuff []byte) match {
+	m := newMatch(output, litBuff)
+	m.codec = opts.LiteralCodec
+	m.fill = opts.Fill
+	return m
+}
+
+// DeltaStats describes the commands in a delta.
+type DeltaStats struct {
+	LitCmds         uint64 // LITERAL commands, compressed or not
+	LitBytes        uint64 // literal data, before compression
+	LitStoredBytes  uint64 // literal data, as stored in the delta
+	CopyCmds        uint64
+	CopyBytes       uint64
+	TargetCopyCmds  uint64
+	TargetCopyBytes uint64
+	FillCmds        uint64
+	FillBytes       uint64
+}
+
+// LitCompressionRatio returns how many times literal data was reduced by
+// compression.
+func (s *DeltaStats) LitCompressionRatio() float64 {
+	if s.LitStoredBytes == 0 {
+		return 1
+	}
+	return float64(s.LitBytes) / float64(s.LitStoredBytes)
+}
+
 // DeltaBuff like Delta but allows to pass literal buffer slice.
 // This is useful for efficient computation of multiple deltas.
 //
@@ -31,24 +157,138 @@ func Delta(sig *SignatureType, i io.Reader, output io.Writer) error {
 //	  _ = DeltaBuff(sig, f, delta, litBuff)
 //	}
 func DeltaBuff(sig *SignatureType, i io.Reader, output io.Writer, litBuff []byte) error {
-	if len(litBuff) != 0 || cap(litBuff) != int(OUTPUT_BUFFER_SIZE) {
+	if litBuff == nil {
 		return fmt.Errorf("bad literal buffer")
 	}
+	return DeltaWithOptions(sig, i, output, DeltaOptions{LitBuff: litBuff})
+}
 
-	input := bufio.NewReader(i)
+// DeltaWithOptions is like DeltaBuff, but allows to enable extensions to the
+// delta format. See DeltaOptions for details.
+func DeltaWithOptions(sig *SignatureType, i io.Reader, output io.Writer, opts DeltaOptions) error {
+	return deltaWithHeader(sig, i, output, opts, opts.header())
+}
 
-	err := binary.Write(output, binary.BigEndian, DELTA_MAGIC)
+// deltaWithHeader generates a delta like DeltaWithOptions, starting it with
+// header instead of the one derived from opts.
+func deltaWithHeader(sig *SignatureType, i io.Reader, output io.Writer, opts DeltaOptions, header deltaHeader) error {
+	litBuff, err := opts.litBuff()
 	if err != nil {
 		return err
 	}
 
-	prevByte := byte(0)
-	m := newMatch(output, litBuff)
+	if opts.Checkpoint != nil && (header.has(DELTA_FLAG_GZIP) || header.has(DELTA_FLAG_FILTER)) {
+		return errors.New("deltas with transformed contents can't be checkpointed")
+	}
+
+	var targets *targetIndex
+	if opts.TargetCopies {
+		targets = newTargetIndex(sig.BlockLen, opts.MaxTargetBlocks)
+	}
+
+	cw := &countingWriter{w: output}
+	err = writeDeltaHeader(cw, header)
+	if err != nil {
+		return err
+	}
+
+	if opts.Filter != nil {
+		i = opts.Filter.NewEncoder(i)
+	}
+
+	m := opts.newMatch(cw, litBuff)
+	s := newScanner(sig, &m, 0, targets)
+	s.orderedCopies = opts.OrderedCopies
+	return runDelta(s, i, cw, opts, header)
+}
+
+// runDelta encodes the rest of the input with s, ending the delta written to
+// cw, and making checkpoints if enabled by opts.
+func runDelta(s *scanner, i io.Reader, cw *countingWriter, opts DeltaOptions, header deltaHeader) error {
+	if opts.Checkpoint != nil {
+		s.checkpointInterval = uint64(opts.CheckpointInterval)
+		if opts.CheckpointInterval <= 0 {
+			s.checkpointInterval = defaultCheckpointInterval
+		}
+		s.checkpoint = func(s *scanner) error {
+			return opts.Checkpoint(s.save(cw.n, header))
+		}
+	}
+
+	err := s.run(bufio.NewReader(i), false)
+	if err != nil {
+		return err
+	}
+
+	if err := s.m.flush(); err != nil {
+		return err
+	}
+
+	if opts.Stats != nil {
+		*opts.Stats = s.m.stats
+	}
 
-	weakSum := NewRollsum()
+	return binary.Write(cw, binary.BigEndian, OP_END)
+}
+
+// scan encodes the input into m, matching it against sig. The blocks of sig are
+// copied from copyBase onwards in the basis. If matchTail is set, the input
+// remaining after the last match may match a partial last block of sig.
+func scan(sig *SignatureType, input io.ByteReader, m *match, copyBase uint64, targets *targetIndex, matchTail bool) error {
+	return newScanner(sig, m, copyBase, targets).run(input, matchTail)
+}
+
+// scanner holds the state of scan, which can be saved in a DeltaCheckpoint.
+type scanner struct {
+	sig      *SignatureType
+	m        *match
+	copyBase uint64
+	targets  *targetIndex
+
+	// Number of bytes read from the input so far.
+	inPos uint64
+
+	// Weak sum of the window of input being matched, and its contents.
+	weakSum Rollsum
+	block   circbuf.Buffer
+
+	// Whether copies must be in order, and where the last one ended in the
+	// basis.
+	orderedCopies bool
+	copyEnd       uint64
+
+	// Called when at least checkpointInterval bytes of input were read since
+	// the previous call, if not nil.
+	checkpoint         func(s *scanner) error
+	checkpointInterval uint64
+	checkpointed       uint64
+}
+
+func newScanner(sig *SignatureType, m *match, copyBase uint64, targets *targetIndex) *scanner {
 	block, _ := circbuf.NewBuffer(int64(sig.BlockLen))
+	return &scanner{
+		sig:      sig,
+		m:        m,
+		copyBase: copyBase,
+		targets:  targets,
+		weakSum:  NewRollsum(),
+		block:    block,
+	}
+}
+
+func (s *scanner) run(input io.ByteReader, matchTail bool) error {
+	sig, m, block := s.sig, s.m, s.block
+	prevByte := byte(0)
 
 	for {
+		if s.checkpoint != nil && s.inPos-s.checkpointed >= s.checkpointInterval {
+			s.checkpointed = s.inPos
+			err := s.checkpoint(s)
+			if err != nil {
+				return err
+			}
+		}
+
 		in, err := input.ReadByte()
 		if err == io.EOF {
 			break
@@ -63,26 +303,48 @@ func DeltaBuff(sig *SignatureType, i io.Reader, output io.Writer, litBuff []byte
 			}
 		}
 		block.WriteByte(in)
-		weakSum.Rollin(in)
+		s.weakSum.Rollin(in)
+		s.inPos++
+
+		if s.targets != nil {
+			s.targets.add(in)
+		}
 
-		if weakSum.count < uint64(sig.BlockLen) {
+		if s.weakSum.count < uint64(sig.BlockLen) {
 			continue
 		}
 
-		if weakSum.count > uint64(sig.BlockLen) {
+		if s.weakSum.count > uint64(sig.BlockLen) {
 			err := m.add(MATCH_KIND_LITERAL, uint64(prevByte), 1)
 			if err != nil {
 				return err
 			}
-			weakSum.Rollout(prevByte)
+			s.weakSum.Rollout(prevByte)
 		}
 
-		if blockIdx, ok := sig.Weak2block[weakSum.Digest()]; ok {
+		weak := s.weakSum.Digest()
+		if blockIdx, ok := sig.Weak2block[weak]; ok && s.inOrder(blockIdx) {
 			strong2, _ := CalcStrongSum(block.Bytes(), sig.SigType, sig.StrongLen)
-			if bytes.Equal(sig.StrongSigs[blockIdx], strong2) {
-				weakSum.Reset()
+			if bytes.Equal(sig.StrongSum(blockIdx), strong2) {
+				s.weakSum.Reset()
 				block.Reset()
-				err := m.add(MATCH_KIND_COPY, uint64(blockIdx)*uint64(sig.BlockLen), uint64(sig.BlockLen))
+				pos := s.copyBase + uint64(blockIdx)*uint64(sig.BlockLen)
+				s.copyEnd = pos + uint64(sig.BlockLen)
+				err := m.add(MATCH_KIND_COPY, pos, uint64(sig.BlockLen))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if s.targets != nil {
+			// Everything before the current block has been encoded already.
+			s.targets.emitted(s.inPos - s.weakSum.count)
+			if pos, ok := s.targets.find(weak, block.Bytes()); ok {
+				s.weakSum.Reset()
+				block.Reset()
+				err := m.add(MATCH_KIND_TARGET_COPY, pos, uint64(sig.BlockLen))
 				if err != nil {
 					return err
 				}
@@ -90,16 +352,28 @@ func DeltaBuff(sig *SignatureType, i io.Reader, output io.Writer, litBuff []byte
 		}
 	}
 
-	for _, b := range block.Bytes() {
+	rest := block.Bytes()
+	if matchTail && len(rest) > 0 && len(rest) < int(sig.BlockLen) {
+		if blockIdx, ok := sig.Weak2block[WeakChecksum(rest)]; ok && s.inOrder(blockIdx) {
+			strong2, _ := CalcStrongSum(rest, sig.SigType, sig.StrongLen)
+			if bytes.Equal(sig.StrongSum(blockIdx), strong2) {
+				return m.add(MATCH_KIND_COPY, s.copyBase+uint64(blockIdx)*uint64(sig.BlockLen), uint64(len(rest)))
+			}
+		}
+	}
+
+	for _, b := range rest {
 		err := m.add(MATCH_KIND_LITERAL, uint64(b), 1)
 		if err != nil {
 			return err
 		}
 	}
 
-	if err := m.flush(); err != nil {
-		return err
-	}
+	return nil
+}
 
-	return binary.Write(output, binary.BigEndian, OP_END)
+// inOrder tells if the block of the signature with the given index may be
+// copied next.
+func (s *scanner) inOrder(blockIdx int) bool {
+	return !s.orderedCopies || s.copyBase+uint64(blockIdx)*uint64(s.sig.BlockLen) >= s.copyEnd
 }
@@ -0,0 +1,326 @@
+package librsync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Filter transforms files before they are signed and diffed, to make them
+// easier to match, and transforms the output of Patch back. It is used with
+// FilteredSignature and DeltaOptions.Filter.
+//
+// The filter used by a delta is recorded in its header by ID, so filters must
+// be registered with RegisterFilter before patching the deltas using them.
+// Patch filters the basis into a temporary file.
+type Filter interface {
+	// ID identifies the filter in delta headers. IDs up to 127 are reserved
+	// for librsync-go.
+	ID() uint8
+
+	// NewEncoder returns a Reader of the transformed data read from r.
+	NewEncoder(r io.Reader) io.Reader
+
+	// NewDecoder returns a WriteCloser writing to w the original data of the
+	// transformed data written to it. Close must flush any pending data, but
+	// not close w.
+	NewDecoder(w io.Writer) io.WriteCloser
+}
+
+const (
+	BCJ_X86_FILTER_ID uint8 = iota + 1
+	BCJ_ARM64_FILTER_ID
+)
+
+var (
+	filtersMu sync.RWMutex
+	filters   = map[uint8]Filter{}
+)
+
+func init() {
+	RegisterFilter(X86Filter{})
+	RegisterFilter(ARM64Filter{})
+}
+
+// RegisterFilter makes a filter available to Patch, replacing any filter
+// previously registered with the same ID.
+func RegisterFilter(f Filter) {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	filters[f.ID()] = f
+}
+
+func filterByID(id uint8) (Filter, error) {
+	filtersMu.RLock()
+	defer filtersMu.RUnlock()
+	f, ok := filters[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter %d", id)
+	}
+	return f, nil
+}
+
+// FilteredSignature is like Signature, but signs the data read from input
+// transformed by f. The result is an ordinary signature, to be used with
+// DeltaOptions.Filter set to the same filter.
+func FilteredSignature(f Filter, input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
+	return Signature(f.NewEncoder(input), output, blockLen, strongLen, sigType)
+}
+
+// X86Filter is a branch/call/jump filter for x86 and x86-64 machine code.
+// Relative CALL and JMP targets are converted to absolute addresses, so that
+// calls to the same function look the same wherever they are, and don't change
+// when code before them is added or removed.
+//
+// The conversion is the one of the x86 BCJ filter of XZ Utils.
+type X86Filter struct{}
+
+func (X86Filter) ID() uint8 {
+	return BCJ_X86_FILTER_ID
+}
+
+func (X86Filter) NewEncoder(r io.Reader) io.Reader {
+	return newBCJReader(r, newX86Converter(true))
+}
+
+func (X86Filter) NewDecoder(w io.Writer) io.WriteCloser {
+	return newBCJWriter(w, newX86Converter(false))
+}
+
+// ARM64Filter is a branch filter for ARM64 machine code. The targets of BL
+// and ADRP instructions are converted to absolute addresses.
+//
+// The conversion is the one of the ARM64 BCJ filter of XZ Utils.
+type ARM64Filter struct{}
+
+func (ARM64Filter) ID() uint8 {
+	return BCJ_ARM64_FILTER_ID
+}
+
+func (ARM64Filter) NewEncoder(r io.Reader) io.Reader {
+	return newBCJReader(r, newARM64Converter(true))
+}
+
+func (ARM64Filter) NewDecoder(w io.Writer) io.WriteCloser {
+	return newBCJWriter(w, newARM64Converter(false))
+}
+
+// bcjConverter converts buf in place, buf starting at offset pos of the
+// stream. It returns the number of bytes converted; the others need more data
+// to be converted, and are passed again at the start of the next buffer. The
+// bytes left at the end of the stream are kept as is.
+type bcjConverter func(buf []byte, pos uint32) int
+
+// Size of the buffers of the BCJ filters.
+const bcjBufferSize = 64 * 1024
+
+// bcjReader converts the data read from r.
+type bcjReader struct {
+	r    io.Reader
+	conv bcjConverter
+
+	// buf[start:done] is converted, buf[done:end] isn't yet.
+	buf              []byte
+	start, done, end int
+
+	// Offset of buf[done] in the stream.
+	pos uint32
+	err error
+}
+
+func newBCJReader(r io.Reader, conv bcjConverter) *bcjReader {
+	return &bcjReader{r: r, conv: conv, buf: make([]byte, bcjBufferSize)}
+}
+
+func (b *bcjReader) Read(p []byte) (int, error) {
+	for b.start == b.done {
+		if b.err != nil {
+			if b.done == b.end {
+				return 0, b.err
+			}
+			b.done = b.end
+			break
+		}
+
+		b.end = copy(b.buf, b.buf[b.done:b.end])
+		b.start, b.done = 0, 0
+		n, err := b.r.Read(b.buf[b.end:])
+		b.end += n
+		b.err = err
+
+		converted := b.conv(b.buf[:b.end], b.pos)
+		b.done += converted
+		b.pos += uint32(converted)
+	}
+
+	n := copy(p, b.buf[b.start:b.done])
+	b.start += n
+	return n, nil
+}
+
+// bcjWriter converts the data written to it into w.
+type bcjWriter struct {
+	w    io.Writer
+	conv bcjConverter
+
+	// Data not converted yet.
+	buf []byte
+
+	// Offset of buf in the stream.
+	pos uint32
+}
+
+func newBCJWriter(w io.Writer, conv bcjConverter) *bcjWriter {
+	return &bcjWriter{w: w, conv: conv, buf: make([]byte, 0, bcjBufferSize)}
+}
+
+func (b *bcjWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(b.buf[len(b.buf):cap(b.buf)], p)
+		b.buf = b.buf[:len(b.buf)+n]
+		p = p[n:]
+
+		converted := b.conv(b.buf, b.pos)
+		_, err := b.w.Write(b.buf[:converted])
+		if err != nil {
+			return written, err
+		}
+		b.pos += uint32(converted)
+		b.buf = b.buf[:copy(b.buf, b.buf[converted:])]
+		written += n
+	}
+	return written, nil
+}
+
+func (b *bcjWriter) Close() error {
+	_, err := b.w.Write(b.buf)
+	b.buf = b.buf[:0]
+	return err
+}
+
+// isX86MSByte tells if b can be the most significant byte of a CALL or JMP
+// displacement.
+func isX86MSByte(b byte) bool {
+	return b == 0 || b == 0xff
+}
+
+var (
+	x86AllowedMask = [8]bool{true, true, true, false, true, false, false, false}
+	x86MaskToBit   = [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+)
+
+func newX86Converter(encoding bool) bcjConverter {
+	var prevMask uint32
+	var prevPos uint32
+	prevPos -= 5
+
+	return func(buf []byte, pos uint32) int {
+		if len(buf) < 5 {
+			return 0
+		}
+		if pos-prevPos > 5 {
+			prevPos = pos - 5
+		}
+
+		limit := len(buf) - 5
+		i := 0
+		for i <= limit {
+			b := buf[i]
+			if b != 0xe8 && b != 0xe9 {
+				i++
+				continue
+			}
+
+			offset := pos + uint32(i) - prevPos
+			prevPos = pos + uint32(i)
+			if offset > 5 {
+				prevMask = 0
+			} else {
+				for j := uint32(0); j < offset; j++ {
+					prevMask &= 0x77
+					prevMask <<= 1
+				}
+			}
+
+			b = buf[i+4]
+			if !isX86MSByte(b) || !x86AllowedMask[(prevMask>>1)&7] || prevMask>>1 >= 0x10 {
+				i++
+				prevMask |= 1
+				if isX86MSByte(b) {
+					prevMask |= 0x10
+				}
+				continue
+			}
+
+			src := binary.LittleEndian.Uint32(buf[i+1:])
+			var dest uint32
+			for {
+				if encoding {
+					dest = src + (pos + uint32(i) + 5)
+				} else {
+					dest = src - (pos + uint32(i) + 5)
+				}
+				if prevMask == 0 {
+					break
+				}
+				bit := x86MaskToBit[prevMask>>1]
+				b = byte(dest >> (24 - bit*8))
+				if !isX86MSByte(b) {
+					break
+				}
+				src = dest ^ (1<<(32-bit*8) - 1)
+			}
+
+			dest &= 0x01ffffff
+			if dest&0x01000000 != 0 {
+				dest |= 0xff000000
+			}
+			binary.LittleEndian.PutUint32(buf[i+1:], dest)
+			i += 5
+			prevMask = 0
+		}
+		return i
+	}
+}
+
+func newARM64Converter(encoding bool) bcjConverter {
+	return func(buf []byte, pos uint32) int {
+		i := 0
+		for ; i+4 <= len(buf); i += 4 {
+			pc := pos + uint32(i)
+			instr := binary.LittleEndian.Uint32(buf[i:])
+
+			switch {
+			case instr>>26 == 0x25:
+				// BL
+				pc >>= 2
+				if !encoding {
+					pc = -pc
+				}
+				instr = 0x94000000 | (instr+pc)&0x03ffffff
+			case instr&0x9f000000 == 0x90000000:
+				// ADRP, only with targets within +/-512MB to avoid
+				// converting data that just looks like it.
+				src := (instr>>29)&3 | (instr>>3)&0x001ffffc
+				if (src+0x00020000)&0x001c0000 != 0 {
+					continue
+				}
+				pc >>= 12
+				if !encoding {
+					pc = -pc
+				}
+				dest := src + pc
+				instr &= 0x9000001f
+				instr |= (dest & 3) << 29
+				instr |= (dest & 0x0003fffc) << 3
+				instr |= -(dest & 0x00020000) & 0x00e00000
+			default:
+				continue
+			}
+			binary.LittleEndian.PutUint32(buf[i:], instr)
+		}
+		return i
+	}
+}
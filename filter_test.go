@@ -0,0 +1,212 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeX86Code returns x86-like code, with calls to functions in its first
+// 4KB, and the same code with bytes inserted after the functions.
+func makeX86Code(size int) (old, new []byte) {
+	rnd := rand.New(rand.NewSource(1))
+
+	build := func(inserted int) []byte {
+		rnd.Seed(1)
+		end := size + inserted
+		code := make([]byte, 0, end)
+		for len(code) < end {
+			if len(code) >= 8192 && inserted > 0 {
+				code = append(code, bytes.Repeat([]byte{0x90}, inserted)...)
+				inserted = 0
+			}
+			if len(code) < 4096 || rnd.Intn(4) != 0 {
+				b := byte(rnd.Intn(256))
+				if b == 0xe8 || b == 0xe9 {
+					b = 0x90
+				}
+				code = append(code, b)
+				continue
+			}
+			target := uint32(rnd.Intn(64) * 64)
+			rel := target - uint32(len(code)+5)
+			code = append(code, 0xe8, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(code[len(code)-4:], rel)
+		}
+		return code
+	}
+	return build(0), build(100)
+}
+
+// makeARM64Code is like makeX86Code, for ARM64.
+func makeARM64Code(size int) (old, new []byte) {
+	rnd := rand.New(rand.NewSource(1))
+
+	build := func(inserted int) []byte {
+		rnd.Seed(1)
+		code := make([]byte, 0, size+inserted)
+		for len(code) < size+inserted {
+			if len(code) == 8192 {
+				for i := 0; i < inserted; i++ {
+					code = append(code, 0x1f, 0x20, 0x03, 0xd5) // NOP
+				}
+			}
+			instr := rnd.Uint32()
+			if len(code) >= 4096 && rnd.Intn(4) == 0 {
+				target := uint32(rnd.Intn(64) * 64)
+				instr = 0x94000000 | ((target-uint32(len(code)))>>2)&0x03ffffff
+			} else if instr>>26 == 0x25 || instr&0x9f000000 == 0x90000000 {
+				instr = 0xd503201f
+			}
+			code = append(code, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(code[len(code)-4:], instr)
+		}
+		return code
+	}
+	return build(0), build(25)
+}
+
+// negFilter is a toy filter used to test custom filters.
+type negFilter struct{}
+
+func (negFilter) ID() uint8 { return 200 }
+
+func (negFilter) NewEncoder(r io.Reader) io.Reader {
+	return &negReader{r}
+}
+
+func (negFilter) NewDecoder(w io.Writer) io.WriteCloser {
+	return &negWriter{w}
+}
+
+type negReader struct{ r io.Reader }
+
+func (n *negReader) Read(p []byte) (int, error) {
+	nr, err := n.r.Read(p)
+	for i := range p[:nr] {
+		p[i] = ^p[i]
+	}
+	return nr, err
+}
+
+type negWriter struct{ w io.Writer }
+
+func (n *negWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i := range p {
+		buf[i] = ^p[i]
+	}
+	return n.w.Write(buf)
+}
+
+func (n *negWriter) Close() error { return nil }
+
+func TestFilterRoundTrip(t *testing.T) {
+	x86, _ := makeX86Code(200 * 1024)
+	arm64, _ := makeARM64Code(200 * 1024)
+	random := make([]byte, 200*1024+3)
+	rand.New(rand.NewSource(2)).Read(random)
+
+	for name, f := range map[string]Filter{"x86": X86Filter{}, "arm64": ARM64Filter{}} {
+		for dataName, data := range map[string][]byte{"x86": x86, "arm64": arm64, "random": random, "short": random[:3], "empty": nil} {
+			t.Run(name+"/"+dataName, func(t *testing.T) {
+				r := require.New(t)
+
+				encoded, err := ioutil.ReadAll(f.NewEncoder(bytes.NewReader(data)))
+				r.NoError(err)
+				r.Len(encoded, len(data))
+
+				// The result doesn't depend on how data is read.
+				encodedByByte, err := ioutil.ReadAll(f.NewEncoder(iotest.OneByteReader(bytes.NewReader(data))))
+				r.NoError(err)
+				r.Equal(encoded, encodedByByte)
+
+				rnd := rand.New(rand.NewSource(3))
+				decoded := &bytes.Buffer{}
+				dw := f.NewDecoder(decoded)
+				for rest := encoded; len(rest) > 0; {
+					n := rnd.Intn(100000) + 1
+					if n > len(rest) {
+						n = len(rest)
+					}
+					_, err = dw.Write(rest[:n])
+					r.NoError(err)
+					rest = rest[n:]
+				}
+				r.NoError(dw.Close())
+				r.Equal(data, decoded.Bytes())
+			})
+		}
+	}
+}
+
+// TestFilterDelta checks that BCJ filters make deltas of shifted code smaller,
+// and that Patch reverts them.
+func TestFilterDelta(t *testing.T) {
+	x86Old, x86New := makeX86Code(512 * 1024)
+	arm64Old, arm64New := makeARM64Code(512 * 1024)
+
+	for _, tc := range []struct {
+		name     string
+		filter   Filter
+		old, new []byte
+	}{
+		{"x86", X86Filter{}, x86Old, x86New},
+		{"arm64", ARM64Filter{}, arm64Old, arm64New},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+			a := assert.New(t)
+
+			sig, err := FilteredSignature(tc.filter, bytes.NewReader(tc.old), &bytes.Buffer{}, 512, 32, BLAKE2_SIG_MAGIC)
+			r.NoError(err)
+			delta := &bytes.Buffer{}
+			r.NoError(DeltaWithOptions(sig, bytes.NewReader(tc.new), delta, DeltaOptions{Filter: tc.filter}))
+
+			output := &bytes.Buffer{}
+			r.NoError(Patch(bytes.NewReader(tc.old), bytes.NewReader(delta.Bytes()), output))
+			r.Equal(tc.new, output.Bytes())
+
+			plainSig, err := Signature(bytes.NewReader(tc.old), &bytes.Buffer{}, 512, 32, BLAKE2_SIG_MAGIC)
+			r.NoError(err)
+			plainDelta := &bytes.Buffer{}
+			r.NoError(Delta(plainSig, bytes.NewReader(tc.new), plainDelta))
+			a.Less(delta.Len()*4, plainDelta.Len())
+		})
+	}
+}
+
+func TestFilterRegistry(t *testing.T) {
+	r := require.New(t)
+
+	old := bytes.Repeat([]byte("some data "), 1000)
+	new := append([]byte("prefix"), old...)
+
+	sig, err := FilteredSignature(negFilter{}, bytes.NewReader(old), &bytes.Buffer{}, 64, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+	delta := &bytes.Buffer{}
+	opts := DeltaOptions{Filter: negFilter{}, TargetCopies: true}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(new), delta, opts))
+
+	// Unknown filters are rejected.
+	err = Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), &bytes.Buffer{})
+	r.EqualError(err, "unknown filter 200")
+
+	RegisterFilter(negFilter{})
+	defer func() {
+		filtersMu.Lock()
+		delete(filters, negFilter{}.ID())
+		filtersMu.Unlock()
+	}()
+
+	output := &bytes.Buffer{}
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output))
+	r.Equal(new, output.Bytes())
+}
@@ -0,0 +1,384 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Compression levels tried by GzipDelta to reproduce a gzip file, the most
+// common first.
+var gzipLevels = []int{
+	gzip.DefaultCompression, gzip.BestCompression, gzip.BestSpeed,
+	2, 3, 4, 5, 7, 8,
+	gzip.NoCompression, gzip.HuffmanOnly,
+}
+
+// Maximum length of the name, comment and extra field of a gzip header stored
+// in a delta.
+const maxGzipHeaderField = 1 << 20
+
+// Size of the chunks of decompressed data handled by GzipDelta.
+const gzipChunkSize = 32 * 1024
+
+// GzipSignature is like Signature, but signs the decompressed contents of the
+// gzip file read from input. The result is an ordinary signature, to be used
+// with GzipDelta.
+func GzipSignature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
+	zr, err := gzip.NewReader(input)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return Signature(zr, output, blockLen, strongLen, sigType)
+}
+
+// GzipDelta generates a delta from the basis of sig, a signature created by
+// GzipSignature, to the gzip file read from input. The input is read twice.
+//
+// If compress/gzip reproduces the input exactly, the delta applies to the
+// decompressed contents and records the gzip header and compression level
+// used, so that Patch recompresses its output into a byte-identical file.
+// This requires the basis to be a gzip file too, which Patch decompresses
+// into a temporary file, and can only be done by librsync-go.
+//
+// Otherwise, for instance for files created by other implementations or with
+// several members, the delta is an ordinary one with the whole input as
+// literal data. Filters aren't supported.
+func GzipDelta(sig *SignatureType, input io.ReadSeeker, output io.Writer, opts DeltaOptions) error {
+	if opts.Filter != nil {
+		return fmt.Errorf("filters aren't supported by gzip deltas")
+	}
+
+	params, err := probeGzip(input)
+	if err != nil {
+		return err
+	}
+	_, err = input.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if params == nil {
+		// Nothing in the basis can be copied from.
+		empty := &SignatureType{
+			SigType:    sig.SigType,
+			BlockLen:   sig.BlockLen,
+			StrongLen:  sig.StrongLen,
+			Weak2block: make(map[uint32]int),
+		}
+		return DeltaWithOptions(empty, input, output, opts)
+	}
+
+	zr, err := gzip.NewReader(input)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+
+	header := opts.header()
+	header.magic = DELTA_EXT_MAGIC
+	header.flags |= DELTA_FLAG_GZIP
+	header.gzip = params
+	return deltaWithHeader(sig, zr, output, opts, header)
+}
+
+// gzipParams describes how to recompress the output of a delta with
+// DELTA_FLAG_GZIP.
+type gzipParams struct {
+	level  int8
+	header gzip.Header
+
+	// Size and CRC-32 of the gzip file, to check the recompressed output.
+	size uint64
+	crc  uint32
+}
+
+// Bits of the flags of gzipParams.
+const gzipParamsExtra = 1
+
+func (g *gzipParams) write(w io.Writer) error {
+	var mtime uint32
+	if g.header.ModTime.After(time.Unix(0, 0)) {
+		mtime = uint32(g.header.ModTime.Unix())
+	}
+	var flags uint8
+	if g.header.Extra != nil {
+		flags |= gzipParamsExtra
+	}
+
+	for _, v := range []interface{}{g.level, g.header.OS, mtime, flags} {
+		err := binary.Write(w, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	fields := [][]byte{[]byte(g.header.Name), []byte(g.header.Comment)}
+	if g.header.Extra != nil {
+		fields = append(fields, g.header.Extra)
+	}
+	for _, field := range fields {
+		err := binary.Write(w, binary.BigEndian, uint32(len(field)))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(field)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := binary.Write(w, binary.BigEndian, g.size)
+	if err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, g.crc)
+}
+
+func readGzipParams(r io.Reader) (*gzipParams, error) {
+	g := &gzipParams{}
+	var mtime uint32
+	var flags uint8
+	for _, v := range []interface{}{&g.level, &g.header.OS, &mtime, &flags} {
+		err := binary.Read(r, binary.BigEndian, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mtime > 0 {
+		g.header.ModTime = time.Unix(int64(mtime), 0)
+	}
+
+	nfields := 2
+	if flags&gzipParamsExtra != 0 {
+		nfields++
+	}
+	fields := make([][]byte, nfields)
+	for i := range fields {
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxGzipHeaderField {
+			return nil, fmt.Errorf("gzip header field too long: %d bytes", n)
+		}
+		fields[i] = make([]byte, n)
+		_, err = io.ReadFull(r, fields[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	g.header.Name = string(fields[0])
+	g.header.Comment = string(fields[1])
+	if nfields > 2 {
+		g.header.Extra = fields[2]
+	}
+
+	err := binary.Read(r, binary.BigEndian, &g.size)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(r, binary.BigEndian, &g.crc)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// probeGzip finds how compress/gzip can reproduce the gzip file read from r,
+// by recompressing it at every level in parallel and comparing the results
+// with the original. It returns nil if no level does.
+func probeGzip(r io.Reader) (*gzipParams, error) {
+	rec := &gzipRecorder{crc: crc32.NewIEEE()}
+	br := bufio.NewReader(io.TeeReader(r, rec))
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+
+	var candidates []*gzipCandidate
+	for _, level := range gzipLevels {
+		c := &gzipCandidate{level: level, rec: rec}
+		c.zw, err = gzip.NewWriterLevel(c, level)
+		if err != nil {
+			return nil, err
+		}
+		c.zw.Header = zr.Header
+		candidates = append(candidates, c)
+	}
+
+	buf := make([]byte, gzipChunkSize)
+	for len(candidates) > 0 {
+		n, err := zr.Read(buf)
+		for _, c := range candidates {
+			c.write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		candidates = rec.trim(candidates)
+	}
+
+	// Trailing data or further members can't be reproduced.
+	_, err = br.Peek(1)
+	if err != io.EOF || len(candidates) == 0 {
+		return nil, nil
+	}
+
+	for _, c := range candidates {
+		c.close()
+		if !c.failed && c.off == rec.end() {
+			return &gzipParams{
+				level:  int8(c.level),
+				header: zr.Header,
+				size:   uint64(rec.end()),
+				crc:    rec.crc.Sum32(),
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// gzipRecorder keeps the part of a gzip file that the candidates of
+// probeGzip still have to compare their output with.
+type gzipRecorder struct {
+	// Offset of buf in the file.
+	base int64
+	buf  []byte
+
+	crc hash.Hash32
+}
+
+func (rec *gzipRecorder) Write(p []byte) (int, error) {
+	rec.buf = append(rec.buf, p...)
+	rec.crc.Write(p)
+	return len(p), nil
+}
+
+// end returns the number of bytes recorded so far.
+func (rec *gzipRecorder) end() int64 {
+	return rec.base + int64(len(rec.buf))
+}
+
+// trim drops the failed candidates, and the data all the others have already
+// compared.
+func (rec *gzipRecorder) trim(candidates []*gzipCandidate) []*gzipCandidate {
+	alive := candidates[:0]
+	min := rec.end()
+	for _, c := range candidates {
+		if c.failed {
+			continue
+		}
+		alive = append(alive, c)
+		if c.off < min {
+			min = c.off
+		}
+	}
+	rec.buf = rec.buf[min-rec.base:]
+	rec.base = min
+	return alive
+}
+
+// gzipCandidate compresses data at a given level, checking that the output
+// matches the recorded file.
+type gzipCandidate struct {
+	level int
+	zw    *gzip.Writer
+	rec   *gzipRecorder
+
+	// Number of bytes output so far, and whether they differ from the file.
+	off    int64
+	failed bool
+}
+
+func (c *gzipCandidate) write(p []byte) {
+	if !c.failed {
+		_, err := c.zw.Write(p)
+		c.failed = c.failed || err != nil
+	}
+}
+
+func (c *gzipCandidate) close() {
+	if !c.failed {
+		err := c.zw.Close()
+		c.failed = c.failed || err != nil
+	}
+}
+
+// Write receives the compressed output of c.zw.
+func (c *gzipCandidate) Write(p []byte) (int, error) {
+	start := c.off - c.rec.base
+	end := start + int64(len(p))
+	if end > int64(len(c.rec.buf)) || !bytes.Equal(p, c.rec.buf[start:end]) {
+		c.failed = true
+	}
+	c.off += int64(len(p))
+	return len(p), nil
+}
+
+// gzipOutput recompresses the output of a delta with DELTA_FLAG_GZIP.
+type gzipOutput struct {
+	zw     *gzip.Writer
+	params *gzipParams
+
+	// Size and CRC-32 of the compressed output.
+	size int64
+	crc  hash.Hash32
+	w    io.Writer
+}
+
+func newGzipOutput(w io.Writer, params *gzipParams) (*gzipOutput, error) {
+	o := &gzipOutput{params: params, crc: crc32.NewIEEE(), w: w}
+	zw, err := gzip.NewWriterLevel(writerFunc(o.writeCompressed), int(params.level))
+	if err != nil {
+		return nil, err
+	}
+	zw.Header = params.header
+	o.zw = zw
+	return o, nil
+}
+
+func (o *gzipOutput) Write(p []byte) (int, error) {
+	return o.zw.Write(p)
+}
+
+func (o *gzipOutput) writeCompressed(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.crc.Write(p[:n])
+	o.size += int64(n)
+	return n, err
+}
+
+// Close finishes the output, and checks that it is the gzip file the delta
+// was generated from.
+func (o *gzipOutput) Close() error {
+	err := o.zw.Close()
+	if err != nil {
+		return err
+	}
+	if uint64(o.size) != o.params.size || o.crc.Sum32() != o.params.crc {
+		return fmt.Errorf("recompressed output differs from the original gzip file")
+	}
+	return nil
+}
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
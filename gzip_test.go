@@ -0,0 +1,161 @@
+package librsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeGzip(t *testing.T, level int, header gzip.Header, data ...[]byte) []byte {
+	buf := &bytes.Buffer{}
+	zw, err := gzip.NewWriterLevel(buf, level)
+	require.NoError(t, err)
+	zw.Header = header
+	for _, d := range data {
+		_, err = zw.Write(d)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// gzipContents returns compressible data, and a copy with a few changes.
+func gzipContents() (old, new []byte) {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"lorem ", "ipsum ", "dolor ", "sit ", "amet ", "consectetur ", "adipiscing ", "elit\n"}
+	buf := &bytes.Buffer{}
+	for buf.Len() < 300*1024 {
+		buf.WriteString(words[rnd.Intn(len(words))])
+	}
+	old = buf.Bytes()
+
+	new = append([]byte{}, old[:1000]...)
+	new = append(new, "inserted text"...)
+	new = append(new, old[1000:150000]...)
+	new = append(new, old[160000:]...)
+	return old, new
+}
+
+// TestGzipDelta checks that deltas of gzip files are computed on their
+// contents, and recompress into the exact new file.
+func TestGzipDelta(t *testing.T) {
+	header := gzip.Header{
+		Name:    "file.txt",
+		Comment: "a comment",
+		Extra:   []byte{'A', 'B', 2, 0, 1, 2},
+		ModTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		OS:      3,
+	}
+
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression, 4, gzip.NoCompression, gzip.HuffmanOnly} {
+		t.Run(gzipLevelName(level), func(t *testing.T) {
+			r := require.New(t)
+			a := assert.New(t)
+
+			oldData, newData := gzipContents()
+			old := makeGzip(t, level, header, oldData)
+			newGz := makeGzip(t, level, header, newData[:5000], newData[5000:])
+
+			sig, err := GzipSignature(bytes.NewReader(old), &bytes.Buffer{}, 2048, 32, BLAKE2_SIG_MAGIC)
+			r.NoError(err)
+
+			var stats DeltaStats
+			delta := &bytes.Buffer{}
+			r.NoError(GzipDelta(sig, bytes.NewReader(newGz), delta, DeltaOptions{Stats: &stats}))
+			a.Less(stats.LitBytes, uint64(3*2048))
+			a.Less(delta.Len(), 8*1024)
+
+			output := &bytes.Buffer{}
+			r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output))
+			a.Equal(newGz, output.Bytes())
+		})
+	}
+}
+
+func gzipLevelName(level int) string {
+	switch level {
+	case gzip.DefaultCompression:
+		return "default"
+	case gzip.HuffmanOnly:
+		return "huffman-only"
+	}
+	return string(rune('0' + level))
+}
+
+func TestGzipDeltaExtensions(t *testing.T) {
+	r := require.New(t)
+
+	oldData, newData := gzipContents()
+	old := makeGzip(t, gzip.BestSpeed, gzip.Header{}, oldData)
+	newGz := makeGzip(t, gzip.BestSpeed, gzip.Header{}, newData, newData[:100000])
+
+	sig, err := GzipSignature(bytes.NewReader(old), &bytes.Buffer{}, 1024, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+
+	delta := &bytes.Buffer{}
+	opts := DeltaOptions{TargetCopies: true, Fill: true, LiteralCodec: &FlateCodec{Level: 9}}
+	r.NoError(GzipDelta(sig, bytes.NewReader(newGz), delta, opts))
+
+	// Target copies read back the decompressed output.
+	output := &bytes.Buffer{}
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output))
+	r.Equal(newGz, output.Bytes())
+}
+
+// TestGzipDeltaFallback checks that gzip files compress/gzip can't reproduce
+// are sent whole.
+func TestGzipDeltaFallback(t *testing.T) {
+	oldData, newData := gzipContents()
+	old := makeGzip(t, gzip.DefaultCompression, gzip.Header{}, oldData)
+
+	members := append(makeGzip(t, gzip.DefaultCompression, gzip.Header{}, newData[:1000]),
+		makeGzip(t, gzip.DefaultCompression, gzip.Header{}, newData[1000:])...)
+	trailing := append(makeGzip(t, gzip.DefaultCompression, gzip.Header{}, newData), "trailing"...)
+	// A valid gzip file, compressed as a single stored block unlike what
+	// compress/gzip would do.
+	stored := append([]byte{}, makeGzip(t, gzip.NoCompression, gzip.Header{})...)
+	stored = append(stored[:10], 1, 5, 0, 0xfa, 0xff, 'h', 'e', 'l', 'l', 'o')
+	stored = append(stored, 0x86, 0xa6, 0x10, 0x36, 5, 0, 0, 0)
+
+	for name, newGz := range map[string][]byte{"members": members, "trailing": trailing, "stored": stored} {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+
+			sig, err := GzipSignature(bytes.NewReader(old), &bytes.Buffer{}, 2048, 32, BLAKE2_SIG_MAGIC)
+			r.NoError(err)
+
+			var stats DeltaStats
+			delta := &bytes.Buffer{}
+			r.NoError(GzipDelta(sig, bytes.NewReader(newGz), delta, DeltaOptions{Stats: &stats}))
+			r.Equal(uint64(len(newGz)), stats.LitBytes)
+
+			// The delta doesn't depend on the basis.
+			output := &bytes.Buffer{}
+			r.NoError(Patch(bytes.NewReader(nil), bytes.NewReader(delta.Bytes()), output))
+			r.Equal(newGz, output.Bytes())
+		})
+	}
+}
+
+func TestGzipInvalid(t *testing.T) {
+	r := require.New(t)
+
+	notGzip := bytes.Repeat([]byte("not a gzip file"), 100)
+	_, err := GzipSignature(bytes.NewReader(notGzip), &bytes.Buffer{}, 512, 32, BLAKE2_SIG_MAGIC)
+	r.Error(err)
+
+	sig, err := GzipSignature(bytes.NewReader(makeGzip(t, 6, gzip.Header{}, notGzip)), &bytes.Buffer{}, 512, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+	r.Error(GzipDelta(sig, bytes.NewReader(notGzip), &bytes.Buffer{}, DeltaOptions{}))
+
+	// Patching a gzip delta needs a gzip basis.
+	newGz := makeGzip(t, 6, gzip.Header{}, notGzip[10:])
+	delta := &bytes.Buffer{}
+	r.NoError(GzipDelta(sig, bytes.NewReader(newGz), delta, DeltaOptions{}))
+	r.Error(Patch(bytes.NewReader(notGzip), bytes.NewReader(delta.Bytes()), &bytes.Buffer{}))
+}
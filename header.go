@@ -0,0 +1,183 @@
+package librsync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DeltaFlags describes which librsync-go extensions are used by a delta
+// starting with DELTA_EXT_MAGIC.
+type DeltaFlags uint32
+
+const (
+	// The delta may contain OP_TARGET_COPY_* commands, which copy data from
+	// the part of the output that has already been reconstructed.
+	DELTA_FLAG_TARGET_COPY DeltaFlags = 1 << iota
+
+	// The delta may contain OP_LITERAL_Z_* commands, whose data is compressed.
+	// The flags are followed by the uint8 ID of the LiteralCodec used.
+	DELTA_FLAG_COMPRESSED_LITERALS
+
+	// The delta may contain OP_FILL_* commands, which repeat a single byte.
+	DELTA_FLAG_FILL
+
+	// The basis and the output are gzip files, and the commands apply to
+	// their decompressed contents. The flags are followed by the parameters
+	// needed to recompress the output, see GzipDelta.
+	DELTA_FLAG_GZIP
+
+	// The basis and the output are transformed by a Filter, and the commands
+	// apply to the transformed data. The flags are followed by the uint8 ID of
+	// the Filter.
+	DELTA_FLAG_FILTER
+
+	// The delta overwrites its basis, and must be applied by PatchInPlace. Its
+	// commands are not in output order: it may contain OP_SEEK_*, OP_STASH_*
+	// and OP_UNSTASH_* commands. The flags are followed by the parameters of
+	// the patch, see InPlaceDelta.
+	DELTA_FLAG_IN_PLACE
+)
+
+// All the flags this version knows how to handle.
+const knownDeltaFlags = DELTA_FLAG_TARGET_COPY | DELTA_FLAG_COMPRESSED_LITERALS |
+	DELTA_FLAG_FILL | DELTA_FLAG_GZIP | DELTA_FLAG_FILTER | DELTA_FLAG_IN_PLACE
+
+// deltaHeader holds the information found at the start of a delta.
+type deltaHeader struct {
+	magic MagicNumber
+	flags DeltaFlags
+
+	// ID of the LiteralCodec, with DELTA_FLAG_COMPRESSED_LITERALS.
+	codec uint8
+
+	// How to recompress the output, with DELTA_FLAG_GZIP.
+	gzip *gzipParams
+
+	// ID of the Filter, with DELTA_FLAG_FILTER.
+	filter uint8
+
+	// Parameters of the patch, with DELTA_FLAG_IN_PLACE.
+	inPlace *inPlaceParams
+}
+
+func (h deltaHeader) has(flag DeltaFlags) bool {
+	return h.flags&flag != 0
+}
+
+// extended tells if the header describes a delta which can only be read by
+// librsync-go.
+func (h deltaHeader) extended() bool {
+	return h.magic == DELTA_EXT_MAGIC
+}
+
+// allows tells if commands of the given kind may appear in the delta.
+func (h deltaHeader) allows(kind OpKind) bool {
+	switch kind {
+	case KIND_END, KIND_LITERAL, KIND_COPY:
+		return true
+	case KIND_TARGET_COPY:
+		return h.has(DELTA_FLAG_TARGET_COPY)
+	case KIND_LITERAL_Z:
+		return h.has(DELTA_FLAG_COMPRESSED_LITERALS)
+	case KIND_FILL:
+		return h.has(DELTA_FLAG_FILL)
+	case KIND_SEEK, KIND_STASH, KIND_UNSTASH:
+		return h.has(DELTA_FLAG_IN_PLACE)
+	}
+	return false
+}
+
+func writeDeltaHeader(w io.Writer, h deltaHeader) error {
+	if !h.extended() {
+		return binary.Write(w, binary.BigEndian, DELTA_MAGIC)
+	}
+
+	err := binary.Write(w, binary.BigEndian, DELTA_EXT_MAGIC)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.BigEndian, h.flags)
+	if err != nil {
+		return err
+	}
+
+	// Flag parameters follow, in the order of the flags.
+	if h.has(DELTA_FLAG_COMPRESSED_LITERALS) {
+		err = binary.Write(w, binary.BigEndian, h.codec)
+		if err != nil {
+			return err
+		}
+	}
+	if h.has(DELTA_FLAG_GZIP) {
+		err = h.gzip.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	if h.has(DELTA_FLAG_FILTER) {
+		err = binary.Write(w, binary.BigEndian, h.filter)
+		if err != nil {
+			return err
+		}
+	}
+	if h.has(DELTA_FLAG_IN_PLACE) {
+		err = h.inPlace.write(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readDeltaHeader(r io.Reader) (deltaHeader, error) {
+	var h deltaHeader
+
+	err := binary.Read(r, binary.BigEndian, &h.magic)
+	if err != nil {
+		return h, err
+	}
+
+	switch h.magic {
+	case DELTA_MAGIC:
+		return h, nil
+	case DELTA_EXT_MAGIC:
+		err = binary.Read(r, binary.BigEndian, &h.flags)
+		if err != nil {
+			return h, err
+		}
+		if h.flags&^knownDeltaFlags != 0 {
+			return h, fmt.Errorf("unsupported delta flags %#x", h.flags&^knownDeltaFlags)
+		}
+		if h.has(DELTA_FLAG_COMPRESSED_LITERALS) {
+			err = binary.Read(r, binary.BigEndian, &h.codec)
+			if err != nil {
+				return h, err
+			}
+		}
+		if h.has(DELTA_FLAG_GZIP) {
+			h.gzip, err = readGzipParams(r)
+			if err != nil {
+				return h, err
+			}
+		}
+		if h.has(DELTA_FLAG_FILTER) {
+			err = binary.Read(r, binary.BigEndian, &h.filter)
+			if err != nil {
+				return h, err
+			}
+		}
+		if h.has(DELTA_FLAG_IN_PLACE) {
+			h.inPlace, err = readInPlaceParams(r)
+			if err != nil {
+				return h, err
+			}
+		}
+		return h, nil
+	case SIGNED_MAGIC:
+		return h, fmt.Errorf("signed delta, must be applied with a Verifier")
+	}
+
+	return h, fmt.Errorf("Got magic number %x rather than expected value %x", h.magic, DELTA_MAGIC)
+}
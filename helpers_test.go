@@ -73,3 +73,29 @@ func argsFromTestName(name string) (file string, magic MagicNumber, blockLen, st
 
 	return
 }
+
+// deltaOptionSets returns the sets of delta extensions with the given names,
+// or all of them if no name is given: "plain", each extension alone, and
+// "all" of them together.
+func deltaOptionSets(names ...string) map[string]DeltaOptions {
+	sets := map[string]DeltaOptions{
+		"plain":         {},
+		"target-copies": {TargetCopies: true},
+		"fill":          {Fill: true},
+		"compressed":    {LiteralCodec: &FlateCodec{}},
+		"all":           {TargetCopies: true, Fill: true, LiteralCodec: &FlateCodec{}},
+	}
+	if len(names) == 0 {
+		return sets
+	}
+
+	selected := make(map[string]DeltaOptions, len(names))
+	for _, name := range names {
+		opts, ok := sets[name]
+		if !ok {
+			panic(fmt.Sprintf("unknown delta option set %q", name))
+		}
+		selected[name] = opts
+	}
+	return selected
+}
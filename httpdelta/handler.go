@@ -0,0 +1,262 @@
+package httpdelta
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// Default limits of HandlerOptions.
+const (
+	DEFAULT_MAX_SIGNATURE_SIZE = 16 * 1024 * 1024
+	DEFAULT_MAX_RESPONSE_SIZE  = 256 * 1024 * 1024
+	DEFAULT_MAX_BLOCK_LEN      = 1024 * 1024
+)
+
+// HandlerOptions configures the handler returned by NewHandler.
+type HandlerOptions struct {
+	// Signatures larger than this are ignored, and the full response is sent.
+	// If zero, DEFAULT_MAX_SIGNATURE_SIZE is used.
+	MaxSignatureSize int64
+
+	// The wrapped handler's response is buffered to compute the delta.
+	// Responses larger than this are sent as is. If zero,
+	// DEFAULT_MAX_RESPONSE_SIZE is used.
+	MaxResponseSize int64
+
+	// Signatures with blocks larger than this are ignored, as a block is
+	// kept in memory while computing the delta. If zero,
+	// DEFAULT_MAX_BLOCK_LEN is used.
+	MaxBlockLen uint32
+
+	// Number of parsed signatures kept in memory, so that clients sending
+	// the same signature don't need it parsed again. If zero, signatures are
+	// not cached.
+	SignatureCacheSize int
+
+	// Extensions used in the deltas. Only librsync-go clients can apply
+	// deltas using them. The options are shared by all requests, which are
+	// served concurrently, so LitBuff, Stats and Checkpoint are ignored.
+	DeltaOptions librsync.DeltaOptions
+}
+
+type handler struct {
+	next http.Handler
+	opts HandlerOptions
+	sigs *signatureCache
+}
+
+// NewHandler wraps next so that it answers requests with a signature and
+// "A-IM: librsync" with a delta, when this is smaller than the response of
+// next.
+//
+// Only successful responses to GET requests are delta encoded. The wrapped
+// handler sees the requests without the signature.
+func NewHandler(next http.Handler, opts HandlerOptions) http.Handler {
+	if opts.MaxSignatureSize == 0 {
+		opts.MaxSignatureSize = DEFAULT_MAX_SIGNATURE_SIZE
+	}
+	if opts.MaxResponseSize == 0 {
+		opts.MaxResponseSize = DEFAULT_MAX_RESPONSE_SIZE
+	}
+	if opts.MaxBlockLen == 0 {
+		opts.MaxBlockLen = DEFAULT_MAX_BLOCK_LEN
+	}
+	return &handler{
+		next: next,
+		opts: opts,
+		sigs: newSignatureCache(opts.SignatureCacheSize),
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "A-IM")
+
+	if r.Method != http.MethodGet || !hasIM(r.Header, "A-IM", IM) || r.ContentLength == 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	sig := h.readSignature(r)
+
+	// Hide the signature from the wrapped handler.
+	r = r.Clone(r.Context())
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.Header.Del("Content-Type")
+	r.Header.Del("Content-Length")
+
+	if sig == nil {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	bw := &bufferingWriter{w: w, header: make(http.Header), max: h.opts.MaxResponseSize}
+	h.next.ServeHTTP(bw, r)
+	if bw.passthrough {
+		return
+	}
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+
+	deltaOpts := h.opts.DeltaOptions
+	deltaOpts.LitBuff, deltaOpts.Stats, deltaOpts.Checkpoint = nil, nil, nil
+	delta := &bytes.Buffer{}
+	err := librsync.DeltaWithOptions(sig, bytes.NewReader(bw.buf.Bytes()), delta, deltaOpts)
+	if err != nil || delta.Len() >= bw.buf.Len() {
+		bw.flush()
+		return
+	}
+
+	header := w.Header()
+	for k, v := range bw.header {
+		header[k] = v
+	}
+	header.Set("IM", IM)
+	header.Add("Cache-Control", "im")
+	header.Set("Content-Length", strconv.Itoa(delta.Len()))
+	header.Del("Content-Range")
+	w.WriteHeader(http.StatusIMUsed)
+	w.Write(delta.Bytes())
+}
+
+// readSignature reads the signature in the body of r, returning nil if it is
+// missing, too large or invalid.
+func (h *handler) readSignature(r *http.Request) *librsync.SignatureType {
+	defer r.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, h.opts.MaxSignatureSize+1))
+	if err != nil || int64(len(data)) > h.opts.MaxSignatureSize {
+		return nil
+	}
+
+	key := sha256.Sum256(data)
+	if sig := h.sigs.get(key); sig != nil {
+		return sig
+	}
+	sig, err := librsync.ReadSignature(bytes.NewReader(data))
+	if err != nil || librsync.CheckSignature(sig, h.opts.MaxBlockLen) != nil {
+		return nil
+	}
+	h.sigs.put(key, sig)
+	return sig
+}
+
+// bufferingWriter buffers a successful response, as long as it is small
+// enough. Other responses are passed through.
+type bufferingWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+	buf    bytes.Buffer
+	max    int64
+
+	passthrough bool
+}
+
+func (bw *bufferingWriter) Header() http.Header {
+	if bw.passthrough {
+		return bw.w.Header()
+	}
+	return bw.header
+}
+
+func (bw *bufferingWriter) WriteHeader(status int) {
+	if bw.status != 0 || bw.passthrough {
+		return
+	}
+	bw.status = status
+	if status != http.StatusOK {
+		bw.flush()
+	}
+}
+
+func (bw *bufferingWriter) Write(p []byte) (int, error) {
+	if bw.status == 0 {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.passthrough && int64(bw.buf.Len()+len(p)) > bw.max {
+		bw.flush()
+	}
+	if bw.passthrough {
+		return bw.w.Write(p)
+	}
+	return bw.buf.Write(p)
+}
+
+// flush sends the buffered response as is, and passes through the rest.
+func (bw *bufferingWriter) flush() {
+	if bw.passthrough {
+		return
+	}
+	bw.passthrough = true
+
+	header := bw.w.Header()
+	for k, v := range bw.header {
+		header[k] = v
+	}
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	bw.w.WriteHeader(bw.status)
+	bw.w.Write(bw.buf.Bytes())
+	bw.buf = bytes.Buffer{}
+}
+
+// signatureCache is an LRU cache of parsed signatures, keyed by the SHA-256 of
+// their serialized form.
+type signatureCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type signatureCacheEntry struct {
+	key [sha256.Size]byte
+	sig *librsync.SignatureType
+}
+
+func newSignatureCache(size int) *signatureCache {
+	return &signatureCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+func (c *signatureCache) get(key [sha256.Size]byte) *librsync.SignatureType {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*signatureCacheEntry).sig
+}
+
+func (c *signatureCache) put(key [sha256.Size]byte, sig *librsync.SignatureType) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&signatureCacheEntry{key, sig})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*signatureCacheEntry).key)
+	}
+}
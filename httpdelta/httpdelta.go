@@ -0,0 +1,38 @@
+// Package httpdelta implements RFC 3229 delta encoding in HTTP with librsync
+// deltas.
+//
+// A client holding a cached copy of a resource sends its signature in the body
+// of the GET request, along with "A-IM: librsync". A server wrapped with
+// NewHandler computes the delta between the cached copy and the current
+// resource, and answers "226 IM Used" with the delta as body if it is smaller
+// than the resource. Transport implements the client side, patching deltas
+// against a Cache so that callers always see the full resource.
+package httpdelta
+
+import (
+	"net/http"
+	"strings"
+)
+
+// IM is the instance manipulation name of librsync deltas, used in the A-IM
+// and IM headers.
+const IM = "librsync"
+
+// SignatureContentType is the media type of the signatures sent by clients.
+const SignatureContentType = "application/x-librsync-signature"
+
+// hasIM tells whether the header key of h lists the instance manipulation im.
+func hasIM(h http.Header, key, im string) bool {
+	for _, v := range h.Values(key) {
+		for _, token := range strings.Split(v, ",") {
+			// Drop parameters, like in "librsync;q=0.5".
+			if i := strings.IndexByte(token, ';'); i >= 0 {
+				token = token[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(token), im) {
+				return true
+			}
+		}
+	}
+	return false
+}
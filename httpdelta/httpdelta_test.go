@@ -0,0 +1,285 @@
+package httpdelta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/balena-os/librsync-go"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// resource serves data that can be changed between requests.
+type resource struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (res *resource) set(data []byte) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.data = data
+}
+
+func (res *resource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength != 0 {
+		http.Error(w, "unexpected body", http.StatusBadRequest)
+		return
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(res.data)
+}
+
+// recorder records the responses seen by the client before they go through
+// Transport.
+type recorder struct {
+	base     http.RoundTripper
+	statuses []int
+	bytes    int64
+}
+
+func (rec *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rec.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	rec.statuses = append(rec.statuses, resp.StatusCode)
+	rec.bytes += int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func newClient(srv *httptest.Server, cache Cache) (*http.Client, *recorder) {
+	rec := &recorder{base: srv.Client().Transport}
+	return &http.Client{Transport: &Transport{Base: rec, Cache: cache}}, rec
+}
+
+func get(t *testing.T, c *http.Client, url string) []byte {
+	resp, err := c.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(body)), resp.ContentLength)
+	return body
+}
+
+func TestHandlerAndTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cache func(t *testing.T) Cache
+	}{
+		{"mem-cache", func(t *testing.T) Cache { return &MemCache{} }},
+		{"dir-cache", func(t *testing.T) Cache { return DirCache(t.TempDir()) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+
+			v1 := randomData(1, 200*1024)
+			v2 := append(append([]byte{}, v1[:100000]...), []byte("new data")...)
+			v2 = append(v2, v1[100000:]...)
+
+			res := &resource{data: v1}
+			srv := httptest.NewServer(NewHandler(res, HandlerOptions{}))
+			defer srv.Close()
+			c, rec := newClient(srv, tc.cache(t))
+
+			r.Equal(v1, get(t, c, srv.URL))
+			r.Equal([]int{http.StatusOK}, rec.statuses)
+
+			res.set(v2)
+			r.Equal(v2, get(t, c, srv.URL))
+			r.Equal([]int{http.StatusOK, http.StatusIMUsed}, rec.statuses)
+			r.Less(rec.bytes, int64(len(v1)+len(v2)/10))
+
+			// The cache holds the patched copy, so the next delta is empty.
+			r.Equal(v2, get(t, c, srv.URL))
+			r.Equal([]int{http.StatusOK, http.StatusIMUsed, http.StatusIMUsed}, rec.statuses)
+		})
+	}
+}
+
+func TestHandlerPassthrough(t *testing.T) {
+	r := require.New(t)
+
+	data := randomData(1, 64*1024)
+	srv := httptest.NewServer(NewHandler(&resource{data: data}, HandlerOptions{}))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	r.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	r.Equal(http.StatusOK, resp.StatusCode)
+	r.Equal(data, body)
+	r.Equal("A-IM", resp.Header.Get("Vary"))
+	r.Empty(resp.Header.Get("IM"))
+}
+
+func TestHandlerLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   HandlerOptions
+		status int
+	}{
+		{"defaults", HandlerOptions{}, http.StatusIMUsed},
+		{"max-response-size", HandlerOptions{MaxResponseSize: 1000}, http.StatusOK},
+		{"max-signature-size", HandlerOptions{MaxSignatureSize: 100}, http.StatusOK},
+		{"max-block-len", HandlerOptions{MaxBlockLen: 1024}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+
+			data := randomData(1, 64*1024)
+			srv := httptest.NewServer(NewHandler(&resource{data: data}, tc.opts))
+			defer srv.Close()
+			c, rec := newClient(srv, &MemCache{})
+
+			r.Equal(data, get(t, c, srv.URL))
+			r.Equal(data, get(t, c, srv.URL))
+			r.Equal([]int{http.StatusOK, tc.status}, rec.statuses)
+		})
+	}
+}
+
+func TestHandlerErrorStatus(t *testing.T) {
+	r := require.New(t)
+
+	notFound := false
+	srv := httptest.NewServer(NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notFound {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(randomData(1, 4096))
+	}), HandlerOptions{}))
+	defer srv.Close()
+	c, _ := newClient(srv, &MemCache{})
+
+	get(t, c, srv.URL)
+	notFound = true
+	resp, err := c.Get(srv.URL)
+	r.NoError(err)
+	resp.Body.Close()
+	r.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSignatureCache(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	data := randomData(1, 16*1024)
+	h := NewHandler(&resource{data: data}, HandlerOptions{SignatureCacheSize: 1}).(*handler)
+
+	request := func(blockLen uint32) int {
+		sig := &bytes.Buffer{}
+		_, err := librsync.Signature(bytes.NewReader(data), sig, blockLen, 32, librsync.BLAKE2_SIG_MAGIC)
+		r.NoError(err)
+
+		req := httptest.NewRequest(http.MethodGet, "/", sig)
+		req.Header.Set("A-IM", "vcdiff, librsync;q=0.5")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	a.Equal(http.StatusIMUsed, request(512))
+	a.Equal(1, h.sigs.lru.Len())
+	first := h.sigs.lru.Front().Value.(*signatureCacheEntry).sig
+
+	a.Equal(http.StatusIMUsed, request(512))
+	a.Same(first, h.sigs.lru.Front().Value.(*signatureCacheEntry).sig)
+
+	a.Equal(http.StatusIMUsed, request(1024))
+	a.Equal(1, h.sigs.lru.Len())
+	a.NotSame(first, h.sigs.lru.Front().Value.(*signatureCacheEntry).sig)
+}
+
+// TestHandlerInvalidSignature checks that signatures which can't be used to
+// compute a delta get the full response.
+func TestHandlerInvalidSignature(t *testing.T) {
+	a := assert.New(t)
+
+	data := randomData(1, 16*1024)
+	h := NewHandler(&resource{data: data}, HandlerOptions{})
+
+	for _, sig := range []*librsync.SignatureType{
+		{SigType: librsync.BLAKE2_SIG_MAGIC, BlockLen: 0, StrongLen: 32},
+		{SigType: librsync.BLAKE2_SIG_MAGIC, BlockLen: DEFAULT_MAX_BLOCK_LEN + 1, StrongLen: 32},
+		{SigType: librsync.BLAKE2_SIG_MAGIC, BlockLen: 2048, StrongLen: 33},
+		{SigType: librsync.MD4_SIG_MAGIC, BlockLen: 2048, StrongLen: 17},
+		{SigType: librsync.DELTA_MAGIC, BlockLen: 2048, StrongLen: 8},
+	} {
+		// A header and the sums of one block.
+		body := &bytes.Buffer{}
+		binary.Write(body, binary.BigEndian, []uint32{uint32(sig.SigType), sig.BlockLen, sig.StrongLen, 1})
+		body.Write(make([]byte, sig.StrongLen))
+
+		req := httptest.NewRequest(http.MethodGet, "/", body)
+		req.Header.Set("A-IM", IM)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		a.Equal(http.StatusOK, w.Code, "%+v", sig)
+		a.Equal(data, w.Body.Bytes(), "%+v", sig)
+	}
+}
+
+func TestHandlerConcurrentRequests(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	v1 := randomData(1, 200*1024)
+	v2 := append(append([]byte{}, v1[:100000]...), []byte("new data")...)
+	v2 = append(v2, v1[100000:]...)
+	sig := &bytes.Buffer{}
+	_, err := librsync.Signature(bytes.NewReader(v1), sig, 2048, 32, librsync.BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+
+	// The buffer and statistics of the options aren't shared by the requests.
+	stats := &librsync.DeltaStats{}
+	h := NewHandler(&resource{data: v2}, HandlerOptions{DeltaOptions: librsync.DeltaOptions{
+		LitBuff: make([]byte, 0, librsync.OUTPUT_BUFFER_SIZE),
+		Stats:   stats,
+	}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(sig.Bytes()))
+			req.Header.Set("A-IM", IM)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			a.Equal(http.StatusIMUsed, w.Code)
+
+			out := &bytes.Buffer{}
+			a.NoError(librsync.Patch(bytes.NewReader(v1), w.Body, out))
+			a.Equal(v2, out.Bytes())
+		}()
+	}
+	wg.Wait()
+	a.Equal(librsync.DeltaStats{}, *stats)
+}
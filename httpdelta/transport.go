@@ -0,0 +1,258 @@
+package httpdelta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// Cache stores the copies of resources that deltas are applied to.
+type Cache interface {
+	// Get returns the cached copy of the resource with the given key, or an
+	// error satisfying errors.Is(err, os.ErrNotExist) if there is none.
+	Get(key string) (io.ReadSeekCloser, error)
+
+	// Put stores the copy of the resource read from r. Copies previously
+	// returned by Get must remain readable.
+	Put(key string, r io.Reader) error
+}
+
+// Transport is an http.RoundTripper asking servers for deltas against the
+// copies of resources found in its cache.
+//
+// Successful responses to GET requests are stored in the cache before being
+// returned, with deltas already applied: callers always get "200 OK" and the
+// full resource.
+type Transport struct {
+	// Transport used to send requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	Cache Cache
+
+	// Parameters of the signatures sent to servers, as in
+	// librsync.Signature. If zero, 2048 byte blocks with 32 byte BLAKE2 sums
+	// are used.
+	BlockLen  uint32
+	StrongLen uint32
+	SigType   librsync.MagicNumber
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Cache == nil || req.Method != http.MethodGet || (req.Body != nil && req.Body != http.NoBody) {
+		return t.base().RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	cached, err := t.Cache.Get(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return t.fetch(req, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer cached.Close()
+
+	sig := &bytes.Buffer{}
+	err = t.signature(cached, sig)
+	if err != nil {
+		return nil, err
+	}
+
+	dreq := req.Clone(req.Context())
+	dreq.Header.Set("A-IM", IM)
+	dreq.Header.Set("Content-Type", SignatureContentType)
+	dreq.Body = ioutil.NopCloser(sig)
+	dreq.ContentLength = int64(sig.Len())
+	dreq.GetBody = nil
+
+	resp, err := t.base().RoundTrip(dreq)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusIMUsed && resp.Header.Get("IM") == IM:
+		defer resp.Body.Close()
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			pw.CloseWithError(librsync.Patch(cached, resp.Body, pw))
+			close(done)
+		}()
+		err = t.Cache.Put(key, pr)
+		pr.CloseWithError(err)
+		<-done
+		if err != nil {
+			return nil, fmt.Errorf("httpdelta: patching %s: %w", key, err)
+		}
+
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Header.Del("IM")
+		return t.fromCache(req, resp, key)
+	case resp.StatusCode == http.StatusOK:
+		return t.store(req, resp, key)
+	default:
+		return resp, nil
+	}
+}
+
+// signature writes the signature of cached to w, and rewinds cached.
+func (t *Transport) signature(cached io.ReadSeeker, w io.Writer) error {
+	blockLen, strongLen, sigType := t.BlockLen, t.StrongLen, t.SigType
+	if blockLen == 0 {
+		blockLen = 2048
+	}
+	if sigType == 0 {
+		sigType = librsync.BLAKE2_SIG_MAGIC
+	}
+	if strongLen == 0 {
+		strongLen = 32
+		if sigType == librsync.MD4_SIG_MAGIC {
+			strongLen = librsync.MD4_SUM_LENGTH
+		}
+	}
+
+	_, err := librsync.Signature(cached, w, blockLen, strongLen, sigType)
+	if err != nil {
+		return err
+	}
+	_, err = cached.Seek(0, io.SeekStart)
+	return err
+}
+
+// fetch sends req as is, storing a successful response in the cache.
+func (t *Transport) fetch(req *http.Request, key string) (*http.Response, error) {
+	resp, err := t.base().RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	return t.store(req, resp, key)
+}
+
+// store puts the body of resp in the cache, and returns resp reading it from
+// there.
+func (t *Transport) store(req *http.Request, resp *http.Response, key string) (*http.Response, error) {
+	err := t.Cache.Put(key, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return t.fromCache(req, resp, key)
+}
+
+// fromCache returns resp with the cached copy of the resource as body.
+func (t *Transport) fromCache(req *http.Request, resp *http.Response, key string) (*http.Response, error) {
+	body, err := t.Cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	size, err := body.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	resp.Body = body
+	resp.ContentLength = size
+	resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	resp.TransferEncoding = nil
+	resp.Uncompressed = false
+	resp.Request = req
+	return resp, nil
+}
+
+// MemCache is a Cache keeping resources in memory.
+type MemCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (c *MemCache) Get(key string) (io.ReadSeekCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+func (c *MemCache) Put(key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		c.data = make(map[string][]byte)
+	}
+	c.data[key] = data
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// DirCache is a Cache keeping resources as files in a directory, named after
+// the SHA-256 of their keys.
+type DirCache string
+
+func (d DirCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(string(d), hex.EncodeToString(sum[:]))
+}
+
+func (d DirCache) Get(key string) (io.ReadSeekCloser, error) {
+	return os.Open(d.path(key))
+}
+
+func (d DirCache) Put(key string, r io.Reader) error {
+	f, err := ioutil.TempFile(string(d), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Replacing the file keeps open copies readable.
+	return os.Rename(f.Name(), d.path(key))
+}
@@ -0,0 +1,447 @@
+package librsync
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var errInPlaceDelta = errors.New("in-place delta, must be applied with PatchInPlace")
+
+// Maximum length of the copies planned by InPlaceDelta. Longer copies are
+// split, so that only the pieces actually involved in cycles are stashed or
+// sent as literals.
+const inPlacePieceSize = 1024 * 1024
+
+// Scratch size used by InPlaceDelta when none is given.
+const defaultScratchSize = 16 * 1024 * 1024
+
+// inPlaceParams are the parameters of a delta with DELTA_FLAG_IN_PLACE.
+type inPlaceParams struct {
+	// Size of the output, to which the file is truncated at the end.
+	size uint64
+
+	// Number of bytes stashed by the delta.
+	scratch uint64
+
+	// Identifies the delta in the journal of PatchInPlace.
+	id uint64
+}
+
+func (p *inPlaceParams) write(w io.Writer) error {
+	for _, v := range []uint64{p.size, p.scratch, p.id} {
+		err := binary.Write(w, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readInPlaceParams(r io.Reader) (*inPlaceParams, error) {
+	p := &inPlaceParams{}
+	for _, v := range []*uint64{&p.size, &p.scratch, &p.id} {
+		err := binary.Read(r, binary.BigEndian, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// InPlaceOptions controls how InPlaceDelta plans a delta.
+type InPlaceOptions struct {
+	// Delta selects the extensions used by the delta, see DeltaOptions.
+	// TargetCopies and Filter aren't supported.
+	Delta DeltaOptions
+
+	// ScratchSize bounds the memory used by PatchInPlace to stash data read
+	// before being overwritten. If zero, 16 MiB are used.
+	ScratchSize uint64
+}
+
+// InPlaceDelta generates a delta from the basis with signature sig to input,
+// like DeltaWithOptions, that overwrites the basis when applied with
+// PatchInPlace. input is read twice.
+//
+// Copies are ordered so that no data of the basis is overwritten before being
+// read, and data already at the right place isn't copied at all. Where copies
+// depend on each other in a cycle, some data is stashed in memory before
+// anything is written, up to opts.ScratchSize, or sent as a literal.
+func InPlaceDelta(sig *SignatureType, input io.ReadSeeker, output io.Writer, opts InPlaceOptions) error {
+	if opts.Delta.TargetCopies || opts.Delta.Filter != nil {
+		return errors.New("in-place deltas don't support target copies or filters")
+	}
+	litBuff, err := opts.Delta.litBuff()
+	if err != nil {
+		return err
+	}
+	if opts.ScratchSize == 0 {
+		opts.ScratchSize = defaultScratchSize
+	}
+
+	ops, id, err := plainDeltaOps(sig, input, opts.Delta.Fill)
+	if err != nil {
+		return err
+	}
+	plan := planInPlace(ops, opts.ScratchSize)
+
+	header := opts.Delta.header()
+	header.magic = DELTA_EXT_MAGIC
+	header.flags |= DELTA_FLAG_IN_PLACE
+	header.inPlace = &inPlaceParams{size: plan.size, scratch: plan.scratch, id: id}
+	err = writeDeltaHeader(output, header)
+	if err != nil {
+		return err
+	}
+
+	e := &inPlaceEncoder{m: opts.Delta.newMatch(output, litBuff), input: input}
+	err = e.encode(plan)
+	if err != nil {
+		return err
+	}
+	if opts.Delta.Stats != nil {
+		*opts.Delta.Stats = e.m.stats
+	}
+	return nil
+}
+
+// plainDeltaOps returns the commands of a plain delta from sig to input, with
+// the data of literals dropped, and an ID for the in-place delta derived from
+// the contents of input.
+func plainDeltaOps(sig *SignatureType, input io.ReadSeeker, fill bool) ([]DeltaOp, uint64, error) {
+	_, err := input.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	h := sha256.New()
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := DeltaWithOptions(sig, io.TeeReader(input, h), pw, DeltaOptions{Fill: fill})
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	var ops []DeltaOp
+	dr, err := NewDeltaReader(pr)
+	for err == nil {
+		var op DeltaOp
+		op, err = dr.Next()
+		if err == nil {
+			op.Data = nil
+			ops = append(ops, op)
+		}
+	}
+	pr.CloseWithError(err)
+	if deltaErr := <-done; deltaErr != nil {
+		return nil, 0, deltaErr
+	}
+	if err != io.EOF {
+		return nil, 0, err
+	}
+
+	return ops, binary.BigEndian.Uint64(h.Sum(nil)), nil
+}
+
+// inPlaceCopy is a piece of a copy within the file patched in place.
+type inPlaceCopy struct {
+	// Where the piece is written and read, and its length.
+	off, pos, len uint64
+}
+
+// inPlaceWrite is a command of an in-place delta that doesn't read from the
+// file: KIND_LITERAL, with data read from the input at the same offset,
+// KIND_FILL or KIND_UNSTASH.
+type inPlaceWrite struct {
+	kind OpKind
+	off  uint64
+	len  uint64
+
+	// Byte repeated by KIND_FILL, or position in the scratch buffer for
+	// KIND_UNSTASH.
+	pos uint64
+}
+
+// inPlacePlan is the order in which an in-place delta writes the output.
+type inPlacePlan struct {
+	// Pieces of the file to stash first.
+	stashes []inPlaceCopy
+
+	// Copies within the file, in the order they must be executed.
+	copies []inPlaceCopy
+
+	// Other writes, done after the copies.
+	writes []inPlaceWrite
+
+	// Size of the output and number of bytes stashed.
+	size, scratch uint64
+}
+
+// planInPlace orders the commands of a plain delta for an in-place patch,
+// stashing at most scratchSize bytes.
+//
+// Copy i must run before copy j if i reads data that j overwrites. This forms
+// a graph whose topological order is the order of the copies, computed by a
+// depth-first search. Where a cycle is found, the copy closing it is removed
+// from the graph: its data is stashed, or sent as a literal if the scratch
+// buffer is full. Literals, fills and removed copies don't read the file and
+// are done last.
+func planInPlace(ops []DeltaOp, scratchSize uint64) *inPlacePlan {
+	plan := &inPlacePlan{}
+
+	// Split the copies in pieces, sorted by offset since the commands are in
+	// output order. Copies to the same place are no-ops.
+	var pieces []inPlaceCopy
+	var off uint64
+	for _, op := range ops {
+		switch op.Kind {
+		case KIND_COPY:
+			if op.Pos != off {
+				for done := uint64(0); done < op.Len; done += inPlacePieceSize {
+					n := op.Len - done
+					if n > inPlacePieceSize {
+						n = inPlacePieceSize
+					}
+					pieces = append(pieces, inPlaceCopy{off: off + done, pos: op.Pos + done, len: n})
+				}
+			}
+		case KIND_LITERAL:
+			plan.writes = append(plan.writes, inPlaceWrite{kind: KIND_LITERAL, off: off, len: op.Len})
+		case KIND_FILL:
+			plan.writes = append(plan.writes, inPlaceWrite{kind: KIND_FILL, off: off, len: op.Len, pos: uint64(op.Value)})
+		}
+		off += op.Len
+	}
+	plan.size = off
+
+	// successors returns the range of pieces overwriting data read by piece
+	// i.
+	successors := func(i int) (int, int) {
+		c := pieces[i]
+		lo := sort.Search(len(pieces), func(j int) bool {
+			return pieces[j].off+pieces[j].len > c.pos
+		})
+		hi := sort.Search(len(pieces), func(j int) bool {
+			return pieces[j].off >= c.pos+c.len
+		})
+		return lo, hi
+	}
+
+	const (
+		unvisited = iota
+		active
+		finished
+	)
+	type frame struct {
+		piece, next, end int
+	}
+	state := make([]uint8, len(pieces))
+	var postorder []int
+	var stack []frame
+	for root := range pieces {
+		if state[root] != unvisited {
+			continue
+		}
+		lo, hi := successors(root)
+		stack = append(stack, frame{root, lo, hi})
+		state[root] = active
+
+		for len(stack) > 0 {
+			f := &stack[len(stack)-1]
+			if f.next == f.end {
+				state[f.piece] = finished
+				postorder = append(postorder, f.piece)
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			j := f.next
+			f.next++
+			if j == f.piece {
+				// Overlapping with itself is handled when copying.
+				continue
+			}
+			switch state[j] {
+			case unvisited:
+				lo, hi := successors(j)
+				stack = append(stack, frame{j, lo, hi})
+				state[j] = active
+			case active:
+				// Cycle: remove the piece from the graph.
+				state[f.piece] = finished
+				plan.breakCycle(pieces[f.piece], scratchSize)
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	for i := len(postorder) - 1; i >= 0; i-- {
+		plan.copies = append(plan.copies, pieces[postorder[i]])
+	}
+	sort.SliceStable(plan.writes, func(i, j int) bool {
+		return plan.writes[i].off < plan.writes[j].off
+	})
+	return plan
+}
+
+// breakCycle stashes the data of a piece, or sends it as a literal if the
+// scratch buffer is full.
+func (plan *inPlacePlan) breakCycle(c inPlaceCopy, scratchSize uint64) {
+	if plan.scratch+c.len > scratchSize {
+		plan.writes = append(plan.writes, inPlaceWrite{kind: KIND_LITERAL, off: c.off, len: c.len})
+		return
+	}
+	plan.stashes = append(plan.stashes, c)
+	plan.writes = append(plan.writes, inPlaceWrite{kind: KIND_UNSTASH, off: c.off, len: c.len, pos: plan.scratch})
+	plan.scratch += c.len
+}
+
+// inPlaceEncoder writes the commands of an in-place delta.
+type inPlaceEncoder struct {
+	m     match
+	input io.ReadSeeker
+
+	// Output offset after the last command.
+	off uint64
+}
+
+func (e *inPlaceEncoder) encode(plan *inPlacePlan) error {
+	for _, c := range plan.stashes {
+		err := writeSizedCommand(e.m.output, OP_STASH_N1_N1, c.pos, c.len)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range plan.copies {
+		err := e.seek(c.off)
+		if err == nil {
+			err = e.m.add(MATCH_KIND_COPY, c.pos, c.len)
+		}
+		if err != nil {
+			return err
+		}
+		e.off += c.len
+	}
+
+	for _, w := range plan.writes {
+		err := e.seek(w.off)
+		if err != nil {
+			return err
+		}
+		switch w.kind {
+		case KIND_LITERAL:
+			err = e.literal(w.off, w.len)
+		case KIND_FILL:
+			err = e.m.add(MATCH_KIND_FILL, w.pos, w.len)
+		case KIND_UNSTASH:
+			err = e.m.flush()
+			if err == nil {
+				err = writeSizedCommand(e.m.output, OP_UNSTASH_N1_N1, w.pos, w.len)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		e.off += w.len
+	}
+
+	err := e.m.flush()
+	if err != nil {
+		return err
+	}
+	return binary.Write(e.m.output, binary.BigEndian, OP_END)
+}
+
+// seek makes the next command write at off.
+func (e *inPlaceEncoder) seek(off uint64) error {
+	if off == e.off {
+		return nil
+	}
+	err := e.m.flush()
+	if err != nil {
+		return err
+	}
+	e.off = off
+	return writeSizedCommand(e.m.output, OP_SEEK_N1, off)
+}
+
+// literal writes the n bytes of the input at off as literals.
+func (e *inPlaceEncoder) literal(off, n uint64) error {
+	err := e.m.flush()
+	if err != nil {
+		return err
+	}
+	_, err = e.input.Seek(int64(off), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	for n > 0 {
+		size := uint64(cap(e.m.lit))
+		if size > n {
+			size = n
+		}
+		e.m.lit = e.m.lit[:size]
+		_, err = io.ReadFull(e.input, e.m.lit)
+		if err != nil {
+			return fmt.Errorf("reading input again: %w", err)
+		}
+		e.m.kind = MATCH_KIND_LITERAL
+		e.m.len = size
+		err = e.m.flush()
+		if err != nil {
+			return err
+		}
+		n -= size
+	}
+	return nil
+}
+
+// writeSizedCommand writes a command with the given parameters, each encoded
+// with the smallest size. base is the op of the command with 1-byte
+// parameters, followed by ops with larger ones as for OP_COPY_*.
+func writeSizedCommand(w io.Writer, base Op, params ...uint64) error {
+	op := base
+	var sizeIndex Op
+	for _, param := range params {
+		switch intSize(param) {
+		case 2:
+			sizeIndex = 1
+		case 4:
+			sizeIndex = 2
+		case 8:
+			sizeIndex = 3
+		default:
+			sizeIndex = 0
+		}
+		op = base + (op-base)*4 + sizeIndex
+	}
+
+	err := binary.Write(w, binary.BigEndian, op)
+	if err != nil {
+		return err
+	}
+	for _, param := range params {
+		var err error
+		switch intSize(param) {
+		case 1:
+			err = binary.Write(w, binary.BigEndian, uint8(param))
+		case 2:
+			err = binary.Write(w, binary.BigEndian, uint16(param))
+		case 4:
+			err = binary.Write(w, binary.BigEndian, uint32(param))
+		case 8:
+			err = binary.Write(w, binary.BigEndian, param)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,680 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Magic number of the journal of PatchInPlace.
+const IN_PLACE_JOURNAL_MAGIC MagicNumber = 0x72730270
+
+// Size of the chunks in which PatchInPlace copies data.
+const inPlaceChunkSize = 1024 * 1024
+
+// Number of bytes PatchInPlace writes between checkpoints, at most, bounding
+// the work redone when resuming.
+const inPlaceCheckpointInterval = 64 * 1024 * 1024
+
+// InPlaceFile is a file patched in place by PatchInPlace, like an *os.File.
+type InPlaceFile interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Truncate changes the size of the file, at the end of the patch.
+	Truncate(size int64) error
+
+	// Sync flushes the file to stable storage, before checkpoints.
+	Sync() error
+}
+
+// PatchInPlace applies a delta generated by InPlaceDelta to f, which holds the
+// basis and is overwritten with the output.
+//
+// If opts.Journal is set, progress is recorded in that file so that, if
+// PatchInPlace is interrupted by a crash, calling it again with the same delta
+// and journal resumes the patch. The file and the journal are synced at
+// checkpoints, taken before overwriting data read since the previous one; the
+// data of such writes is saved in the journal first. Stashed data is kept in
+// a second file, named after the journal with a ".scratch" suffix. Both are
+// removed once the patch is complete.
+//
+// opts.Sparse is ignored.
+func PatchInPlace(f InPlaceFile, delta io.Reader, opts PatchOptions) error {
+	delta, closeDelta, err := verifiedStream(delta, opts.Verifier, opts.DetachedSignature)
+	if err != nil {
+		return err
+	}
+	defer closeDelta()
+
+	cr := &countingReader{r: delta}
+	header, err := readDeltaHeader(cr)
+	if err != nil {
+		return err
+	}
+	if !header.has(DELTA_FLAG_IN_PLACE) {
+		return errors.New("not an in-place delta")
+	}
+
+	// The delta must not write past the size of the output.
+	if header.inPlace.size > math.MaxInt64 {
+		return ErrOutputTooLarge
+	}
+	size := int64(header.inPlace.size)
+	if opts.ExpectedSize > 0 && size != opts.ExpectedSize {
+		return ErrOutputSizeMismatch
+	}
+	limits := newPatchLimits(opts)
+	if limits.maxSize > 0 && size > limits.maxSize {
+		return ErrOutputTooLarge
+	}
+	limits.maxSize, limits.expected = size, 0
+	// Every stashed byte is unstashed to a distinct place in the output.
+	if header.inPlace.scratch > header.inPlace.size {
+		return errors.New("invalid in-place delta: scratch size exceeds output size")
+	}
+
+	p := &inPlacePatcher{
+		f:      f,
+		delta:  cr,
+		header: header,
+		limits: limits,
+		buf:    make([]byte, inPlaceChunkSize),
+	}
+	if header.has(DELTA_FLAG_COMPRESSED_LITERALS) {
+		p.codec, err = literalCodec(header.codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Journal != "" {
+		p.journal = &inPlaceJournal{path: opts.Journal, id: header.inPlace.id}
+		resumed, err := p.resume()
+		if err != nil {
+			return err
+		}
+		if resumed && p.state.complete {
+			return p.finish()
+		}
+	}
+
+	err = p.run()
+	if err != nil {
+		return err
+	}
+	if p.journal != nil {
+		p.state.complete = true
+		err = p.checkpoint(nil, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return p.finish()
+}
+
+// inPlaceState is the progress of PatchInPlace, as recorded in its journal.
+type inPlaceState struct {
+	// Offset in the delta of the command being executed, and where it
+	// writes.
+	deltaOff, off int64
+
+	// Bytes of the command already written.
+	done int64
+
+	// Length of the scratch buffer.
+	scratch int64
+
+	// Whether the patch is complete, except for truncating the file.
+	complete bool
+}
+
+// inPlacePatcher holds the state of a PatchInPlace.
+type inPlacePatcher struct {
+	f      InPlaceFile
+	delta  *countingReader
+	header deltaHeader
+	codec  LiteralCodec
+	limits patchLimits
+	buf    []byte
+
+	scratch []byte
+
+	// Position in the delta and output of the current command, and bytes of
+	// it written.
+	state inPlaceState
+
+	// Bytes of the current command to skip when resuming.
+	skip int64
+
+	journal *inPlaceJournal
+
+	// Ranges read since the last checkpoint, which must not be overwritten
+	// before the next one, and bytes written since then.
+	reads   rangeSet
+	written int64
+}
+
+func (p *inPlacePatcher) run() error {
+	for {
+		p.state.deltaOff = p.delta.n
+		cmd, param1, param2, err := readCommand(p.delta)
+		if err != nil {
+			return err
+		}
+		if !p.header.allows(cmd.Kind) || cmd.Kind == KIND_TARGET_COPY {
+			return fmt.Errorf("Bogus command %x", cmd.Kind)
+		}
+		if param1 < 0 || param2 < 0 {
+			return fmt.Errorf("invalid command parameters %d, %d", param1, param2)
+		}
+		switch cmd.Kind {
+		case KIND_SEEK, KIND_STASH:
+			err = p.limits.count()
+		case KIND_END:
+		default:
+			err = p.limits.check(cmd.Kind, param1, param2, p.state.off)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch cmd.Kind {
+		case KIND_SEEK:
+			p.state.off = param1
+		case KIND_STASH:
+			err = p.stash(param1, param2)
+		case KIND_LITERAL:
+			_, err = io.CopyN(inPlaceWriter{p}, p.delta, param1)
+		case KIND_LITERAL_Z:
+			_, err = copyCompressedLiteral(inPlaceWriter{p}, p.delta, p.codec, param1, param2)
+		case KIND_COPY:
+			err = p.copy(param1, param2)
+		case KIND_FILL:
+			err = p.fill(byte(param1), param2)
+		case KIND_UNSTASH:
+			err = p.unstash(param1, param2)
+		case KIND_END:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if cmd.Kind != KIND_SEEK && cmd.Kind != KIND_STASH {
+			p.state.off += p.state.done
+			p.state.done = 0
+		}
+		p.skip = 0
+	}
+}
+
+func (p *inPlacePatcher) stash(pos, n int64) error {
+	if int64(len(p.scratch))+n > int64(p.header.inPlace.scratch) {
+		return errors.New("stashed data exceeds the scratch size of the delta")
+	}
+
+	// The scratch buffer grows as data is read, rather than as the header
+	// says.
+	for read := int64(0); read < n; {
+		size := n - read
+		if size > inPlaceChunkSize {
+			size = inPlaceChunkSize
+		}
+		data := p.buf[:size]
+		err := readFullAt(p.f, data, pos+read)
+		if err != nil {
+			return err
+		}
+		p.scratch = append(p.scratch, data...)
+		read += size
+	}
+	p.reads.add(pos, n)
+	return nil
+}
+
+// copy copies n bytes at pos in the file to the current offset, like memmove:
+// backwards if the destination overlaps the end of the source.
+func (p *inPlacePatcher) copy(pos, n int64) error {
+	backwards := pos < p.state.off && pos+n > p.state.off
+	for p.state.done < n {
+		size := n - p.state.done
+		if size > inPlaceChunkSize {
+			size = inPlaceChunkSize
+		}
+		start := p.state.done
+		if backwards {
+			start = n - p.state.done - size
+		}
+
+		data := p.buf[:size]
+		err := readFullAt(p.f, data, pos+start)
+		if err != nil {
+			return err
+		}
+		p.reads.add(pos+start, size)
+		err = p.write(data, p.state.off+start)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *inPlacePatcher) fill(b byte, n int64) error {
+	data := bytes.Repeat([]byte{b}, inPlaceChunkSize)
+	for p.state.done < n {
+		size := n - p.state.done
+		if size > inPlaceChunkSize {
+			size = inPlaceChunkSize
+		}
+		err := p.write(data[:size], p.state.off+p.state.done)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *inPlacePatcher) unstash(pos, n int64) error {
+	if n > int64(len(p.scratch)) || pos > int64(len(p.scratch))-n {
+		return fmt.Errorf("unstash of %d bytes from %d, but only %d bytes are stashed", n, pos, len(p.scratch))
+	}
+	for p.state.done < n {
+		size := n - p.state.done
+		if size > inPlaceChunkSize {
+			size = inPlaceChunkSize
+		}
+		start := pos + p.state.done
+		err := p.write(p.scratch[start:start+size], p.state.off+p.state.done)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes the next bytes of the current command at off, taking a
+// checkpoint first if needed.
+func (p *inPlacePatcher) write(data []byte, off int64) error {
+	n := int64(len(data))
+	if p.journal != nil && (p.reads.overlaps(off, n) || p.written+n > inPlaceCheckpointInterval) {
+		p.state.done += n
+		err := p.checkpoint(data, off)
+		p.state.done -= n
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := p.f.WriteAt(data, off)
+	if err != nil {
+		return err
+	}
+	p.state.done += n
+	p.written += n
+	return nil
+}
+
+// checkpoint records in the journal the current state, reached once data is
+// written at off.
+func (p *inPlacePatcher) checkpoint(data []byte, off int64) error {
+	err := p.f.Sync()
+	if err != nil {
+		return err
+	}
+	p.state.scratch = int64(len(p.scratch))
+	err = p.journal.save(p.state, p.scratch, data, off)
+	if err != nil {
+		return err
+	}
+	p.reads = p.reads[:0]
+	p.written = 0
+	return nil
+}
+
+// resume restores the state recorded in the journal, if any, redoing its last
+// write and skipping the part of the delta already applied.
+func (p *inPlacePatcher) resume() (bool, error) {
+	state, scratch, redo, redoOff, err := p.journal.load(int64(p.header.inPlace.scratch))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	p.state = state
+
+	if redoOff < 0 || redoOff+int64(len(redo)) > int64(p.header.inPlace.size) {
+		return false, errors.New("invalid journal: write past the end of the output")
+	}
+	if len(redo) > 0 {
+		_, err = p.f.WriteAt(redo, redoOff)
+		if err != nil {
+			return false, err
+		}
+	}
+	if state.complete {
+		return true, nil
+	}
+
+	p.scratch = scratch
+
+	// Skip to the command being executed, whose written bytes are skipped as
+	// it is executed again.
+	_, err = io.CopyN(ioutil.Discard, p.delta, state.deltaOff-p.delta.n)
+	if err != nil {
+		return false, fmt.Errorf("skipping applied commands: %w", err)
+	}
+	p.skip = state.done
+	p.state.done = 0
+	return true, p.resumeCommand()
+}
+
+// resumeCommand executes the rest of the command at which the patch was
+// interrupted.
+func (p *inPlacePatcher) resumeCommand() error {
+	cmd, param1, param2, err := readCommand(p.delta)
+	if err != nil {
+		return err
+	}
+	p.state.done = p.skip
+	switch cmd.Kind {
+	case KIND_LITERAL:
+		p.state.done = 0
+		_, err = io.CopyN(inPlaceWriter{p}, p.delta, param1)
+	case KIND_LITERAL_Z:
+		p.state.done = 0
+		_, err = copyCompressedLiteral(inPlaceWriter{p}, p.delta, p.codec, param1, param2)
+	case KIND_COPY:
+		err = p.copy(param1, param2)
+	case KIND_FILL:
+		err = p.fill(byte(param1), param2)
+	case KIND_UNSTASH:
+		err = p.unstash(param1, param2)
+	default:
+		err = fmt.Errorf("journal refers to command %x, which doesn't write", cmd.Kind)
+	}
+	if err != nil {
+		return err
+	}
+	p.state.off += p.state.done
+	p.state.done = 0
+	p.skip = 0
+	return nil
+}
+
+// finish truncates the file to the size of the output and removes the
+// journal.
+func (p *inPlacePatcher) finish() error {
+	err := p.f.Truncate(int64(p.header.inPlace.size))
+	if err != nil {
+		return err
+	}
+	err = p.f.Sync()
+	if err != nil {
+		return err
+	}
+	if p.journal != nil {
+		return p.journal.remove()
+	}
+	return nil
+}
+
+// inPlaceWriter writes literal data at the current offset, skipping what was
+// already written before resuming.
+type inPlaceWriter struct {
+	p *inPlacePatcher
+}
+
+func (w inPlaceWriter) Write(b []byte) (int, error) {
+	p := w.p
+	n := len(b)
+	if p.skip > 0 {
+		skipped := int64(len(b))
+		if skipped > p.skip {
+			skipped = p.skip
+		}
+		p.skip -= skipped
+		p.state.done += skipped
+		b = b[skipped:]
+	}
+	if len(b) == 0 {
+		return n, nil
+	}
+
+	err := p.write(b, p.state.off+p.state.done)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// inPlaceJournal is the journal of a PatchInPlace.
+//
+// It holds the magic number, the ID of the delta, the inPlaceState as int64
+// values and a byte, and the data of the next write with its offset and
+// length. It is replaced atomically by a new one at each checkpoint. The
+// scratch file holds the stashed data, and only grows.
+type inPlaceJournal struct {
+	path string
+	id   uint64
+
+	// Bytes of the scratch buffer saved to the scratch file.
+	scratchSaved int64
+}
+
+func (j *inPlaceJournal) scratchPath() string {
+	return j.path + ".scratch"
+}
+
+func (j *inPlaceJournal) save(state inPlaceState, scratch, data []byte, off int64) error {
+	if int64(len(scratch)) > j.scratchSaved {
+		err := j.saveScratch(scratch)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	var complete uint8
+	if state.complete {
+		complete = 1
+	}
+	for _, v := range []interface{}{IN_PLACE_JOURNAL_MAGIC, j.id, state.deltaOff, state.off, state.done,
+		state.scratch, complete, off, int64(len(data))} {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	buf.Write(data)
+
+	tmp := j.path + ".tmp"
+	err := writeSyncedFile(tmp, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, j.path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(j.path))
+}
+
+// saveScratch appends the part of the scratch buffer not saved yet to the
+// scratch file.
+func (j *inPlaceJournal) saveScratch(scratch []byte) error {
+	f, err := os.OpenFile(j.scratchPath(), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(scratch[j.scratchSaved:], j.scratchSaved)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	j.scratchSaved = int64(len(scratch))
+	return nil
+}
+
+// load reads the journal. The error satisfies os.IsNotExist if there is none.
+func (j *inPlaceJournal) load(maxScratch int64) (state inPlaceState, scratch, data []byte, off int64, err error) {
+	journal, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		return state, nil, nil, 0, err
+	}
+
+	r := bytes.NewReader(journal)
+	var magic MagicNumber
+	var id uint64
+	var complete uint8
+	var dataLen int64
+	for _, v := range []interface{}{&magic, &id, &state.deltaOff, &state.off, &state.done, &state.scratch,
+		&complete, &off, &dataLen} {
+		err = binary.Read(r, binary.BigEndian, v)
+		if err != nil {
+			return state, nil, nil, 0, fmt.Errorf("invalid journal: %w", err)
+		}
+	}
+	if magic != IN_PLACE_JOURNAL_MAGIC {
+		return state, nil, nil, 0, errors.New("invalid journal")
+	}
+	if id != j.id {
+		return state, nil, nil, 0, errors.New("journal belongs to another delta")
+	}
+	if dataLen != int64(r.Len()) || state.scratch < 0 || state.scratch > maxScratch ||
+		state.deltaOff < 0 || state.done < 0 {
+		return state, nil, nil, 0, errors.New("invalid journal")
+	}
+	state.complete = complete != 0
+	data = journal[len(journal)-r.Len():]
+
+	if state.scratch > 0 {
+		f, err := os.Open(j.scratchPath())
+		if err != nil {
+			return state, nil, nil, 0, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return state, nil, nil, 0, err
+		}
+		if info.Size() < state.scratch {
+			return state, nil, nil, 0, errors.New("invalid journal: missing stashed data")
+		}
+		scratch = make([]byte, state.scratch)
+		_, err = f.ReadAt(scratch, 0)
+		if err != nil {
+			return state, nil, nil, 0, fmt.Errorf("reading stashed data: %w", err)
+		}
+		j.scratchSaved = state.scratch
+	}
+	return state, scratch, data, off, nil
+}
+
+func (j *inPlaceJournal) remove() error {
+	err := os.Remove(j.scratchPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readFullAt reads len(p) bytes at off in r.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func writeSyncedFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir flushes the entries of a directory to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// rangeSet is a set of byte ranges, sorted and merged.
+type rangeSet []byteRange
+
+type byteRange struct {
+	start, end int64
+}
+
+func (s *rangeSet) add(off, n int64) {
+	r := byteRange{off, off + n}
+	set := *s
+
+	// The ranges from i to j touch the new one, and are merged with it.
+	i := sort.Search(len(set), func(i int) bool { return set[i].end >= r.start })
+	j := sort.Search(len(set), func(i int) bool { return set[i].start > r.end })
+	if i == j {
+		set = append(set, byteRange{})
+		copy(set[i+1:], set[i:])
+		set[i] = r
+		*s = set
+		return
+	}
+
+	if set[i].start < r.start {
+		r.start = set[i].start
+	}
+	if set[j-1].end > r.end {
+		r.end = set[j-1].end
+	}
+	set[i] = r
+	*s = append(set[:i+1], set[j:]...)
+}
+
+func (s rangeSet) overlaps(off, n int64) bool {
+	i := sort.Search(len(s), func(i int) bool { return s[i].end > off })
+	return i < len(s) && s[i].start < off+n
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,279 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memFile is an InPlaceFile in memory, which can simulate crashes: after
+// failAt writes, the next one writes only half of its data and fails. Data
+// written since the last Sync is kept in data, but not in durable.
+type memFile struct {
+	data, durable []byte
+
+	writes, failAt int
+	written        int64
+}
+
+var errCrash = errors.New("crash")
+
+func newMemFile(data []byte) *memFile {
+	return &memFile{
+		data:    append([]byte{}, data...),
+		durable: append([]byte{}, data...),
+		failAt:  -1,
+	}
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	crash := f.writes == f.failAt
+	f.writes++
+	if crash {
+		p = p[:len(p)/2]
+	}
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], p)
+	f.written += int64(len(p))
+	if crash {
+		return len(p), errCrash
+	}
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.durable = append(f.durable[:0], f.data...)
+	return nil
+}
+
+func inPlaceDelta(t *testing.T, old, new []byte, opts InPlaceOptions) []byte {
+	delta := &bytes.Buffer{}
+	require.NoError(t, InPlaceDelta(signature(t, bytes.NewReader(old)), bytes.NewReader(new), delta, opts))
+	return delta.Bytes()
+}
+
+func randomBytes(rnd *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	rnd.Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	var data []byte
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+	return data
+}
+
+// inPlaceCases returns pairs of old and new files exercising the ordering of
+// copies.
+func inPlaceCases() map[string][2][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	old := randomBytes(rnd, 3*1024*1024)
+	mb := 1024 * 1024
+
+	return map[string][2][]byte{
+		"unchanged": {old, old},
+		"edited":    {old, concat(old[:1000], randomBytes(rnd, 500), old[1500:2*mb], randomBytes(rnd, 100), old[2*mb+100:])},
+		"inserted":  {old, concat(randomBytes(rnd, 100), old)},
+		"removed":   {old, old[100:]},
+		"grown":     {old, concat(old, randomBytes(rnd, mb), old[:mb])},
+		"shrunk":    {old, concat(old[2*mb:], old[:mb/2])},
+		"swapped":   {old, concat(old[2*mb:], randomBytes(rnd, 100), old[:2*mb-5000], randomBytes(rnd, 3000))},
+		"reversed":  {old, concat(old[2*mb:], old[mb:2*mb], old[:mb])},
+		"filled":    {old, concat(old[:mb], make([]byte, mb), old[mb:])},
+	}
+}
+
+func TestPatchInPlace(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	for name, files := range inPlaceCases() {
+		t.Run(name, func(t *testing.T) {
+			old, new := files[0], files[1]
+			delta := inPlaceDelta(t, old, new, InPlaceOptions{Delta: DeltaOptions{Fill: true, LiteralCodec: &FlateCodec{}}})
+
+			f := newMemFile(old)
+			r.NoError(PatchInPlace(f, bytes.NewReader(delta), PatchOptions{}))
+			a.True(bytes.Equal(new, f.data))
+
+			// The delta can't be applied otherwise.
+			r.Error(Patch(bytes.NewReader(old), bytes.NewReader(delta), &bytes.Buffer{}))
+			_, err := NewDeltaReader(bytes.NewReader(delta))
+			r.Error(err)
+		})
+	}
+}
+
+func TestPatchInPlaceWrites(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	// Only the changed data is written.
+	files := inPlaceCases()["edited"]
+	delta := inPlaceDelta(t, files[0], files[1], InPlaceOptions{})
+	f := newMemFile(files[0])
+	r.NoError(PatchInPlace(f, bytes.NewReader(delta), PatchOptions{}))
+	a.True(bytes.Equal(files[1], f.data))
+	a.Less(f.written, int64(2000))
+}
+
+func TestInPlaceDeltaScratch(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	// Swapping the two halves of the file can't be done by ordering copies.
+	rnd := rand.New(rand.NewSource(2))
+	old := randomBytes(rnd, 2*1024*1024)
+	new := concat(old[1024*1024:], old[:1024*1024])
+
+	stats := &DeltaStats{}
+	delta := inPlaceDelta(t, old, new, InPlaceOptions{Delta: DeltaOptions{Stats: stats}})
+	a.Less(len(delta), 1000)
+	a.Zero(stats.LitBytes)
+	f := newMemFile(old)
+	r.NoError(PatchInPlace(f, bytes.NewReader(delta), PatchOptions{}))
+	a.True(bytes.Equal(new, f.data))
+
+	// Without enough scratch space, data is sent as literals.
+	delta = inPlaceDelta(t, old, new, InPlaceOptions{ScratchSize: 1000, Delta: DeltaOptions{Stats: stats}})
+	a.Equal(uint64(1024*1024), stats.LitBytes)
+	f = newMemFile(old)
+	r.NoError(PatchInPlace(f, bytes.NewReader(delta), PatchOptions{}))
+	a.True(bytes.Equal(new, f.data))
+}
+
+func TestPatchInPlaceResume(t *testing.T) {
+	r := require.New(t)
+
+	for _, name := range []string{"inserted", "removed", "swapped", "shrunk"} {
+		files := inPlaceCases()[name]
+		old, new := files[0], files[1]
+		delta := inPlaceDelta(t, old, new, InPlaceOptions{Delta: DeltaOptions{Fill: true}})
+
+		f := newMemFile(old)
+		r.NoError(PatchInPlace(f, bytes.NewReader(delta), PatchOptions{}))
+		writes := f.writes
+
+		// Crash at each write, keeping or losing the data written since the
+		// last sync, and resume.
+		for _, keep := range []bool{true, false} {
+			for failAt := 0; failAt < writes; failAt++ {
+				journal := filepath.Join(t.TempDir(), "journal")
+				opts := PatchOptions{Journal: journal}
+
+				f := newMemFile(old)
+				f.failAt = failAt
+				err := PatchInPlace(f, bytes.NewReader(delta), opts)
+				r.Equal(errCrash, err, "%s: crash at %d", name, failAt)
+
+				if !keep {
+					f.data = f.durable
+				}
+
+				// Crash again while resuming, if there is something left to
+				// write.
+				f = newMemFile(f.data)
+				f.failAt = 0
+				err = PatchInPlace(f, bytes.NewReader(delta), opts)
+				if err != nil {
+					r.Equal(errCrash, err, "%s: crash at %d then 0", name, failAt)
+				}
+
+				f = newMemFile(f.data)
+				r.NoError(PatchInPlace(f, bytes.NewReader(delta), opts), "%s: crash at %d", name, failAt)
+				r.True(bytes.Equal(new, f.data), "%s: crash at %d, keep %v", name, failAt, keep)
+
+				_, err = ioutil.ReadFile(journal)
+				r.Error(err)
+				_, err = ioutil.ReadFile(journal + ".scratch")
+				r.Error(err)
+			}
+		}
+	}
+}
+
+func TestPatchInPlaceJournalMismatch(t *testing.T) {
+	r := require.New(t)
+
+	files := inPlaceCases()["inserted"]
+	delta := inPlaceDelta(t, files[0], files[1], InPlaceOptions{})
+	journal := filepath.Join(t.TempDir(), "journal")
+
+	f := newMemFile(files[0])
+	f.failAt = 2
+	r.Equal(errCrash, PatchInPlace(f, bytes.NewReader(delta), PatchOptions{Journal: journal}))
+
+	other := inPlaceDelta(t, files[0], files[0][1:], InPlaceOptions{})
+	r.Error(PatchInPlace(newMemFile(f.data), bytes.NewReader(other), PatchOptions{Journal: journal}))
+}
+
+// TestPatchInPlaceCorrupt checks that sizes read from the delta and journal
+// are checked before being used.
+func TestPatchInPlaceCorrupt(t *testing.T) {
+	r := require.New(t)
+
+	// The scratch buffer can't be larger than the output.
+	huge := &bytes.Buffer{}
+	r.NoError(writeDeltaHeader(huge, deltaHeader{
+		magic:   DELTA_EXT_MAGIC,
+		flags:   DELTA_FLAG_IN_PLACE,
+		inPlace: &inPlaceParams{size: 10, scratch: 1 << 50},
+	}))
+	huge.WriteByte(byte(OP_END))
+	r.Error(PatchInPlace(newMemFile(nil), huge, PatchOptions{}))
+
+	// Sizes and unstashes that overflow int64.
+	for _, size := range []uint64{^uint64(0), 10} {
+		overflow := &bytes.Buffer{}
+		r.NoError(writeDeltaHeader(overflow, deltaHeader{
+			magic:   DELTA_EXT_MAGIC,
+			flags:   DELTA_FLAG_IN_PLACE,
+			inPlace: &inPlaceParams{size: size},
+		}))
+		r.NoError(writeSizedCommand(overflow, OP_UNSTASH_N1_N1, math.MaxInt64, 1))
+		overflow.WriteByte(byte(OP_END))
+		r.Error(PatchInPlace(newMemFile(make([]byte, 10)), overflow, PatchOptions{MaxOutputSize: 1 << 20}), "size %d", size)
+	}
+
+	// The journal can't write past the end of the output.
+	files := inPlaceCases()["inserted"]
+	delta := inPlaceDelta(t, files[0], files[1], InPlaceOptions{})
+	journal := filepath.Join(t.TempDir(), "journal")
+	f := newMemFile(files[0])
+	f.failAt = 2
+	r.Equal(errCrash, PatchInPlace(f, bytes.NewReader(delta), PatchOptions{Journal: journal}))
+
+	data, err := ioutil.ReadFile(journal)
+	r.NoError(err)
+	binary.BigEndian.PutUint64(data[45:], 1<<40)
+	r.NoError(ioutil.WriteFile(journal, data, 0600))
+	f = newMemFile(f.data)
+	r.Error(PatchInPlace(f, bytes.NewReader(delta), PatchOptions{Journal: journal}))
+	r.Zero(f.written)
+}
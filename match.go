@@ -1,6 +1,7 @@
 package librsync
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -11,6 +12,8 @@ type matchKind uint8
 const (
 	MATCH_KIND_LITERAL matchKind = iota
 	MATCH_KIND_COPY
+	MATCH_KIND_TARGET_COPY
+	MATCH_KIND_FILL
 )
 
 // Size of the output buffer in bytes. We'll flush the match once it gets this
@@ -18,12 +21,30 @@ const (
 // generate on our deltas.
 var OUTPUT_BUFFER_SIZE = uint64(16 * 1024 * 1024)
 
+// Literals smaller than this are never compressed: the savings wouldn't pay for
+// the codec overhead.
+var MIN_COMPRESSED_LITERAL_SIZE = uint64(64)
+
+// Runs of identical literal bytes at least this long are encoded as FILL
+// commands, when these are enabled.
+var MIN_FILL_LENGTH = uint64(32)
+
 type match struct {
 	kind   matchKind
 	pos    uint64
 	len    uint64
 	output io.Writer
 	lit    []byte
+	stats  DeltaStats
+
+	// Codec used to compress literals, if any, and its output buffer.
+	codec LiteralCodec
+	zbuf  bytes.Buffer
+
+	// Whether to generate FILL commands, and the length of the run of
+	// identical bytes at the end of the literal.
+	fill bool
+	run  uint64
 }
 
 func intSize(d uint64) uint8 {
@@ -70,7 +91,7 @@ func (m *match) flush() error {
 	var cmd Op
 
 	switch m.kind {
-	case MATCH_KIND_COPY:
+	case MATCH_KIND_COPY, MATCH_KIND_TARGET_COPY:
 		switch posSize {
 		case 1:
 			cmd = OP_COPY_N1_N1
@@ -91,6 +112,15 @@ func (m *match) flush() error {
 			cmd += 3
 		}
 
+		if m.kind == MATCH_KIND_TARGET_COPY {
+			cmd += OP_TARGET_COPY_N1_N1 - OP_COPY_N1_N1
+			m.stats.TargetCopyCmds++
+			m.stats.TargetCopyBytes += m.len
+		} else {
+			m.stats.CopyCmds++
+			m.stats.CopyBytes += m.len
+		}
+
 		err := binary.Write(m.output, binary.BigEndian, cmd)
 		if err != nil {
 			return err
@@ -104,6 +134,19 @@ func (m *match) flush() error {
 			return err
 		}
 	case MATCH_KIND_LITERAL:
+		m.stats.LitCmds++
+		m.stats.LitBytes += m.len
+
+		compressed, err := m.flushCompressed()
+		if err != nil {
+			return err
+		}
+		if compressed {
+			m.lit = m.lit[:0]
+			break
+		}
+		m.stats.LitStoredBytes += m.len
+
 		cmd = OP_LITERAL_N1
 		switch lenSize {
 		case 1:
@@ -116,7 +159,7 @@ func (m *match) flush() error {
 			cmd = OP_LITERAL_N8
 		}
 
-		err := binary.Write(m.output, binary.BigEndian, cmd)
+		err = binary.Write(m.output, binary.BigEndian, cmd)
 		if err != nil {
 			return err
 		}
@@ -129,13 +172,127 @@ func (m *match) flush() error {
 			return err
 		}
 		m.lit = m.lit[:0] // reuse the same buffer
+	case MATCH_KIND_FILL:
+		switch lenSize {
+		case 1:
+			cmd = OP_FILL_N1
+		case 2:
+			cmd = OP_FILL_N2
+		case 4:
+			cmd = OP_FILL_N4
+		case 8:
+			cmd = OP_FILL_N8
+		}
+
+		err := binary.Write(m.output, binary.BigEndian, cmd)
+		if err != nil {
+			return err
+		}
+		err = m.write(m.pos, 1)
+		if err != nil {
+			return err
+		}
+		err = m.write(m.len, lenSize)
+		if err != nil {
+			return err
+		}
+		m.stats.FillCmds++
+		m.stats.FillBytes += m.len
 	}
 	m.pos = 0
 	m.len = 0
+	m.run = 0
+	return nil
+}
+
+// flushCompressed writes the literal data as an OP_LITERAL_Z_* command, if
+// there is a codec and the data gets smaller when compressed. Returns whether
+// the command was written.
+func (m *match) flushCompressed() (bool, error) {
+	if m.codec == nil || m.len < MIN_COMPRESSED_LITERAL_SIZE {
+		return false, nil
+	}
+
+	m.zbuf.Reset()
+	zw, err := m.codec.NewWriter(&m.zbuf)
+	if err != nil {
+		return false, err
+	}
+	_, err = zw.Write(m.lit)
+	if err != nil {
+		return false, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return false, err
+	}
+
+	zlen := uint64(m.zbuf.Len())
+	if zlen >= m.len {
+		return false, nil
+	}
+
+	// Both lengths are encoded with the size needed by the largest one.
+	var cmd Op
+	lenSize := intSize(m.len)
+	switch lenSize {
+	case 1:
+		cmd = OP_LITERAL_Z_N1
+	case 2:
+		cmd = OP_LITERAL_Z_N2
+	case 4:
+		cmd = OP_LITERAL_Z_N4
+	case 8:
+		cmd = OP_LITERAL_Z_N8
+	}
+
+	err = binary.Write(m.output, binary.BigEndian, cmd)
+	if err != nil {
+		return false, err
+	}
+	err = m.write(m.len, lenSize)
+	if err != nil {
+		return false, err
+	}
+	err = m.write(zlen, lenSize)
+	if err != nil {
+		return false, err
+	}
+	_, err = m.output.Write(m.zbuf.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	m.stats.LitStoredBytes += zlen
+	return true, nil
+}
+
+// startFill turns the run of identical bytes at the end of the literal into a
+// FILL.
+func (m *match) startFill() error {
+	b := m.lit[len(m.lit)-1]
+	run := m.run
+
+	m.lit = m.lit[:len(m.lit)-int(run)]
+	m.len -= run
+	err := m.flush()
+	if err != nil {
+		return err
+	}
+
+	m.kind = MATCH_KIND_FILL
+	m.pos = uint64(b)
+	m.len = run
+	m.run = 0
 	return nil
 }
 
 func (m *match) add(kind matchKind, pos, len uint64) error {
+	if kind == MATCH_KIND_LITERAL && m.kind == MATCH_KIND_FILL && m.len != 0 && byte(pos) == byte(m.pos) {
+		m.len += 1
+		return nil
+	}
+
 	if len != 0 && m.kind != kind {
 		err := m.flush()
 		if err != nil {
@@ -149,13 +306,23 @@ func (m *match) add(kind matchKind, pos, len uint64) error {
 	case MATCH_KIND_LITERAL:
 		m.lit = append(m.lit, byte(pos))
 		m.len += 1
+		if m.fill {
+			if m.run > 0 && m.lit[m.len-2] == byte(pos) {
+				m.run++
+			} else {
+				m.run = 1
+			}
+			if m.run >= MIN_FILL_LENGTH {
+				return m.startFill()
+			}
+		}
 		if m.len >= OUTPUT_BUFFER_SIZE {
 			err := m.flush()
 			if err != nil {
 				return err
 			}
 		}
-	case MATCH_KIND_COPY:
+	case MATCH_KIND_COPY, MATCH_KIND_TARGET_COPY:
 		if m.pos+m.len != pos {
 			err := m.flush()
 			if err != nil {
@@ -166,6 +333,15 @@ func (m *match) add(kind matchKind, pos, len uint64) error {
 		} else {
 			m.len += len
 		}
+	case MATCH_KIND_FILL:
+		if m.len != 0 && m.pos != pos {
+			err := m.flush()
+			if err != nil {
+				return err
+			}
+		}
+		m.pos = pos
+		m.len += len
 	}
 	return nil
 }
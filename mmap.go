@@ -0,0 +1,145 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errMmapUnsupported is returned when files can't be mapped in memory on this
+// platform.
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// MappedFile is a file opened for reading, and mapped in memory where
+// possible, so that reading from it doesn't need system calls or copies. It
+// can be used as the basis of Patch, and as a BlockSource. Otherwise, for
+// example on other platforms than Linux or for files which aren't regular,
+// reads go to the file itself.
+//
+// The file must not be truncated while it is mapped.
+type MappedFile struct {
+	f *os.File
+
+	// Content of f, if it is mapped, and a reader of it.
+	data []byte
+	r    *bytes.Reader
+}
+
+// MapFile opens the file at path, and maps it in memory if possible. It must
+// be closed after use.
+func MapFile(path string) (*MappedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	m := &MappedFile{f: f}
+	size := info.Size()
+	// Empty files can't be mapped.
+	if info.Mode().IsRegular() && size > 0 && int64(int(size)) == size {
+		data, err := mmapFile(f, int(size))
+		if err == nil {
+			m.data = data
+			m.r = bytes.NewReader(data)
+		}
+	}
+	return m, nil
+}
+
+// Mapped tells if the file is mapped in memory.
+func (m *MappedFile) Mapped() bool {
+	return m.data != nil
+}
+
+func (m *MappedFile) Read(p []byte) (int, error) {
+	if m.r != nil {
+		return m.r.Read(p)
+	}
+	return m.f.Read(p)
+}
+
+func (m *MappedFile) Seek(offset int64, whence int) (int64, error) {
+	if m.r != nil {
+		return m.r.Seek(offset, whence)
+	}
+	return m.f.Seek(offset, whence)
+}
+
+func (m *MappedFile) ReadAt(p []byte, off int64) (int, error) {
+	if m.r != nil {
+		return m.r.ReadAt(p, off)
+	}
+	return m.f.ReadAt(p, off)
+}
+
+// Hint implements BlockSource.
+func (m *MappedFile) Hint(off, n int64) {}
+
+// Close unmaps and closes the file. Data referencing the mapping, like the
+// strong sums of a signature read by ReadSignatureMapped, must not be used
+// anymore.
+func (m *MappedFile) Close() error {
+	var err error
+	if m.data != nil {
+		err = munmapFile(m.data)
+		m.data, m.r = nil, nil
+	}
+	cerr := m.f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadSignatureMapped reads a signature from m, which must stay open while the
+// signature is used. If m is mapped, the sums are referenced from the mapping
+// instead of being copied: StrongSigs is left nil, and the strong sums are
+// only available through StrongSum. Otherwise the signature is read from the
+// start of the file with ReadSignature.
+func ReadSignatureMapped(m *MappedFile) (*SignatureType, error) {
+	if m.data == nil {
+		_, err := m.f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		return ReadSignature(m.f)
+	}
+
+	data := m.data
+	if len(data) < 12 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	magic := MagicNumber(binary.BigEndian.Uint32(data))
+	if magic == SIGNED_MAGIC {
+		return nil, fmt.Errorf("signed signature, must be read with a Verifier")
+	}
+	blockLen := binary.BigEndian.Uint32(data[4:])
+	strongLen := binary.BigEndian.Uint32(data[8:])
+	sums := data[12:]
+
+	entryLen := 4 + int64(strongLen)
+	if int64(len(sums))%entryLen != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count := int(int64(len(sums)) / entryLen)
+	weak2block := make(map[uint32]int, count)
+	for i := 0; i < count; i++ {
+		weak2block[binary.BigEndian.Uint32(sums[int64(i)*entryLen:])] = i
+	}
+
+	return &SignatureType{
+		SigType:    magic,
+		BlockLen:   blockLen,
+		StrongLen:  strongLen,
+		Weak2block: weak2block,
+		sums:       sums,
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package librsync
+
+import "os"
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return errMmapUnsupported
+}
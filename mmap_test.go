@@ -0,0 +1,155 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSignatureMapped(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	dir := t.TempDir()
+
+	old, _, _ := makeImage(t, 1024*1024, DeltaOptions{})
+	sigData := &bytes.Buffer{}
+	_, err := Signature(bytes.NewReader(old), sigData, 512, 24, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+	want, err := ReadSignature(bytes.NewReader(sigData.Bytes()))
+	r.NoError(err)
+
+	path := filepath.Join(dir, "sig")
+	r.NoError(ioutil.WriteFile(path, sigData.Bytes(), 0600))
+	m, err := MapFile(path)
+	r.NoError(err)
+	defer m.Close()
+	a.Equal(runtime.GOOS == "linux", m.Mapped())
+
+	got, err := ReadSignatureMapped(m)
+	r.NoError(err)
+	a.Equal(want.SigType, got.SigType)
+	a.Equal(want.BlockLen, got.BlockLen)
+	a.Equal(want.StrongLen, got.StrongLen)
+	a.Equal(want.Weak2block, got.Weak2block)
+	r.Equal(want.NumBlocks(), got.NumBlocks())
+	for i := 0; i < want.NumBlocks(); i++ {
+		a.Equal(want.StrongSigs[i], got.StrongSum(i))
+	}
+	if m.Mapped() {
+		// The strong sums aren't copied.
+		a.Nil(got.StrongSigs)
+	}
+
+	// Appending to a strong sum doesn't write to the mapping.
+	_ = append(got.StrongSum(0), 0)
+	a.Equal(want.StrongSigs[1], got.StrongSum(1))
+
+	// Deltas are the same with either signature.
+	_, new, _ := makeImage(t, 1024*1024, DeltaOptions{})
+	wantDelta, gotDelta := &bytes.Buffer{}, &bytes.Buffer{}
+	r.NoError(Delta(want, bytes.NewReader(new), wantDelta))
+	r.NoError(Delta(got, bytes.NewReader(new), gotDelta))
+	a.Equal(wantDelta.Bytes(), gotDelta.Bytes())
+
+	// The signature is truncated.
+	path = filepath.Join(dir, "truncated")
+	r.NoError(ioutil.WriteFile(path, sigData.Bytes()[:sigData.Len()-1], 0600))
+	truncated, err := MapFile(path)
+	r.NoError(err)
+	defer truncated.Close()
+	_, err = ReadSignatureMapped(truncated)
+	r.Error(err)
+
+	// Empty files can't be mapped, and are read instead.
+	path = filepath.Join(dir, "empty")
+	r.NoError(ioutil.WriteFile(path, nil, 0600))
+	empty, err := MapFile(path)
+	r.NoError(err)
+	defer empty.Close()
+	a.False(empty.Mapped())
+	_, err = ReadSignatureMapped(empty)
+	r.Equal(io.EOF, err)
+}
+
+func TestPatchMapped(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	dir := t.TempDir()
+
+	old, new, delta := makeImage(t, 4*1024*1024, DeltaOptions{Fill: true})
+	path := filepath.Join(dir, "old")
+	r.NoError(ioutil.WriteFile(path, old, 0600))
+	m, err := MapFile(path)
+	r.NoError(err)
+	defer m.Close()
+
+	out := &bytes.Buffer{}
+	r.NoError(Patch(m, bytes.NewReader(delta), out))
+	a.True(bytes.Equal(new, out.Bytes()))
+
+	f, err := os.Create(filepath.Join(dir, "new"))
+	r.NoError(err)
+	defer f.Close()
+	r.NoError(PatchFromSource(m, bytes.NewReader(delta), f, PatchOptions{}))
+	got, err := ioutil.ReadFile(f.Name())
+	r.NoError(err)
+	a.True(bytes.Equal(new, got))
+
+	// The basis is too short.
+	path = filepath.Join(dir, "short")
+	r.NoError(ioutil.WriteFile(path, old[:len(old)/2], 0600))
+	short, err := MapFile(path)
+	r.NoError(err)
+	defer short.Close()
+	r.Error(Patch(short, bytes.NewReader(delta), &bytes.Buffer{}))
+}
+
+func benchmarkPatchMapped(b *testing.B, size int, mapped bool) {
+	old, new, delta := makeImage(b, size, DeltaOptions{})
+	path := filepath.Join(b.TempDir(), "old")
+	if err := ioutil.WriteFile(path, old, 0600); err != nil {
+		b.Fatal(err)
+	}
+	var base io.ReadSeeker
+	if mapped {
+		m, err := MapFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer m.Close()
+		base = m
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+		// Hiding the file makes copies go through memory.
+		base = readWriteSeekerOnly{f}
+	}
+
+	b.SetBytes(int64(len(new)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := Patch(base, bytes.NewReader(delta), ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPatchMapped256MB(b *testing.B) {
+	benchmarkPatchMapped(b, 256*1024*1024, true)
+}
+
+func BenchmarkPatchNotMapped256MB(b *testing.B) {
+	benchmarkPatchMapped(b, 256*1024*1024, false)
+}
@@ -0,0 +1,188 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+)
+
+// Size of the aligned pages compared by an Overwriter. A page is rewritten
+// entirely if any of its bytes differ, as flash storage would do anyway.
+const overwritePageSize = 4096
+
+// ReaderWriterAt is the interface that groups io.ReaderAt and io.WriterAt,
+// like an *os.File or a block device.
+type ReaderWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Overwriter is an io.Writer writing over existing data, typically a previous
+// version of the output, such as the inactive partition of an A/B update.
+// Data is compared with what is already there before being written, and
+// identical pages are skipped, which reduces the wear of flash storage when
+// the output is similar to the existing data.
+//
+// An Overwriter can be passed as the output of Patch or PatchWithOptions. It
+// implements io.ReaderAt for target copies, but not io.Seeker, so that
+// PatchOptions.Sparse has no effect: holes would keep the existing data.
+//
+// Existing data past the end of the output is left as is: the caller should
+// truncate the target to Size if needed.
+type Overwriter struct {
+	target ReaderWriterAt
+
+	// Offset in target of the first byte written, and of the next one.
+	start, off int64
+
+	// Number of bytes actually written to target.
+	written int64
+
+	// Existing data, read for comparison.
+	buf []byte
+}
+
+// NewOverwriter returns an Overwriter writing over the contents of target,
+// starting at offset zero.
+func NewOverwriter(target ReaderWriterAt) *Overwriter {
+	return &Overwriter{target: target}
+}
+
+// NewSeekingOverwriter returns an Overwriter writing over the contents of rws,
+// starting at its current offset. rws must not be used by anything else while
+// the Overwriter is in use.
+func NewSeekingOverwriter(rws io.ReadWriteSeeker) (*Overwriter, error) {
+	off, err := rws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &Overwriter{target: &seekingReaderWriterAt{rws: rws, pos: off}, start: off, off: off}, nil
+}
+
+// Write compares p with the existing data at the current offset, and writes
+// the pages which differ.
+func (o *Overwriter) Write(p []byte) (int, error) {
+	if o.buf == nil {
+		o.buf = make([]byte, sourceChunkSize)
+	}
+
+	done := 0
+	for done < len(p) {
+		chunk := p[done:]
+		if len(chunk) > len(o.buf) {
+			chunk = chunk[:len(o.buf)]
+		}
+		err := o.writeChunk(chunk)
+		if err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	return done, nil
+}
+
+func (o *Overwriter) writeChunk(p []byte) error {
+	existing := o.buf[:len(p)]
+	n, err := o.target.ReadAt(existing, o.off)
+	if n < len(p) && err != io.EOF {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	// Bytes past the end of the existing data always differ.
+	existing = existing[:n]
+
+	// Write the runs of differing pages, aligned on the offset in target.
+	pending := -1
+	i := 0
+	for i < len(p) {
+		end := i + overwritePageSize - int((o.off+int64(i))%overwritePageSize)
+		if end > len(p) {
+			end = len(p)
+		}
+		same := end <= len(existing) && bytes.Equal(p[i:end], existing[i:end])
+		if !same && pending < 0 {
+			pending = i
+		}
+		if same && pending >= 0 {
+			if err := o.writeAt(p[pending:i], o.off+int64(pending)); err != nil {
+				return err
+			}
+			pending = -1
+		}
+		i = end
+	}
+	if pending >= 0 {
+		if err := o.writeAt(p[pending:], o.off+int64(pending)); err != nil {
+			return err
+		}
+	}
+
+	o.off += int64(len(p))
+	return nil
+}
+
+func (o *Overwriter) writeAt(p []byte, off int64) error {
+	n, err := o.target.WriteAt(p, off)
+	o.written += int64(n)
+	return err
+}
+
+// ReadAt reads the output back, at offsets relative to where the Overwriter
+// started writing.
+func (o *Overwriter) ReadAt(p []byte, off int64) (int, error) {
+	return o.target.ReadAt(p, o.start+off)
+}
+
+// Written returns the number of bytes actually written to the target.
+func (o *Overwriter) Written() int64 {
+	return o.written
+}
+
+// Size returns the number of bytes written to the Overwriter, including those
+// which were identical and skipped.
+func (o *Overwriter) Size() int64 {
+	return o.off - o.start
+}
+
+// seekingReaderWriterAt implements ReaderWriterAt by seeking rws.
+type seekingReaderWriterAt struct {
+	rws io.ReadWriteSeeker
+
+	// Position of rws, or -1 if unknown.
+	pos int64
+}
+
+func (s *seekingReaderWriterAt) seek(off int64) error {
+	if off == s.pos {
+		return nil
+	}
+	_, err := s.rws.Seek(off, io.SeekStart)
+	if err != nil {
+		s.pos = -1
+		return err
+	}
+	s.pos = off
+	return nil
+}
+
+func (s *seekingReaderWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := s.seek(off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.rws, p)
+	s.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *seekingReaderWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := s.seek(off); err != nil {
+		return 0, err
+	}
+	n, err := s.rws.Write(p)
+	s.pos += int64(n)
+	return n, err
+}
@@ -0,0 +1,92 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readWriteSeekerOnly hides the other methods of an *os.File.
+type readWriteSeekerOnly struct {
+	f *os.File
+}
+
+func (s readWriteSeekerOnly) Read(p []byte) (int, error)  { return s.f.Read(p) }
+func (s readWriteSeekerOnly) Write(p []byte) (int, error) { return s.f.Write(p) }
+func (s readWriteSeekerOnly) Seek(off int64, whence int) (int64, error) {
+	return s.f.Seek(off, whence)
+}
+
+func TestOverwriter(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, delta := makeImage(t, 4*1024*1024, DeltaOptions{TargetCopies: true, Fill: true})
+	dir := t.TempDir()
+
+	tests := map[string]struct {
+		existing []byte
+		maxWrite int64
+	}{
+		"previous":    {old, int64(len(new)) / 2},
+		"same":        {new, 0},
+		"empty":       {nil, int64(len(new))},
+		"shorter":     {new[:len(new)/2], int64(len(new)) / 2},
+		"longer":      {append(append([]byte{}, new...), old...), 0},
+		"unaligned":   {append([]byte{1}, new...), int64(len(new))},
+		"single-byte": {append(append(append([]byte{}, new[:1000]...), ^new[1000]), new[1001:]...), overwritePageSize},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			r.NoError(ioutil.WriteFile(path, tt.existing, 0600))
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			r.NoError(err)
+			defer f.Close()
+
+			o := NewOverwriter(f)
+			r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta), o))
+			a.Equal(int64(len(new)), o.Size())
+			a.LessOrEqual(o.Written(), tt.maxWrite)
+			r.NoError(f.Truncate(o.Size()))
+
+			got, err := ioutil.ReadFile(path)
+			r.NoError(err)
+			a.True(bytes.Equal(new, got))
+		})
+	}
+}
+
+func TestSeekingOverwriter(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, delta := makeImage(t, 4*1024*1024, DeltaOptions{TargetCopies: true})
+
+	// The output starts after a header which is kept.
+	header := []byte("header")
+	path := filepath.Join(t.TempDir(), "out")
+	r.NoError(ioutil.WriteFile(path, append(append([]byte{}, header...), old...), 0600))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	r.NoError(err)
+	defer f.Close()
+	_, err = f.Seek(int64(len(header)), io.SeekStart)
+	r.NoError(err)
+
+	o, err := NewSeekingOverwriter(readWriteSeekerOnly{f})
+	r.NoError(err)
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta), o))
+	a.Equal(int64(len(new)), o.Size())
+	a.Less(o.Written(), int64(len(new))/2)
+
+	got, err := ioutil.ReadFile(path)
+	r.NoError(err)
+	a.True(bytes.Equal(append(header, new...), got))
+}
@@ -0,0 +1,304 @@
+package librsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Maximum number of bytes written by a job of PatchParallel. Longer commands
+// are split, and consecutive literals are merged up to this size.
+const parallelJobSize = 1024 * 1024
+
+// patchJob is a part of the output of PatchParallel, written by a worker.
+type patchJob struct {
+	kind OpKind
+
+	// Where the job writes in the output, and how many bytes.
+	off, n int64
+
+	// Position in the basis, for KIND_COPY.
+	pos int64
+
+	// Data, for KIND_LITERAL.
+	data []byte
+
+	// Byte to repeat, for KIND_FILL.
+	fill byte
+}
+
+// PatchParallel applies delta to base like Patch, writing the result to out
+// with up to the given number of workers, or GOMAXPROCS if workers is zero or
+// less.
+//
+// The delta is read sequentially, computing where each command writes in the
+// output, while the commands are executed concurrently. Target copies wait
+// for the commands before them to complete, and need out to implement
+// io.ReaderAt. Deltas generated by GzipDelta or with a Filter can't be
+// applied in parallel, and signed deltas must be checked with VerifyStream
+// first.
+//
+// out is not truncated, and only the ranges written by the delta are
+// changed.
+func PatchParallel(base io.ReaderAt, delta io.Reader, out io.WriterAt, workers int) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	header, err := readDeltaHeader(delta)
+	if err != nil {
+		return err
+	}
+	if header.has(DELTA_FLAG_IN_PLACE) {
+		return errInPlaceDelta
+	}
+	if header.has(DELTA_FLAG_GZIP) || header.has(DELTA_FLAG_FILTER) {
+		return errors.New("deltas with transformed contents can't be applied in parallel")
+	}
+
+	p := &parallelPatcher{
+		base:   base,
+		delta:  delta,
+		out:    out,
+		header: header,
+		jobs:   make(chan patchJob, 2*workers),
+	}
+	p.literals.New = func() interface{} {
+		return make([]byte, 0, parallelJobSize)
+	}
+
+	if header.has(DELTA_FLAG_TARGET_COPY) {
+		ra, ok := out.(io.ReaderAt)
+		if !ok || !readable(ra) {
+			return errors.New("deltas with target copies can only be applied in parallel to a readable io.ReaderAt")
+		}
+		p.target = ra
+	}
+	if header.has(DELTA_FLAG_COMPRESSED_LITERALS) {
+		p.codec, err = literalCodec(header.codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	var workersDone sync.WaitGroup
+	workersDone.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer workersDone.Done()
+			p.work()
+		}()
+	}
+
+	err = p.run()
+	close(p.jobs)
+	workersDone.Wait()
+	if jobErr := p.failed(); jobErr != nil {
+		return jobErr
+	}
+	return err
+}
+
+// parallelPatcher holds the state of a PatchParallel.
+type parallelPatcher struct {
+	base   io.ReaderAt
+	delta  io.Reader
+	out    io.WriterAt
+	header deltaHeader
+	target io.ReaderAt
+	codec  LiteralCodec
+
+	jobs    chan patchJob
+	pending sync.WaitGroup
+
+	// Offset in the output of the next command.
+	off int64
+
+	// Literal data not sent to the workers yet, ending at off.
+	literal []byte
+
+	// Buffers for literal data.
+	literals sync.Pool
+
+	mu  sync.Mutex
+	err error
+}
+
+// run reads the delta and sends its commands to the workers.
+func (p *parallelPatcher) run() error {
+	for p.failed() == nil {
+		cmd, param1, param2, err := readCommand(p.delta)
+		if err != nil {
+			return err
+		}
+
+		if !p.header.allows(cmd.Kind) {
+			return fmt.Errorf("Bogus command %x", cmd.Kind)
+		}
+
+		if cmd.Kind != KIND_LITERAL && cmd.Kind != KIND_LITERAL_Z {
+			p.flushLiteral()
+		}
+
+		switch cmd.Kind {
+		case KIND_LITERAL:
+			_, err = io.CopyN(literalWriter{p}, p.delta, param1)
+		case KIND_LITERAL_Z:
+			_, err = copyCompressedLiteral(literalWriter{p}, p.delta, p.codec, param1, param2)
+		case KIND_COPY:
+			p.split(patchJob{kind: KIND_COPY, pos: param1, n: param2})
+		case KIND_FILL:
+			p.split(patchJob{kind: KIND_FILL, fill: byte(param1), n: param2})
+		case KIND_TARGET_COPY:
+			err = p.targetCopy(param1, param2)
+		case KIND_END:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split sends job to the workers in parts of at most parallelJobSize bytes,
+// starting at the current output offset.
+func (p *parallelPatcher) split(job patchJob) {
+	n := job.n
+	for n > 0 {
+		part := job
+		part.off = p.off
+		part.n = n
+		if part.n > parallelJobSize {
+			part.n = parallelJobSize
+		}
+		p.send(part)
+
+		job.pos += part.n
+		p.off += part.n
+		n -= part.n
+	}
+}
+
+func (p *parallelPatcher) send(job patchJob) {
+	p.pending.Add(1)
+	p.jobs <- job
+}
+
+// flushLiteral sends the pending literal data to the workers.
+func (p *parallelPatcher) flushLiteral() {
+	if len(p.literal) == 0 {
+		return
+	}
+	n := int64(len(p.literal))
+	p.send(patchJob{kind: KIND_LITERAL, off: p.off - n, n: n, data: p.literal})
+	p.literal = nil
+}
+
+// targetCopy copies output data once the commands before it are written.
+func (p *parallelPatcher) targetCopy(pos, n int64) error {
+	p.pending.Wait()
+	if err := p.failed(); err != nil {
+		return err
+	}
+
+	err := copyTarget(&offsetWriter{p.out, p.off}, p.target, pos, n, p.off)
+	if err != nil {
+		return err
+	}
+	p.off += n
+	return nil
+}
+
+// work executes jobs until there are no more, or one fails.
+func (p *parallelPatcher) work() {
+	buf := make([]byte, parallelJobSize)
+	for job := range p.jobs {
+		if p.failed() == nil {
+			err := p.execute(job, buf)
+			if err != nil {
+				p.fail(err)
+			}
+		}
+		if job.data != nil {
+			p.literals.Put(job.data[:0])
+		}
+		p.pending.Done()
+	}
+}
+
+func (p *parallelPatcher) execute(job patchJob, buf []byte) error {
+	switch job.kind {
+	case KIND_LITERAL:
+		_, err := p.out.WriteAt(job.data, job.off)
+		return err
+	case KIND_COPY:
+		n, err := p.base.ReadAt(buf[:job.n], job.pos)
+		if int64(n) < job.n {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		_, err = p.out.WriteAt(buf[:n], job.off)
+		return err
+	case KIND_FILL:
+		_, err := writeFill(&offsetWriter{p.out, job.off}, job.fill, job.n)
+		return err
+	}
+	return nil
+}
+
+func (p *parallelPatcher) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// failed returns the error of the first failed job, if any.
+func (p *parallelPatcher) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// literalWriter accumulates literal data written to the output, sending it
+// to the workers in jobs of parallelJobSize bytes.
+type literalWriter struct {
+	p *parallelPatcher
+}
+
+func (w literalWriter) Write(b []byte) (int, error) {
+	p := w.p
+	written := 0
+	for written < len(b) {
+		if p.literal == nil {
+			p.literal = p.literals.Get().([]byte)
+		}
+		n := copy(p.literal[len(p.literal):cap(p.literal)], b[written:])
+		p.literal = p.literal[:len(p.literal)+n]
+		p.off += int64(n)
+		written += n
+
+		if len(p.literal) == cap(p.literal) {
+			p.flushLiteral()
+		}
+	}
+	return written, nil
+}
+
+// offsetWriter writes sequentially to w, starting at off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,156 @@
+package librsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchParallel(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	// Target copies read data written by other goroutines.
+	dir := t.TempDir()
+	for name, opts := range deltaOptionSets("plain", "target-copies") {
+		for _, tt := range allTestCases {
+			t.Run(name+"/"+tt, func(t *testing.T) {
+				file, _, _, _, err := argsFromTestName(tt)
+				r.NoError(err)
+
+				sig, err := ReadSignatureFile("testdata/" + tt + ".signature")
+				r.NoError(err)
+				newData, err := ioutil.ReadFile("testdata/" + file + ".new")
+				r.NoError(err)
+				delta := &bytes.Buffer{}
+				r.NoError(DeltaWithOptions(sig, bytes.NewReader(newData), delta, opts))
+
+				base, err := os.Open("testdata/" + file + ".old")
+				r.NoError(err)
+				defer base.Close()
+				out, err := os.Create(filepath.Join(dir, "out"))
+				r.NoError(err)
+				defer out.Close()
+
+				r.NoError(PatchParallel(base, delta, out, 4))
+				got, err := ioutil.ReadFile(out.Name())
+				r.NoError(err)
+				a.Equal(string(newData), string(got))
+			})
+		}
+	}
+}
+
+// makeImage returns a large basis and a new version of it with scattered
+// changes, and the delta between them.
+func makeImage(t errorI, size int, opts DeltaOptions) (old, new, delta []byte) {
+	rnd := rand.New(rand.NewSource(1))
+	old = make([]byte, size)
+	rnd.Read(old)
+
+	new = append([]byte{}, old...)
+	for i := 0; i < 100; i++ {
+		pos := rnd.Intn(len(new) - 10000)
+		rnd.Read(new[pos : pos+rnd.Intn(10000)])
+	}
+	// Some data moved around, and some zeros.
+	copy(new[size/2:], old[:size/8])
+	copy(new[size/4:size/4+size/16], make([]byte, size/16))
+
+	buf := &bytes.Buffer{}
+	err := DeltaWithOptions(signature(t, bytes.NewReader(old)), bytes.NewReader(new), buf, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	return old, new, buf.Bytes()
+}
+
+func TestPatchParallelImage(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, delta := makeImage(t, 16*1024*1024, DeltaOptions{Fill: true, LiteralCodec: &FlateCodec{}})
+
+	// The output is only written where the delta says.
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	r.NoError(err)
+	defer out.Close()
+	_, err = out.Write(bytes.Repeat([]byte{0xff}, len(new)))
+	r.NoError(err)
+
+	r.NoError(PatchParallel(bytes.NewReader(old), bytes.NewReader(delta), out, 0))
+	got, err := ioutil.ReadFile(out.Name())
+	r.NoError(err)
+	a.True(bytes.Equal(new, got))
+}
+
+func TestPatchParallelErrors(t *testing.T) {
+	r := require.New(t)
+
+	old, _, delta := makeImage(t, 4*1024*1024, DeltaOptions{})
+	dir := t.TempDir()
+	out, err := os.Create(filepath.Join(dir, "out"))
+	r.NoError(err)
+	defer out.Close()
+
+	// The basis is too short.
+	err = PatchParallel(bytes.NewReader(old[:len(old)/2]), bytes.NewReader(delta), out, 4)
+	r.Error(err)
+
+	// The delta is truncated.
+	err = PatchParallel(bytes.NewReader(old), bytes.NewReader(delta[:len(delta)/2]), out, 4)
+	r.Error(err)
+
+	// Target copies need to read back the output.
+	_, _, delta = makeImage(t, 1024*1024, DeltaOptions{TargetCopies: true})
+	err = PatchParallel(bytes.NewReader(old), bytes.NewReader(delta), writerAtOnly{out}, 4)
+	r.Error(err)
+}
+
+type writerAtOnly struct {
+	w *os.File
+}
+
+func (w writerAtOnly) WriteAt(p []byte, off int64) (int, error) {
+	return w.w.WriteAt(p, off)
+}
+
+func benchmarkPatchImage(b *testing.B, size int, parallel bool) {
+	old, new, delta := makeImage(b, size, DeltaOptions{})
+	out, err := os.Create(filepath.Join(b.TempDir(), "out"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	b.SetBytes(int64(len(new)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if parallel {
+			err = PatchParallel(bytes.NewReader(old), bytes.NewReader(delta), out, 0)
+		} else {
+			_, err = out.Seek(0, 0)
+			if err == nil {
+				err = Patch(bytes.NewReader(old), bytes.NewReader(delta), out)
+			}
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPatchImage256MB(b *testing.B) {
+	benchmarkPatchImage(b, 256*1024*1024, false)
+}
+
+func BenchmarkPatchParallelImage256MB(b *testing.B) {
+	benchmarkPatchImage(b, 256*1024*1024, true)
+}
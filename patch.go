@@ -1,9 +1,15 @@
 package librsync
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"os"
 )
 
 type MagicNumber uint32
@@ -11,6 +17,10 @@ type MagicNumber uint32
 const (
 	DELTA_MAGIC MagicNumber = 0x72730236
 
+	// A delta using librsync-go extensions to the format. The magic number is
+	// followed by a uint32 with DeltaFlags telling which ones.
+	DELTA_EXT_MAGIC MagicNumber = 0x72730246
+
 	// A signature file with MD4 signatures.
 	//
 	// Backward compatible with librsync < 1.0, but strongly deprecated because
@@ -20,6 +30,10 @@ const (
 
 	// A signature file using the BLAKE2 hash. Supported from librsync 1.0.
 	BLAKE2_SIG_MAGIC MagicNumber = 0x72730137
+
+	// A signature of the entries of a tar archive, see TarSignature. Only
+	// supported by librsync-go.
+	TAR_SIG_MAGIC MagicNumber = 0x72730154
 )
 
 func readParam(r io.Reader, size uint8) int64 {
@@ -44,45 +58,468 @@ func readParam(r io.Reader, size uint8) int64 {
 	return 0
 }
 
+// readCommand reads the next command of a delta, with its parameters.
+func readCommand(r io.Reader) (cmd Command, param1, param2 int64, err error) {
+	var op Op
+	err = binary.Read(r, binary.BigEndian, &op)
+	if err != nil {
+		return
+	}
+	cmd = op2cmd[op]
+
+	if cmd.Len1 == 0 {
+		param1 = int64(cmd.Immediate)
+	} else {
+		param1 = readParam(r, cmd.Len1)
+		param2 = readParam(r, cmd.Len2)
+	}
+	return
+}
+
+// PatchOptions controls how PatchWithOptions applies a delta. The zero value
+// gives the same behavior as Patch.
+type PatchOptions struct {
+	// Sparse makes aligned blocks of zeros in the output, like those of FILL
+	// commands or copied from the holes of a sparse basis, create holes
+	// instead of being written, by seeking over them. This is done only if
+	// out implements io.WriteSeeker, in which case it must read as zeros past
+	// its end, like a newly created or truncated file, unless PunchHoles is
+	// set.
+	Sparse bool
+
+	// PunchHoles makes Sparse punch holes in out if it is an *os.File, so
+	// that it may hold other data already. Where holes can't be punched, the
+	// zeros are written.
+	PunchHoles bool
+
+	// Verifier, if not nil, checks the ed25519 signature of the delta before
+	// applying it. The delta must then be signed with a SignedWriter, unless
+	// DetachedSignature is set.
+	Verifier Verifier
+
+	// DetachedSignature is the signature of the delta returned by
+	// DetachedSignature, checked by Verifier.
+	DetachedSignature []byte
+
+	// Journal is the path of the file where PatchInPlace records its
+	// progress, if not empty.
+	Journal string
+
+	// Checkpoint, if not nil, is called by PatchResumable with its progress
+	// every CheckpointInterval bytes of output, or 64MiB if zero. The
+	// checkpoint should be persisted before returning; an error aborts the
+	// patch.
+	Checkpoint         func(PatchCheckpoint) error
+	CheckpointInterval int64
+
+	// MaxOutputSize, if not zero, limits the number of bytes written by the
+	// commands of the delta. A command that would exceed it fails with
+	// ErrOutputTooLarge before writing anything.
+	MaxOutputSize int64
+
+	// MaxOps, if not zero, limits the number of commands of the delta, which
+	// fails with ErrTooManyOps otherwise.
+	MaxOps int64
+
+	// ExpectedSize, if not zero, is the number of bytes the commands of the
+	// delta must write. A command that would exceed it fails like with
+	// MaxOutputSize, and a delta ending before fails with
+	// ErrOutputSizeMismatch.
+	ExpectedSize int64
+}
+
+var (
+	// ErrOutputTooLarge is returned when a delta writes more than
+	// PatchOptions.MaxOutputSize or PatchOptions.ExpectedSize bytes.
+	ErrOutputTooLarge = errors.New("delta output is too large")
+
+	// ErrTooManyOps is returned when a delta has more than
+	// PatchOptions.MaxOps commands.
+	ErrTooManyOps = errors.New("delta has too many commands")
+
+	// ErrOutputSizeMismatch is returned when a delta writes less than
+	// PatchOptions.ExpectedSize bytes.
+	ErrOutputSizeMismatch = errors.New("delta output doesn't have the expected size")
+)
+
+// patchLimits enforces the limits set by PatchOptions on the commands of a
+// delta.
+type patchLimits struct {
+	maxSize  int64
+	maxOps   int64
+	expected int64
+
+	// Number of commands so far.
+	ops int64
+}
+
+func newPatchLimits(opts PatchOptions) patchLimits {
+	l := patchLimits{maxSize: opts.MaxOutputSize, maxOps: opts.MaxOps, expected: opts.ExpectedSize}
+	if l.expected > 0 && (l.maxSize <= 0 || l.expected < l.maxSize) {
+		l.maxSize = l.expected
+	}
+	return l
+}
+
+// check tells if the next command may be applied after written bytes of
+// output, counting it.
+func (l *patchLimits) check(kind OpKind, param1, param2, written int64) error {
+	if kind == KIND_END {
+		if l.expected > 0 && written != l.expected {
+			return ErrOutputSizeMismatch
+		}
+		return nil
+	}
+
+	err := l.count()
+	if err != nil {
+		return err
+	}
+
+	n := param2
+	if kind == KIND_LITERAL || kind == KIND_LITERAL_Z {
+		n = param1
+	}
+	if n < 0 {
+		return fmt.Errorf("Bogus command length %d", n)
+	}
+	if l.maxSize > 0 && n > l.maxSize-written {
+		return ErrOutputTooLarge
+	}
+	return nil
+}
+
+// count counts a command which doesn't write.
+func (l *patchLimits) count() error {
+	l.ops++
+	if l.maxOps > 0 && l.ops > l.maxOps {
+		return ErrTooManyOps
+	}
+	return nil
+}
+
+// Patch applies delta to base, writing the result to out.
+//
+// If the delta contains target copies (see DeltaOptions.TargetCopies), data is
+// read back from out if it implements io.ReaderAt and can be read, like a file
+// opened for reading and writing; in this case out must start at offset zero.
+// Otherwise the whole output is kept in memory while patching.
+//
+// If the delta was generated by GzipDelta from the decompressed contents of
+// gzip files, or with a Filter, base must be the original basis; it is
+// decompressed or filtered into a temporary file, and the output is
+// transformed back.
+//
+// If base and out are both regular files, data copied from base is copied
+// within the kernel with copy_file_range on Linux, letting filesystems which
+// support it share the data instead of duplicating it.
 func Patch(base io.ReadSeeker, delta io.Reader, out io.Writer) error {
-	var magic MagicNumber
+	return PatchWithOptions(base, delta, out, PatchOptions{})
+}
+
+// PatchWithOptions is like Patch, but allows to customize how the delta is
+// applied. See PatchOptions for details.
+func PatchWithOptions(base io.ReadSeeker, delta io.Reader, out io.Writer, opts PatchOptions) error {
+	return PatchFromSource(NewReadSeekerSource(base), delta, out, opts)
+}
 
-	err := binary.Read(delta, binary.BigEndian, &magic)
+// PatchFromSource is like PatchWithOptions, but reads the basis from src. Each
+// COPY command is hinted to src before being read.
+func PatchFromSource(src BlockSource, delta io.Reader, out io.Writer, opts PatchOptions) error {
+	delta, closeDelta, err := verifiedStream(delta, opts.Verifier, opts.DetachedSignature)
 	if err != nil {
 		return err
 	}
+	defer closeDelta()
 
-	if magic != DELTA_MAGIC {
-		return fmt.Errorf("Got magic number %x rather than expected value %x", magic, DELTA_MAGIC)
+	header, err := readDeltaHeader(delta)
+	if err != nil {
+		return err
+	}
+	if header.has(DELTA_FLAG_IN_PLACE) {
+		return errInPlaceDelta
 	}
 
-	for {
-		var op Op
-		err := binary.Read(delta, binary.BigEndian, &op)
+	p := &patcher{
+		base:   src,
+		delta:  delta,
+		out:    out,
+		header: header,
+		limits: newPatchLimits(opts),
+	}
+
+	var filter Filter
+	if header.has(DELTA_FLAG_FILTER) {
+		filter, err = filterByID(header.filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	if header.has(DELTA_FLAG_GZIP) || filter != nil {
+		f, err := transformedBase(src, header, filter)
 		if err != nil {
 			return err
 		}
-		cmd := op2cmd[op]
+		defer removeTemp(f)
+		p.base = NewReaderAtSource(f)
+	}
 
-		var param1, param2 int64
+	// Writers to close after patching, in reverse order.
+	var closers []io.Closer
+	if header.has(DELTA_FLAG_GZIP) {
+		gz, err := newGzipOutput(p.out, header.gzip)
+		if err != nil {
+			return err
+		}
+		p.out = gz
+		closers = append(closers, gz)
+	}
+	if filter != nil {
+		fw := filter.NewDecoder(p.out)
+		p.out = fw
+		closers = append(closers, fw)
+	}
 
-		if cmd.Len1 == 0 {
-			param1 = int64(cmd.Immediate)
+	if header.has(DELTA_FLAG_TARGET_COPY) {
+		if ra, ok := p.out.(io.ReaderAt); ok && readable(ra) {
+			p.target = ra
 		} else {
-			param1 = readParam(delta, cmd.Len1)
-			param2 = readParam(delta, cmd.Len2)
+			h := &outputHistory{w: p.out}
+			p.target = h
+			p.out = h
 		}
+	}
 
-		switch cmd.Kind {
-		default:
+	if header.has(DELTA_FLAG_COMPRESSED_LITERALS) {
+		p.codec, err = literalCodec(header.codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ws, ok := p.out.(io.WriteSeeker); ok && opts.Sparse {
+		p.sparse, err = newSparseWriter(ws, opts.PunchHoles)
+		if err != nil {
+			return err
+		}
+		p.out = p.sparse
+	}
+	p.baseFile, p.outFile = copyRangeFiles(src, p.out)
+
+	err = p.run()
+	if err != nil {
+		return err
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		err = closers[i].Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transformedBase writes to a temporary file the data that the commands of a
+// delta with DELTA_FLAG_GZIP or DELTA_FLAG_FILTER copy from base. The file
+// must be removed with removeTemp.
+func transformedBase(src BlockSource, header deltaHeader, filter Filter) (*os.File, error) {
+	var r io.Reader = io.NewSectionReader(src, 0, math.MaxInt64)
+	if header.has(DELTA_FLAG_GZIP) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing basis: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if filter != nil {
+		r = filter.NewEncoder(r)
+	}
+
+	f, err := ioutil.TempFile("", "librsync-basis-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		removeTemp(f)
+		return nil, fmt.Errorf("transforming basis: %w", err)
+	}
+	return f, nil
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// patcher holds the state of a Patch.
+type patcher struct {
+	base   BlockSource
+	delta  io.Reader
+	out    io.Writer
+	header deltaHeader
+
+	// Output which can be read back for target copies, if enabled.
+	target io.ReaderAt
+
+	// Codec for compressed literals, if enabled.
+	codec LiteralCodec
+
+	// Output leaving holes, if sparse output is enabled.
+	sparse *sparseWriter
+
+	// Basis and output, if both are regular files, to do COPY commands with
+	// copyFileRange.
+	baseFile, outFile *os.File
+
+	// Number of bytes written to out so far.
+	written int64
+
+	limits patchLimits
+
+	// Buffer for copies from base, allocated on first use.
+	buf []byte
+}
+
+func (p *patcher) run() error {
+	for {
+		cmd, param1, param2, err := readCommand(p.delta)
+		if err != nil {
+			return err
+		}
+
+		if !p.header.allows(cmd.Kind) {
 			return fmt.Errorf("Bogus command %x", cmd.Kind)
+		}
+		err = p.limits.check(cmd.Kind, param1, param2, p.written)
+		if err != nil {
+			return err
+		}
+
+		switch cmd.Kind {
 		case KIND_LITERAL:
-			io.CopyN(out, delta, param1)
+			err = p.literal(param1)
+		case KIND_LITERAL_Z:
+			err = p.compressedLiteral(param1, param2)
 		case KIND_COPY:
-			base.Seek(param1, io.SeekStart)
-			io.CopyN(out, base, param2)
+			err = p.copy(param1, param2)
+		case KIND_TARGET_COPY:
+			err = p.targetCopy(param1, param2)
+		case KIND_FILL:
+			err = p.fill(byte(param1), param2)
 		case KIND_END:
-			return nil
+			return p.end()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *patcher) literal(n int64) error {
+	written, err := io.CopyN(p.out, p.delta, n)
+	p.written += written
+	return err
+}
+
+func (p *patcher) compressedLiteral(n, zn int64) error {
+	written, err := copyCompressedLiteral(p.out, p.delta, p.codec, n, zn)
+	p.written += written
+	return err
+}
+
+func (p *patcher) copy(pos, n int64) error {
+	if p.outFile != nil {
+		written, err := copyFileRange(p.outFile, p.baseFile, pos, n)
+		p.written += written
+		if err != errCopyRangeUnsupported {
+			return err
+		}
+		// Copy the rest, and everything else, through memory.
+		p.outFile = nil
+		pos += written
+		n -= written
+	}
+
+	m, ok := p.base.(*MappedFile)
+	if ok && m.data != nil && pos >= 0 && pos <= int64(len(m.data))-n {
+		// Write the mapped data directly, without copying it.
+		written, err := p.out.Write(m.data[pos : pos+n])
+		p.written += int64(written)
+		return err
+	}
+
+	if p.buf == nil {
+		p.buf = make([]byte, sourceChunkSize)
+	}
+	written, err := copyFromSource(p.out, p.base, pos, n, p.buf)
+	p.written += written
+	return err
+}
+
+func (p *patcher) targetCopy(pos, n int64) error {
+	if p.sparse != nil {
+		// The output is read back, so it must be all written.
+		err := p.sparse.flush()
+		if err != nil {
+			return err
+		}
+	}
+	err := copyTarget(p.out, p.target, pos, n, p.written)
+	if err != nil {
+		return err
+	}
+	p.written += n
+	return nil
+}
+
+func (p *patcher) fill(b byte, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+
+	if b == 0 && p.sparse != nil {
+		p.sparse.zeros(n)
+		p.written += n
+		return nil
+	}
+
+	written, err := writeFill(p.out, b, n)
+	p.written += written
+	return err
+}
+
+func (p *patcher) end() error {
+	if p.sparse == nil {
+		return nil
+	}
+	return p.sparse.flush()
+}
+
+// Size of the buffer used to write FILL commands.
+const fillBufferSize = 64 * 1024
+
+// writeFill writes n copies of b to w.
+func writeFill(w io.Writer, b byte, n int64) (int64, error) {
+	size := int64(fillBufferSize)
+	if size > n {
+		size = n
+	}
+	buf := bytes.Repeat([]byte{b}, int(size))
+
+	var written int64
+	for written < n {
+		chunk := buf
+		if n-written < int64(len(chunk)) {
+			chunk = chunk[:n-written]
+		}
+		nw, err := w.Write(chunk)
+		written += int64(nw)
+		if err != nil {
+			return written, err
 		}
 	}
+	return written, nil
 }
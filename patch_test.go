@@ -3,7 +3,9 @@ package librsync
 import (
 	"bytes"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -82,3 +84,198 @@ func TestDeltaAndPatch(t *testing.T) {
 		})
 	}
 }
+
+// TestDeltaAndPatchWithOptions is like TestDeltaAndPatch, but with extensions
+// to the delta format enabled.
+func TestDeltaAndPatchWithOptions(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	for name, opts := range deltaOptionSets() {
+		for _, tt := range allTestCases {
+			t.Run(name+"/"+tt, func(t *testing.T) {
+				file, _, _, _, err := argsFromTestName(tt)
+				r.NoError(err)
+
+				sig, err := ReadSignatureFile("testdata/" + tt + ".signature")
+				r.NoError(err)
+
+				newFile, err := os.Open("testdata/" + file + ".new")
+				r.NoError(err)
+				deltaBuffer := &bytes.Buffer{}
+
+				err = DeltaWithOptions(sig, newFile, deltaBuffer, opts)
+				r.NoError(err)
+
+				baseFile, err := os.Open("testdata/" + file + ".old")
+				r.NoError(err)
+
+				output := &bytes.Buffer{}
+				err = Patch(baseFile, deltaBuffer, output)
+				r.NoError(err)
+
+				wantNewFile, err := ioutil.ReadFile("testdata/" + file + ".new")
+				r.NoError(err)
+
+				gotNewFile, err := ioutil.ReadAll(output)
+				r.NoError(err)
+
+				a.Equal(wantNewFile, gotNewFile)
+			})
+		}
+	}
+}
+
+// TestTargetCopiesRepeatedContent checks that data repeated in the new file,
+// but absent from the basis, is sent only once.
+func TestTargetCopiesRepeatedContent(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(old)
+	chunk := make([]byte, 100*1024)
+	rand.New(rand.NewSource(2)).Read(chunk)
+
+	// The new chunk appears three times, once overlapping with itself.
+	var newData []byte
+	newData = append(newData, chunk...)
+	newData = append(newData, old...)
+	newData = append(newData, chunk...)
+	newData = append(newData, bytes.Repeat(chunk[:1000], 50)...)
+
+	sig := signature(t, bytes.NewReader(old))
+
+	plain := &bytes.Buffer{}
+	r.NoError(Delta(sig, bytes.NewReader(newData), plain))
+
+	delta := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(newData), delta, DeltaOptions{TargetCopies: true}))
+	a.Less(delta.Len(), plain.Len()-len(chunk))
+
+	// Patch into a buffer, keeping the output in memory.
+	output := &bytes.Buffer{}
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output))
+	a.Equal(newData, output.Bytes())
+
+	// Patch into a file, reading the output back from it.
+	f, err := os.Create(filepath.Join(t.TempDir(), "new"))
+	r.NoError(err)
+	defer f.Close()
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), f))
+	gotNewFile, err := ioutil.ReadFile(f.Name())
+	r.NoError(err)
+	a.Equal(newData, gotNewFile)
+
+	// Patch into a file which can't be read back, keeping the output in memory.
+	wf, err := os.OpenFile(filepath.Join(t.TempDir(), "new"), os.O_CREATE|os.O_WRONLY, 0600)
+	r.NoError(err)
+	defer wf.Close()
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), wf))
+	gotNewFile, err = ioutil.ReadFile(wf.Name())
+	r.NoError(err)
+	a.Equal(newData, gotNewFile)
+
+	// Only the first indexed blocks are copied.
+	limited := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(newData), limited, DeltaOptions{TargetCopies: true, MaxTargetBlocks: 100}))
+	a.Less(delta.Len(), limited.Len())
+	a.Less(limited.Len(), plain.Len())
+	output.Reset()
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(limited.Bytes()), output))
+	a.Equal(newData, output.Bytes())
+}
+
+// TestFill checks that runs of a single byte are encoded as FILL commands, and
+// that these are correctly applied, with or without holes.
+func TestFill(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(old)
+
+	var newData []byte
+	newData = append(newData, old[:10000]...)
+	newData = append(newData, make([]byte, 1024*1024)...)
+	newData = append(newData, bytes.Repeat([]byte{0xff}, 100)...)
+	newData = append(newData, 0, 0, 0)
+	newData = append(newData, old[10000:]...)
+	newData = append(newData, make([]byte, 100000)...)
+
+	sig := signature(t, bytes.NewReader(old))
+
+	var stats DeltaStats
+	delta := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(newData), delta, DeltaOptions{Fill: true, Stats: &stats}))
+	a.Less(delta.Len(), 2000)
+	a.Equal(uint64(3), stats.FillCmds)
+
+	output := &bytes.Buffer{}
+	r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output))
+	a.Equal(newData, output.Bytes())
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "new"))
+	r.NoError(err)
+	defer f.Close()
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), f, PatchOptions{Sparse: true})
+	r.NoError(err)
+	gotNewFile, err := ioutil.ReadFile(f.Name())
+	r.NoError(err)
+	a.Equal(newData, gotNewFile)
+}
+
+func TestPatchLimits(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, delta := makeImage(t, 1024*1024, DeltaOptions{Fill: true})
+	size := int64(len(new))
+	dr, err := NewDeltaReader(bytes.NewReader(delta))
+	r.NoError(err)
+	var ops int64
+	for _, err = dr.Next(); err == nil; _, err = dr.Next() {
+		ops++
+	}
+
+	tests := []struct {
+		opts PatchOptions
+		err  error
+	}{
+		{PatchOptions{MaxOutputSize: size, MaxOps: ops, ExpectedSize: size}, nil},
+		{PatchOptions{MaxOutputSize: size - 1}, ErrOutputTooLarge},
+		{PatchOptions{MaxOps: ops - 1}, ErrTooManyOps},
+		{PatchOptions{ExpectedSize: size - 1}, ErrOutputTooLarge},
+		{PatchOptions{ExpectedSize: size + 1}, ErrOutputSizeMismatch},
+	}
+	for _, tt := range tests {
+		out := &countingWriter{w: ioutil.Discard}
+		err := PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta), out, tt.opts)
+		r.Equal(tt.err, err, "%+v", tt.opts)
+		if tt.opts.MaxOutputSize > 0 {
+			a.LessOrEqual(out.n, tt.opts.MaxOutputSize)
+		}
+		if tt.opts.ExpectedSize > 0 {
+			a.LessOrEqual(out.n, tt.opts.ExpectedSize)
+		}
+	}
+
+	// A tiny delta can't fill the disk.
+	huge := &bytes.Buffer{}
+	r.NoError(writeDeltaHeader(huge, deltaHeader{magic: DELTA_MAGIC}))
+	r.NoError(writeSizedCommand(huge, OP_LITERAL_N1, 1<<40))
+	huge.Write([]byte("data"))
+	out := &countingWriter{w: ioutil.Discard}
+	err = PatchWithOptions(bytes.NewReader(old), huge, out, PatchOptions{MaxOutputSize: 1 << 30})
+	r.Equal(ErrOutputTooLarge, err)
+	a.Zero(out.n)
+
+	// The limits apply to in-place deltas too.
+	inPlace := inPlaceDelta(t, old, new, InPlaceOptions{})
+	err = PatchInPlace(newMemFile(old), bytes.NewReader(inPlace), PatchOptions{MaxOutputSize: size - 1})
+	r.Equal(ErrOutputTooLarge, err)
+	err = PatchInPlace(newMemFile(old), bytes.NewReader(inPlace), PatchOptions{ExpectedSize: size + 1})
+	r.Equal(ErrOutputSizeMismatch, err)
+	err = PatchInPlace(newMemFile(old), bytes.NewReader(inPlace), PatchOptions{MaxOps: 1})
+	r.Equal(ErrTooManyOps, err)
+}
@@ -0,0 +1,478 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// Magic number of a serialized PatchCheckpoint.
+const PATCH_CHECKPOINT_MAGIC MagicNumber = 0x72730280
+
+// Number of output bytes between the checkpoints of PatchResumable, if
+// PatchOptions.CheckpointInterval is not set.
+const defaultCheckpointInterval = 64 * 1024 * 1024
+
+// Size of a serialized PatchCheckpoint.
+const patchCheckpointSize = 4 + 3*8 + sha256.Size
+
+// ErrCheckpointMismatch is returned by PatchResumable when the output doesn't
+// match the checkpoint it resumes from.
+var ErrCheckpointMismatch = errors.New("output doesn't match the checkpoint")
+
+// PatchCheckpoint is the progress of PatchResumable, from which it can resume
+// after an interruption. It is serialized by MarshalBinary, to be persisted by
+// the caller.
+type PatchCheckpoint struct {
+	// Offset in the delta of the next command to apply.
+	DeltaOffset int64
+
+	// Number of output bytes of that command already written, if it was
+	// interrupted.
+	CommandDone int64
+
+	// Number of output bytes written.
+	OutputOffset int64
+
+	// SHA-256 of the first OutputOffset bytes of the output.
+	OutputHash [sha256.Size]byte
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (c *PatchCheckpoint) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, v := range []interface{}{PATCH_CHECKPOINT_MAGIC, c.DeltaOffset, c.CommandDone, c.OutputOffset,
+		c.OutputHash} {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (c *PatchCheckpoint) UnmarshalBinary(data []byte) error {
+	if len(data) != patchCheckpointSize {
+		return errors.New("invalid checkpoint")
+	}
+	r := bytes.NewReader(data)
+	var magic MagicNumber
+	var cp PatchCheckpoint
+	for _, v := range []interface{}{&magic, &cp.DeltaOffset, &cp.CommandDone, &cp.OutputOffset, &cp.OutputHash} {
+		binary.Read(r, binary.BigEndian, v)
+	}
+	if magic != PATCH_CHECKPOINT_MAGIC || cp.DeltaOffset < 0 || cp.CommandDone < 0 || cp.OutputOffset < 0 {
+		return errors.New("invalid checkpoint")
+	}
+	*c = cp
+	return nil
+}
+
+// PatchResumable applies delta to base like PatchWithOptions, writing the
+// result at the start of out, and calling opts.Checkpoint every
+// opts.CheckpointInterval bytes of output with its progress. out is synced
+// before each checkpoint if it has a Sync method, like an *os.File.
+//
+// If resume is not nil, patching resumes from this checkpoint, with the same
+// base and delta: the output written before it is read back and checked
+// against its hash, failing with ErrCheckpointMismatch if it differs, and
+// isn't written again.
+//
+// Deltas generated by GzipDelta or with a Filter can't be resumed, and signed
+// deltas must be checked with VerifyStream first.
+func PatchResumable(base io.ReadSeeker, delta io.ReadSeeker, out ReaderWriterAt, resume *PatchCheckpoint,
+	opts PatchOptions) error {
+	if opts.Verifier != nil {
+		return errors.New("signed deltas can't be resumed, check them with VerifyStream first")
+	}
+
+	_, err := delta.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	cr := &countingReader{r: delta}
+	header, err := readDeltaHeader(cr)
+	if err != nil {
+		return err
+	}
+	if header.has(DELTA_FLAG_IN_PLACE) {
+		return errInPlaceDelta
+	}
+	if header.has(DELTA_FLAG_GZIP) || header.has(DELTA_FLAG_FILTER) {
+		return errors.New("deltas with transformed contents can't be resumed")
+	}
+
+	rp := &resumablePatcher{
+		out:      out,
+		delta:    cr,
+		seeker:   delta,
+		hash:     sha256.New(),
+		interval: opts.CheckpointInterval,
+		notify:   opts.Checkpoint,
+	}
+	if rp.interval <= 0 {
+		rp.interval = defaultCheckpointInterval
+	}
+	rp.p = &patcher{
+		base:   NewReadSeekerSource(base),
+		delta:  cr,
+		header: header,
+		target: out,
+		limits: newPatchLimits(opts),
+	}
+	if header.has(DELTA_FLAG_COMPRESSED_LITERALS) {
+		rp.p.codec, err = literalCodec(header.codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	var done int64
+	if resume != nil {
+		err = rp.resume(resume)
+		if err != nil {
+			return err
+		}
+		done = resume.CommandDone
+	}
+	rp.p.out = io.MultiWriter(&offsetWriter{out, rp.p.written}, rp.hash)
+	rp.checkpointed = rp.p.written
+
+	return rp.run(done)
+}
+
+// resumablePatcher holds the state of a PatchResumable.
+type resumablePatcher struct {
+	p     *patcher
+	out   ReaderWriterAt
+	delta *countingReader
+	hash  hash.Hash
+
+	// Seeker of the delta, to resume from a checkpoint.
+	seeker io.Seeker
+
+	interval int64
+	notify   func(PatchCheckpoint) error
+
+	// Output offset of the last checkpoint.
+	checkpointed int64
+}
+
+// resume checks the output written before cp, and positions the delta at cp.
+func (rp *resumablePatcher) resume(cp *PatchCheckpoint) error {
+	if cp.DeltaOffset < rp.delta.n {
+		return errors.New("invalid checkpoint")
+	}
+
+	_, err := io.Copy(rp.hash, io.NewSectionReader(rp.out, 0, cp.OutputOffset))
+	if err != nil {
+		return fmt.Errorf("reading output: %w", err)
+	}
+	var sum [sha256.Size]byte
+	if !bytes.Equal(rp.hash.Sum(sum[:0]), cp.OutputHash[:]) {
+		return ErrCheckpointMismatch
+	}
+
+	_, err = rp.seeker.Seek(cp.DeltaOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	rp.delta.n = cp.DeltaOffset
+	rp.p.written = cp.OutputOffset
+	return nil
+}
+
+// run applies the delta, the first command having done bytes already written.
+func (rp *resumablePatcher) run(done int64) error {
+	p := rp.p
+	for {
+		cmdOff := rp.delta.n
+		cmd, param1, param2, err := readCommand(rp.delta)
+		if err != nil {
+			return err
+		}
+
+		if !p.header.allows(cmd.Kind) {
+			return fmt.Errorf("Bogus command %x", cmd.Kind)
+		}
+		err = p.limits.check(cmd.Kind, param1, param2, p.written-done)
+		if err != nil {
+			return err
+		}
+
+		// Commands are applied in parts, so that checkpoints can be made in
+		// the middle of them.
+		var part func(off, n int64) error
+		n := param2
+		switch cmd.Kind {
+		case KIND_LITERAL:
+			n = param1
+			if done > 0 {
+				_, err = io.CopyN(ioutil.Discard, rp.delta, done)
+			}
+			part = func(off, n int64) error { return p.literal(n) }
+		case KIND_LITERAL_Z:
+			// Compressed literals are decoded at once, and only checkpointed
+			// after them.
+			if done > 0 {
+				return errors.New("invalid checkpoint")
+			}
+			err = p.compressedLiteral(param1, param2)
+			if err == nil {
+				err = rp.maybeCheckpoint(rp.delta.n, 0)
+			}
+		case KIND_COPY:
+			part = func(off, n int64) error { return p.copy(param1+off, n) }
+		case KIND_TARGET_COPY:
+			part = func(off, n int64) error { return p.targetCopy(param1+off, n) }
+		case KIND_FILL:
+			part = func(off, n int64) error { return p.fill(byte(param1), n) }
+		case KIND_END:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if part != nil {
+			if done > n {
+				return errors.New("invalid checkpoint")
+			}
+			for done < n {
+				size := rp.checkpointed + rp.interval - p.written
+				if size > n-done {
+					size = n - done
+				}
+				err = part(done, size)
+				if err != nil {
+					return err
+				}
+				done += size
+
+				if done == n {
+					err = rp.maybeCheckpoint(rp.delta.n, 0)
+				} else {
+					err = rp.maybeCheckpoint(cmdOff, done)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		done = 0
+	}
+}
+
+// maybeCheckpoint makes a checkpoint if the interval has elapsed since the
+// last one.
+func (rp *resumablePatcher) maybeCheckpoint(deltaOff, done int64) error {
+	if rp.p.written-rp.checkpointed < rp.interval {
+		return nil
+	}
+	rp.checkpointed = rp.p.written
+	if rp.notify == nil {
+		return nil
+	}
+
+	if s, ok := rp.out.(interface{ Sync() error }); ok {
+		err := s.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	cp := PatchCheckpoint{
+		DeltaOffset:  deltaOff,
+		CommandDone:  done,
+		OutputOffset: rp.p.written,
+	}
+	rp.hash.Sum(cp.OutputHash[:0])
+	return rp.notify(cp)
+}
+
+// Magic number of a serialized DeltaCheckpoint.
+const DELTA_CHECKPOINT_MAGIC MagicNumber = 0x72730281
+
+// DeltaCheckpoint is the state of a delta generated by DeltaWithOptions, from
+// which ResumeDelta can continue it, see DeltaOptions.Checkpoint. It is
+// serialized by MarshalBinary, to be persisted by the caller. Its size is
+// bounded by OUTPUT_BUFFER_SIZE and the block length of the signature.
+type DeltaCheckpoint struct {
+	// Number of bytes of the input read.
+	InputOffset int64
+
+	// Length of the delta written.
+	OutputLength int64
+
+	// Extensions used by the delta, and block length of the signature.
+	flags    DeltaFlags
+	codec    uint8
+	blockLen uint32
+
+	// Weak sum and contents of the window being matched.
+	weakSum Rollsum
+	window  []byte
+
+	// Length of the input whose blocks can be referenced by target copies.
+	emittedTo uint64
+
+	// End of the last copy in the basis, with ordered copies.
+	copyEnd uint64
+
+	// Command being accumulated, not written yet.
+	kind          matchKind
+	pos, len, run uint64
+	lit           []byte
+	stats         DeltaStats
+}
+
+// save returns the state of s, after writing n bytes of a delta with header.
+func (s *scanner) save(n int64, header deltaHeader) *DeltaCheckpoint {
+	cp := &DeltaCheckpoint{
+		InputOffset:  int64(s.inPos),
+		OutputLength: n,
+		flags:        header.flags,
+		codec:        header.codec,
+		blockLen:     s.sig.BlockLen,
+		weakSum:      s.weakSum,
+		window:       append([]byte{}, s.block.Bytes()...),
+		copyEnd:      s.copyEnd,
+		kind:         s.m.kind,
+		pos:          s.m.pos,
+		len:          s.m.len,
+		run:          s.m.run,
+		lit:          append([]byte{}, s.m.lit...),
+		stats:        s.m.stats,
+	}
+	if s.targets != nil {
+		cp.emittedTo = s.targets.emittedTo
+	}
+	return cp
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (c *DeltaCheckpoint) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, v := range []interface{}{DELTA_CHECKPOINT_MAGIC, c.InputOffset, c.OutputLength, c.flags, c.codec,
+		c.blockLen, c.weakSum.count, c.weakSum.s1, c.weakSum.s2, c.emittedTo, c.copyEnd, c.kind, c.pos, c.len,
+		c.run, c.stats, uint32(len(c.window)), c.window, uint64(len(c.lit)), c.lit} {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (c *DeltaCheckpoint) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var magic MagicNumber
+	var cp DeltaCheckpoint
+	var windowLen uint32
+	var litLen uint64
+	for _, v := range []interface{}{&magic, &cp.InputOffset, &cp.OutputLength, &cp.flags, &cp.codec,
+		&cp.blockLen, &cp.weakSum.count, &cp.weakSum.s1, &cp.weakSum.s2, &cp.emittedTo, &cp.copyEnd, &cp.kind,
+		&cp.pos, &cp.len, &cp.run, &cp.stats, &windowLen} {
+		err := binary.Read(r, binary.BigEndian, v)
+		if err != nil {
+			return fmt.Errorf("invalid checkpoint: %w", err)
+		}
+	}
+	if magic != DELTA_CHECKPOINT_MAGIC || windowLen > cp.blockLen || uint64(windowLen) != cp.weakSum.count ||
+		int(windowLen) > r.Len() {
+		return errors.New("invalid checkpoint")
+	}
+	cp.window = make([]byte, windowLen)
+	r.Read(cp.window)
+
+	err := binary.Read(r, binary.BigEndian, &litLen)
+	if err != nil || litLen != uint64(r.Len()) || litLen > OUTPUT_BUFFER_SIZE ||
+		(cp.kind == MATCH_KIND_LITERAL && litLen != cp.len) || cp.InputOffset < 0 || cp.OutputLength < 0 {
+		return errors.New("invalid checkpoint")
+	}
+	cp.lit = make([]byte, litLen)
+	r.Read(cp.lit)
+
+	*c = cp
+	return nil
+}
+
+// ResumeDelta continues the delta from the basis with signature sig to input
+// saved in cp, writing the rest of it to output. It must be called with the
+// same signature, input and options as the interrupted DeltaWithOptions, and
+// output must follow the first cp.OutputLength bytes of the delta, like a file
+// truncated to that length and opened for appending. The result is the same
+// as if the delta wasn't interrupted, and further checkpoints can be made.
+//
+// With target copies, the input before the checkpoint is read again to index
+// its blocks.
+func ResumeDelta(sig *SignatureType, input io.ReadSeeker, output io.Writer, cp *DeltaCheckpoint,
+	opts DeltaOptions) error {
+	header := opts.header()
+	if header.flags != cp.flags || header.codec != cp.codec || sig.BlockLen != cp.blockLen {
+		return errors.New("checkpoint of a delta with other options")
+	}
+	if opts.Filter != nil {
+		return errors.New("deltas with transformed contents can't be checkpointed")
+	}
+
+	litBuff, err := opts.litBuff()
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: output, n: cp.OutputLength}
+	m := opts.newMatch(cw, litBuff)
+	m.kind, m.pos, m.len, m.run, m.stats = cp.kind, cp.pos, cp.len, cp.run, cp.stats
+	m.lit = append(m.lit, cp.lit...)
+
+	var targets *targetIndex
+	if opts.TargetCopies {
+		targets = newTargetIndex(sig.BlockLen, opts.MaxTargetBlocks)
+		_, err = input.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		br := bufio.NewReader(io.LimitReader(input, cp.InputOffset))
+		for {
+			b, err := br.ReadByte()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			targets.add(b)
+		}
+		if targets.pos+uint64(len(targets.block)) != uint64(cp.InputOffset) {
+			return io.ErrUnexpectedEOF
+		}
+		targets.emitted(cp.emittedTo)
+	}
+
+	_, err = input.Seek(cp.InputOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	s := newScanner(sig, &m, 0, targets)
+	s.inPos = uint64(cp.InputOffset)
+	s.checkpointed = s.inPos
+	s.weakSum = cp.weakSum
+	s.block.Write(cp.window)
+	s.orderedCopies = opts.OrderedCopies
+	s.copyEnd = cp.copyEnd
+
+	return runDelta(s, input, cw, opts, header)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
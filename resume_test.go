@@ -0,0 +1,228 @@
+package librsync
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchCheckpointMarshal(t *testing.T) {
+	r := require.New(t)
+
+	cp := PatchCheckpoint{DeltaOffset: 1, CommandDone: 2, OutputOffset: 3}
+	cp.OutputHash[0] = 4
+	data, err := cp.MarshalBinary()
+	r.NoError(err)
+
+	var got PatchCheckpoint
+	r.NoError(got.UnmarshalBinary(data))
+	r.Equal(cp, got)
+
+	r.Error(got.UnmarshalBinary(data[1:]))
+	data[0] ^= 1
+	r.Error(got.UnmarshalBinary(data))
+}
+
+func TestPatchResumable(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	// Checkpoints can fall within commands of every kind.
+	for name, deltaOpts := range deltaOptionSets("plain", "all") {
+		t.Run(name, func(t *testing.T) {
+			old, new, delta := makeImage(t, 4*1024*1024, deltaOpts)
+
+			var checkpoints int
+			opts := PatchOptions{
+				CheckpointInterval: 256 * 1024,
+				Checkpoint: func(cp PatchCheckpoint) error {
+					checkpoints++
+					return nil
+				},
+			}
+			f := newMemFile(nil)
+			r.NoError(PatchResumable(bytes.NewReader(old), bytes.NewReader(delta), f, nil, opts))
+			a.True(bytes.Equal(new, f.data))
+			a.GreaterOrEqual(checkpoints, len(new)/(256*1024)-1)
+			writes := f.writes
+
+			// Interrupt at various writes, losing what wasn't synced, and
+			// resume from the last checkpoint.
+			for failAt := 0; failAt < writes; failAt += 7 {
+				var last []byte
+				opts.Checkpoint = func(cp PatchCheckpoint) error {
+					var err error
+					last, err = cp.MarshalBinary()
+					return err
+				}
+
+				f := newMemFile(nil)
+				f.failAt = failAt
+				err := PatchResumable(bytes.NewReader(old), bytes.NewReader(delta), f, nil, opts)
+				r.Equal(errCrash, err, "crash at %d", failAt)
+
+				var resume *PatchCheckpoint
+				if last != nil {
+					resume = &PatchCheckpoint{}
+					r.NoError(resume.UnmarshalBinary(last))
+				}
+				f = newMemFile(f.durable)
+				r.NoError(PatchResumable(bytes.NewReader(old), bytes.NewReader(delta), f, resume, opts),
+					"crash at %d", failAt)
+				r.True(bytes.Equal(new, f.data), "crash at %d", failAt)
+				if resume != nil {
+					a.Less(f.written, int64(len(new))-resume.OutputOffset+1, "crash at %d", failAt)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchResumableErrors(t *testing.T) {
+	r := require.New(t)
+
+	old, _, delta := makeImage(t, 1024*1024, DeltaOptions{})
+
+	var checkpoints []PatchCheckpoint
+	opts := PatchOptions{
+		CheckpointInterval: 64 * 1024,
+		Checkpoint: func(cp PatchCheckpoint) error {
+			checkpoints = append(checkpoints, cp)
+			return nil
+		},
+	}
+	f := newMemFile(nil)
+	r.NoError(PatchResumable(bytes.NewReader(old), bytes.NewReader(delta), f, nil, opts))
+	r.NotEmpty(checkpoints)
+	cp := checkpoints[len(checkpoints)/2]
+
+	// The output was changed before the checkpoint.
+	corrupt := newMemFile(f.data)
+	corrupt.data[cp.OutputOffset/2] ^= 1
+	err := PatchResumable(bytes.NewReader(old), bytes.NewReader(delta), corrupt, &cp, opts)
+	r.Equal(ErrCheckpointMismatch, err)
+
+	// The checkpoint can't be saved.
+	errSave := errors.New("save")
+	opts.Checkpoint = func(PatchCheckpoint) error { return errSave }
+	err = PatchResumable(bytes.NewReader(old), bytes.NewReader(delta), newMemFile(nil), nil, opts)
+	r.Equal(errSave, err)
+
+	// Filtered deltas can't be resumed.
+	filtered := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(signature(t, bytes.NewReader(old)), bytes.NewReader(old), filtered,
+		DeltaOptions{Filter: X86Filter{}}))
+	err = PatchResumable(bytes.NewReader(old), bytes.NewReader(filtered.Bytes()), newMemFile(nil), nil, PatchOptions{})
+	r.Error(err)
+}
+
+func TestPatchResumableLiteral(t *testing.T) {
+	r := require.New(t)
+
+	// Checkpoints are made in the middle of long literals.
+	rnd := rand.New(rand.NewSource(1))
+	old := randomBytes(rnd, 1024)
+	new := randomBytes(rnd, 1024*1024)
+	delta := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(signature(t, bytes.NewReader(old)), bytes.NewReader(new), delta, DeltaOptions{}))
+
+	var checkpoints []PatchCheckpoint
+	opts := PatchOptions{
+		CheckpointInterval: 100 * 1000,
+		Checkpoint: func(cp PatchCheckpoint) error {
+			checkpoints = append(checkpoints, cp)
+			return nil
+		},
+	}
+	f := newMemFile(nil)
+	r.NoError(PatchResumable(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), f, nil, opts))
+
+	for _, cp := range checkpoints {
+		r.NotZero(cp.CommandDone)
+		cp := cp
+		f := newMemFile(new[:cp.OutputOffset])
+		r.NoError(PatchResumable(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), f, &cp, opts))
+		r.True(bytes.Equal(new, f.data))
+		r.Equal(int64(len(new))-cp.OutputOffset, f.written)
+	}
+}
+
+func TestResumeDelta(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	// Checkpoints record the index of target copies and the literal codec.
+	for name, opts := range deltaOptionSets("plain", "target-copies", "compressed") {
+		t.Run(name, func(t *testing.T) {
+			old, new, _ := makeImage(t, 1024*1024, DeltaOptions{})
+			sig := signature(t, bytes.NewReader(old))
+
+			var checkpoints [][]byte
+			var stats DeltaStats
+			opts := opts
+			opts.Stats = &stats
+			opts.CheckpointInterval = 100 * 1000
+			opts.Checkpoint = func(cp *DeltaCheckpoint) error {
+				data, err := cp.MarshalBinary()
+				checkpoints = append(checkpoints, data)
+				return err
+			}
+			want := &bytes.Buffer{}
+			r.NoError(DeltaWithOptions(sig, bytes.NewReader(new), want, opts))
+			wantStats := stats
+			r.Len(checkpoints, len(new)/(100*1000))
+
+			all := checkpoints
+			for i, data := range all {
+				var cp DeltaCheckpoint
+				r.NoError(cp.UnmarshalBinary(data))
+				a.Equal(int64(i+1)*100*1000, cp.InputOffset)
+
+				checkpoints = [][]byte{}
+				got := bytes.NewBuffer(append([]byte{}, want.Bytes()[:cp.OutputLength]...))
+				r.NoError(ResumeDelta(sig, bytes.NewReader(new), got, &cp, opts))
+				r.True(bytes.Equal(want.Bytes(), got.Bytes()), "checkpoint %d", i)
+				a.Equal(wantStats, stats)
+				a.Equal(all[i+1:], checkpoints)
+			}
+		})
+	}
+}
+
+func TestResumeDeltaErrors(t *testing.T) {
+	r := require.New(t)
+
+	old, new, _ := makeImage(t, 1024*1024, DeltaOptions{})
+	sig := signature(t, bytes.NewReader(old))
+
+	var last *DeltaCheckpoint
+	opts := DeltaOptions{
+		Fill:               true,
+		CheckpointInterval: 100 * 1000,
+		Checkpoint: func(cp *DeltaCheckpoint) error {
+			last = cp
+			return nil
+		},
+	}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(new), &bytes.Buffer{}, opts))
+	r.NotNil(last)
+
+	// The options differ.
+	err := ResumeDelta(sig, bytes.NewReader(new), &bytes.Buffer{}, last, DeltaOptions{})
+	r.Error(err)
+
+	// The checkpoint is truncated.
+	data, err := last.MarshalBinary()
+	r.NoError(err)
+	var cp DeltaCheckpoint
+	r.Error(cp.UnmarshalBinary(data[:len(data)-1]))
+
+	// Filtered deltas can't be checkpointed.
+	opts.Filter = X86Filter{}
+	err = DeltaWithOptions(sig, bytes.NewReader(new), &bytes.Buffer{}, opts)
+	r.Error(err)
+}
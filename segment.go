@@ -0,0 +1,452 @@
+package librsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Magic number of the trailer of a segmented delta, see SegmentedDelta.
+const SEGMENTED_DELTA_MAGIC MagicNumber = 0x72730290
+
+// Default number of output bytes covered by a segment.
+const defaultSegmentSize = 64 * 1024 * 1024
+
+// Sizes of an entry of the index of a segmented delta, and of its trailer.
+const (
+	segmentEntrySize   = 4*8 + sha256.Size
+	segmentTrailerSize = sha256.Size + 8 + 4 + 4
+)
+
+// ErrSegmentChecksum is returned when the data of a segment doesn't match its
+// checksum.
+var ErrSegmentChecksum = errors.New("segment checksum mismatch")
+
+// SegmentedOptions controls how SegmentedDelta generates a delta.
+type SegmentedOptions struct {
+	// Delta selects the extensions used by the segments. Target copies and
+	// filters are not supported, as they make segments depend on each other.
+	Delta DeltaOptions
+
+	// SegmentSize is the number of output bytes covered by each segment. If
+	// zero, 64 MiB are used.
+	SegmentSize int64
+}
+
+// Segment is a part of a segmented delta, which is itself a delta writing a
+// range of the output.
+type Segment struct {
+	// Range of the output written by the segment.
+	OutputOffset, OutputLength int64
+
+	// Range of the segmented delta holding the segment.
+	Offset, Length int64
+
+	// SHA-256 of the segment.
+	Checksum [sha256.Size]byte
+}
+
+// SegmentIndex describes the segments of a segmented delta, in output order.
+type SegmentIndex struct {
+	// Size of the output.
+	Size int64
+
+	Segments []Segment
+}
+
+// SegmentedDelta generates a delta from the basis with signature sig to input,
+// like DeltaWithOptions, split in segments which can be applied independently:
+// in parallel, only some of them, or again after a failure. Each segment is a
+// complete delta, writing opts.SegmentSize bytes of the output at most.
+//
+// The segments are followed by their index and a trailer of fixed size, so
+// that ReadSegmentIndex can find them: the whole segmented delta can't be
+// applied by Patch.
+func SegmentedDelta(sig *SignatureType, input io.Reader, output io.Writer, opts SegmentedOptions) error {
+	if opts.Delta.TargetCopies || opts.Delta.Filter != nil {
+		return errors.New("segmented deltas don't support target copies or filters")
+	}
+	litBuff, err := opts.Delta.litBuff()
+	if err != nil {
+		return err
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := DeltaWithOptions(sig, input, pw, DeltaOptions{Fill: opts.Delta.Fill})
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	w := &segmentWriter{
+		output: &countingWriter{w: output},
+		opts:   opts,
+		header: opts.Delta.header(),
+	}
+	w.m = opts.Delta.newMatch(nil, litBuff)
+
+	dr, err := NewDeltaReader(pr)
+	for err == nil {
+		var op DeltaOp
+		op, err = dr.Next()
+		if err == nil {
+			err = w.add(op)
+		}
+	}
+	pr.CloseWithError(err)
+	if deltaErr := <-done; deltaErr != nil {
+		return deltaErr
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	err = w.end()
+	if err != nil {
+		return err
+	}
+	if opts.Delta.Stats != nil {
+		*opts.Delta.Stats = w.m.stats
+	}
+	return w.writeIndex()
+}
+
+// segmentWriter splits the commands of a delta in segments.
+type segmentWriter struct {
+	output *countingWriter
+	opts   SegmentedOptions
+	header deltaHeader
+	m      match
+
+	// Segments written, and the one being written, if started.
+	segments []Segment
+	current  *Segment
+
+	// Output of the current segment, and its hash.
+	out  *countingWriter
+	hash hash.Hash
+}
+
+// add appends op to the segments, splitting it at their boundaries.
+func (w *segmentWriter) add(op DeltaOp) error {
+	for op.Len > 0 {
+		if w.current == nil {
+			err := w.start()
+			if err != nil {
+				return err
+			}
+		}
+
+		part := op
+		room := uint64(w.opts.SegmentSize - w.current.OutputLength)
+		if part.Len > room {
+			part.Len = room
+		}
+
+		var err error
+		switch op.Kind {
+		case KIND_LITERAL:
+			err = w.literal(op.Data[:part.Len])
+			op.Data = op.Data[part.Len:]
+		case KIND_COPY:
+			err = w.m.add(MATCH_KIND_COPY, op.Pos, part.Len)
+			op.Pos += part.Len
+		case KIND_FILL:
+			err = w.m.add(MATCH_KIND_FILL, uint64(op.Value), part.Len)
+		default:
+			err = fmt.Errorf("unexpected command %x", op.Kind)
+		}
+		if err != nil {
+			return err
+		}
+		op.Len -= part.Len
+
+		w.current.OutputLength += int64(part.Len)
+		if w.current.OutputLength == w.opts.SegmentSize {
+			err = w.end()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// literal encodes data as literal commands.
+func (w *segmentWriter) literal(data []byte) error {
+	err := w.m.flush()
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		size := cap(w.m.lit)
+		if size > len(data) {
+			size = len(data)
+		}
+		w.m.lit = append(w.m.lit[:0], data[:size]...)
+		w.m.kind = MATCH_KIND_LITERAL
+		w.m.len = uint64(size)
+		err = w.m.flush()
+		if err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// start begins a new segment.
+func (w *segmentWriter) start() error {
+	var outputOffset int64
+	if n := len(w.segments); n > 0 {
+		outputOffset = w.segments[n-1].OutputOffset + w.segments[n-1].OutputLength
+	}
+	w.current = &Segment{OutputOffset: outputOffset, Offset: w.output.n}
+
+	w.hash = sha256.New()
+	w.out = &countingWriter{w: io.MultiWriter(w.output, w.hash)}
+	w.m.output = w.out
+	return writeDeltaHeader(w.out, w.header)
+}
+
+// end completes the current segment, if any.
+func (w *segmentWriter) end() error {
+	if w.current == nil {
+		return nil
+	}
+	err := w.m.flush()
+	if err == nil {
+		err = binary.Write(w.out, binary.BigEndian, OP_END)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.current.Length = w.out.n
+	w.hash.Sum(w.current.Checksum[:0])
+	w.segments = append(w.segments, *w.current)
+	w.current = nil
+	return nil
+}
+
+// writeIndex writes the index of the segments and the trailer.
+func (w *segmentWriter) writeIndex() error {
+	indexOffset := w.output.n
+	buf := &bytes.Buffer{}
+	for _, s := range w.segments {
+		for _, v := range []interface{}{s.OutputOffset, s.OutputLength, s.Offset, s.Length, s.Checksum} {
+			binary.Write(buf, binary.BigEndian, v)
+		}
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	for _, v := range []interface{}{sum, indexOffset, uint32(len(w.segments)), SEGMENTED_DELTA_MAGIC} {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	_, err := w.output.Write(buf.Bytes())
+	return err
+}
+
+// ReadSegmentIndex reads the index of the segmented delta of the given size
+// in r.
+func ReadSegmentIndex(r io.ReaderAt, size int64) (*SegmentIndex, error) {
+	if size < segmentTrailerSize {
+		return nil, errors.New("not a segmented delta")
+	}
+	trailer := make([]byte, segmentTrailerSize)
+	_, err := r.ReadAt(trailer, size-segmentTrailerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var sum [sha256.Size]byte
+	var indexOffset int64
+	var count uint32
+	var magic MagicNumber
+	tr := bytes.NewReader(trailer)
+	for _, v := range []interface{}{&sum, &indexOffset, &count, &magic} {
+		binary.Read(tr, binary.BigEndian, v)
+	}
+	if magic != SEGMENTED_DELTA_MAGIC {
+		return nil, errors.New("not a segmented delta")
+	}
+	if indexOffset < 0 || indexOffset+int64(count)*segmentEntrySize != size-segmentTrailerSize {
+		return nil, errors.New("invalid segment index")
+	}
+
+	index := make([]byte, int64(count)*segmentEntrySize)
+	_, err = r.ReadAt(index, indexOffset)
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(index) != sum {
+		return nil, fmt.Errorf("segment index: %w", ErrSegmentChecksum)
+	}
+
+	idx := &SegmentIndex{Segments: make([]Segment, count)}
+	ir := bytes.NewReader(index)
+	for i := range idx.Segments {
+		s := &idx.Segments[i]
+		for _, v := range []interface{}{&s.OutputOffset, &s.OutputLength, &s.Offset, &s.Length, &s.Checksum} {
+			binary.Read(ir, binary.BigEndian, v)
+		}
+		if s.OutputOffset != idx.Size || s.OutputLength <= 0 || s.Offset < 0 || s.Length <= 0 ||
+			s.Offset+s.Length > indexOffset {
+			return nil, errors.New("invalid segment index")
+		}
+		idx.Size += s.OutputLength
+	}
+	return idx, nil
+}
+
+// Find returns the indices of the segments writing any of the n bytes of the
+// output at off.
+func (idx *SegmentIndex) Find(off, n int64) []int {
+	first := sort.Search(len(idx.Segments), func(i int) bool {
+		s := idx.Segments[i]
+		return s.OutputOffset+s.OutputLength > off
+	})
+	var found []int
+	for i := first; i < len(idx.Segments) && idx.Segments[i].OutputOffset < off+n; i++ {
+		found = append(found, i)
+	}
+	return found
+}
+
+// Read reads the segment from the segmented delta in r, and checks it.
+func (s Segment) Read(r io.ReaderAt) ([]byte, error) {
+	data := make([]byte, s.Length)
+	_, err := r.ReadAt(data, s.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return data, s.Verify(data)
+}
+
+// Verify checks that data is the segment, returning ErrSegmentChecksum if
+// not.
+func (s Segment) Verify(data []byte) error {
+	if int64(len(data)) != s.Length || sha256.Sum256(data) != s.Checksum {
+		return ErrSegmentChecksum
+	}
+	return nil
+}
+
+// PatchSegment checks the segment data and applies it to base, writing its
+// range of the output to out.
+func PatchSegment(base io.ReaderAt, s Segment, data []byte, out io.WriterAt) error {
+	err := s.Verify(data)
+	if err != nil {
+		return err
+	}
+
+	w := &segmentOutput{w: out, off: s.OutputOffset, end: s.OutputOffset + s.OutputLength}
+	err = PatchFromSource(NewReaderAtSource(base), bytes.NewReader(data), w, PatchOptions{})
+	if err != nil {
+		return err
+	}
+	if w.off != w.end {
+		return fmt.Errorf("segment wrote %d bytes instead of %d", w.off-s.OutputOffset, s.OutputLength)
+	}
+	return nil
+}
+
+// segmentOutput writes the output of a segment to w, from off to end.
+type segmentOutput struct {
+	w        io.WriterAt
+	off, end int64
+}
+
+func (o *segmentOutput) Write(p []byte) (int, error) {
+	if int64(len(p)) > o.end-o.off {
+		return 0, errors.New("segment writes past its range")
+	}
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// SegmentErrors maps the indices of the segments which failed to apply to
+// their errors.
+type SegmentErrors map[int]error
+
+func (e SegmentErrors) Error() string {
+	failed := make([]int, 0, len(e))
+	for i := range e {
+		failed = append(failed, i)
+	}
+	sort.Ints(failed)
+	return fmt.Sprintf("%d segments failed, segment %d: %v", len(e), failed[0], e[failed[0]])
+}
+
+// PatchSegmented applies the given segments of the segmented delta in delta,
+// described by idx, or all of them if segments is nil. Segments are applied by
+// up to the given number of workers, or GOMAXPROCS if zero or less.
+//
+// All the segments are attempted. If some fail, for example because they
+// were corrupted in transit, SegmentErrors tells which ones, so that they can
+// be fetched and applied again.
+func PatchSegmented(base io.ReaderAt, delta io.ReaderAt, idx *SegmentIndex, out io.WriterAt, segments []int,
+	workers int) error {
+	if segments == nil {
+		segments = make([]int, len(idx.Segments))
+		for i := range segments {
+			segments[i] = i
+		}
+	}
+	for _, i := range segments {
+		if i < 0 || i >= len(idx.Segments) {
+			return fmt.Errorf("no segment %d", i)
+		}
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	jobs := make(chan int)
+	errs := SegmentErrors{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				err := patchSegmentAt(base, delta, idx.Segments[i], out)
+				if err != nil {
+					mu.Lock()
+					errs[i] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, i := range segments {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func patchSegmentAt(base io.ReaderAt, delta io.ReaderAt, s Segment, out io.WriterAt) error {
+	data, err := s.Read(delta)
+	if err != nil {
+		return err
+	}
+	return PatchSegment(base, s, data, out)
+}
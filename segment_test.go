@@ -0,0 +1,140 @@
+package librsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func segmentedDelta(t *testing.T, old, new []byte, opts SegmentedOptions) ([]byte, *SegmentIndex) {
+	delta := &bytes.Buffer{}
+	require.NoError(t, SegmentedDelta(signature(t, bytes.NewReader(old)), bytes.NewReader(new), delta, opts))
+	idx, err := ReadSegmentIndex(bytes.NewReader(delta.Bytes()), int64(delta.Len()))
+	require.NoError(t, err)
+	return delta.Bytes(), idx
+}
+
+func TestSegmentedDelta(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, _ := makeImage(t, 4*1024*1024, DeltaOptions{})
+	optionSets := map[string]SegmentedOptions{
+		"default": {},
+		"small":   {SegmentSize: 300 * 1000, Delta: DeltaOptions{Fill: true, LiteralCodec: &FlateCodec{}}},
+	}
+
+	for name, opts := range optionSets {
+		t.Run(name, func(t *testing.T) {
+			delta, idx := segmentedDelta(t, old, new, opts)
+			a.Equal(int64(len(new)), idx.Size)
+			if opts.SegmentSize != 0 {
+				a.Len(idx.Segments, (len(new)+int(opts.SegmentSize)-1)/int(opts.SegmentSize))
+			}
+
+			out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+			r.NoError(err)
+			defer out.Close()
+			r.NoError(PatchSegmented(bytes.NewReader(old), bytes.NewReader(delta), idx, out, nil, 3))
+			got, err := ioutil.ReadFile(out.Name())
+			r.NoError(err)
+			a.True(bytes.Equal(new, got))
+
+			// Each segment is a delta on its own.
+			for _, s := range idx.Segments {
+				buf := &bytes.Buffer{}
+				r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta[s.Offset:s.Offset+s.Length]), buf))
+				a.True(bytes.Equal(new[s.OutputOffset:s.OutputOffset+s.OutputLength], buf.Bytes()))
+			}
+		})
+	}
+}
+
+func TestSegmentedDeltaEmpty(t *testing.T) {
+	r := require.New(t)
+
+	delta, idx := segmentedDelta(t, []byte("old"), nil, SegmentedOptions{})
+	r.Zero(idx.Size)
+	r.Empty(idx.Segments)
+	r.NoError(PatchSegmented(bytes.NewReader(nil), bytes.NewReader(delta), idx, newMemFile(nil), nil, 0))
+}
+
+func TestPatchSegmentedPartial(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, _ := makeImage(t, 4*1024*1024, DeltaOptions{})
+	delta, idx := segmentedDelta(t, old, new, SegmentedOptions{SegmentSize: 1024 * 1024})
+
+	// Only the segments covering a range are applied.
+	segments := idx.Find(1500*1000, 1000*1000)
+	r.Equal([]int{1, 2}, segments)
+	f := newMemFile(nil)
+	r.NoError(PatchSegmented(bytes.NewReader(old), bytes.NewReader(delta), idx, f, segments, 0))
+	a.True(bytes.Equal(new[1024*1024:3*1024*1024], f.data[1024*1024:]))
+	a.Equal(make([]byte, 1024*1024), f.data[:1024*1024])
+
+	a.Equal([]int{0}, idx.Find(0, 1))
+	a.Equal([]int{3}, idx.Find(int64(len(new))-1, 100))
+	a.Empty(idx.Find(int64(len(new)), 100))
+}
+
+func TestPatchSegmentedRetry(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, _ := makeImage(t, 4*1024*1024, DeltaOptions{})
+	delta, idx := segmentedDelta(t, old, new, SegmentedOptions{SegmentSize: 1024 * 1024})
+
+	// Two segments are corrupted in transit.
+	corrupted := append([]byte{}, delta...)
+	corrupted[idx.Segments[1].Offset+10] ^= 1
+	corrupted[idx.Segments[3].Offset+idx.Segments[3].Length-1] ^= 1
+
+	f := newMemFile(nil)
+	err := PatchSegmented(bytes.NewReader(old), bytes.NewReader(corrupted), idx, f, nil, 0)
+	r.Error(err)
+	errs, ok := err.(SegmentErrors)
+	r.True(ok)
+	r.Len(errs, 2)
+	r.Equal(ErrSegmentChecksum, errs[1])
+	r.Equal(ErrSegmentChecksum, errs[3])
+
+	// Only they are fetched and applied again.
+	for i := range errs {
+		s := idx.Segments[i]
+		data, err := s.Read(bytes.NewReader(delta))
+		r.NoError(err)
+		r.NoError(PatchSegment(bytes.NewReader(old), s, data, f))
+	}
+	a.True(bytes.Equal(new, f.data))
+}
+
+func TestReadSegmentIndexErrors(t *testing.T) {
+	r := require.New(t)
+
+	old, new, _ := makeImage(t, 1024*1024, DeltaOptions{})
+	delta, _ := segmentedDelta(t, old, new, SegmentedOptions{SegmentSize: 256 * 1024})
+
+	// Not a segmented delta.
+	plain := &bytes.Buffer{}
+	r.NoError(Delta(signature(t, bytes.NewReader(old)), bytes.NewReader(new), plain))
+	_, err := ReadSegmentIndex(bytes.NewReader(plain.Bytes()), int64(plain.Len()))
+	r.Error(err)
+
+	// The index is corrupted.
+	corrupted := append([]byte{}, delta...)
+	corrupted[len(corrupted)-segmentTrailerSize-1] ^= 1
+	_, err = ReadSegmentIndex(bytes.NewReader(corrupted), int64(len(corrupted)))
+	r.ErrorIs(err, ErrSegmentChecksum)
+
+	// Target copies would make segments depend on each other.
+	err = SegmentedDelta(signature(t, bytes.NewReader(old)), bytes.NewReader(new), &bytes.Buffer{},
+		SegmentedOptions{Delta: DeltaOptions{TargetCopies: true}})
+	r.Error(err)
+}
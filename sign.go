@@ -0,0 +1,332 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// A delta or signature stream signed with ed25519. The magic number is
+	// followed by a uint8 length and the ID of the signing key, the stream
+	// itself, and the 64 bytes of the ed25519 signature, which covers both
+	// the key ID and the stream. Only supported by librsync-go.
+	SIGNED_MAGIC MagicNumber = 0x72730260
+
+	// A detached ed25519 signature of a delta or signature stream. The magic
+	// number is followed by a uint8 length and the ID of the signing key, and
+	// the 64 bytes of the ed25519 signature. Only supported by librsync-go.
+	DETACHED_SIGNATURE_MAGIC MagicNumber = 0x72730261
+)
+
+// Prefix of the data hashed to sign streams, so that the signatures can't be
+// mistaken for signatures of something else made with the same key.
+const signedStreamContext = "librsync-go signed stream\x00"
+
+// ErrBadStreamSignature is returned when the ed25519 signature of a delta or
+// signature stream doesn't match the stream.
+var ErrBadStreamSignature = errors.New("invalid stream signature")
+
+// Signer signs delta and signature streams.
+type Signer interface {
+	// KeyID identifies the key in signed streams, so that they can be
+	// verified with the right public key. It must not be longer than 255
+	// bytes.
+	KeyID() string
+
+	// Sign returns the ed25519 signature of digest.
+	Sign(digest []byte) ([]byte, error)
+}
+
+// Verifier checks the signatures of delta and signature streams, usually
+// against a set of trusted public keys.
+type Verifier interface {
+	// Verify returns nil if sig is a valid ed25519 signature of digest by
+	// the key identified by keyID.
+	Verify(keyID string, digest, sig []byte) error
+}
+
+// Ed25519Signer is a Signer using an ed25519 private key. The key ID is
+// derived from the public key by Ed25519KeyID.
+type Ed25519Signer struct {
+	Key ed25519.PrivateKey
+}
+
+func (s Ed25519Signer) KeyID() string {
+	return Ed25519KeyID(s.Key.Public().(ed25519.PublicKey))
+}
+
+func (s Ed25519Signer) Sign(digest []byte) ([]byte, error) {
+	return ed25519.Sign(s.Key, digest), nil
+}
+
+// Ed25519PublicKeys is a Verifier trusting a set of ed25519 public keys,
+// indexed by their ID.
+type Ed25519PublicKeys map[string]ed25519.PublicKey
+
+// NewEd25519PublicKeys returns a Verifier trusting keys, with IDs given by
+// Ed25519KeyID.
+func NewEd25519PublicKeys(keys ...ed25519.PublicKey) Ed25519PublicKeys {
+	k := make(Ed25519PublicKeys, len(keys))
+	for _, key := range keys {
+		k[Ed25519KeyID(key)] = key
+	}
+	return k
+}
+
+func (k Ed25519PublicKeys) Verify(keyID string, digest, sig []byte) error {
+	key, ok := k[keyID]
+	if !ok {
+		return fmt.Errorf("stream signed with unknown key %q", keyID)
+	}
+	if !ed25519.Verify(key, digest, sig) {
+		return ErrBadStreamSignature
+	}
+	return nil
+}
+
+// Ed25519KeyID returns the default ID of an ed25519 public key: the first 8
+// bytes of its SHA-256 hash, in hexadecimal.
+func Ed25519KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// newStreamHash returns the hash of a stream whose digest is signed by the
+// key identified by keyID. The key ID is hashed too, so that it can't be
+// changed without invalidating the signature.
+func newStreamHash(keyID string) hash.Hash {
+	h := sha512.New()
+	h.Write([]byte(signedStreamContext))
+	h.Write(append([]byte{byte(len(keyID))}, keyID...))
+	return h
+}
+
+// SignedWriter signs the stream written through it, embedding the signature.
+// The result must be read with VerifyStream, PatchOptions.Verifier or
+// ReadSignatureWithOptions.
+type SignedWriter struct {
+	w      io.Writer
+	signer Signer
+	h      hash.Hash
+}
+
+// NewSignedWriter returns a SignedWriter writing to w, and writes the header
+// of the signed stream.
+func NewSignedWriter(w io.Writer, s Signer) (*SignedWriter, error) {
+	err := writeSignatureHeader(w, SIGNED_MAGIC, s.KeyID())
+	if err != nil {
+		return nil, err
+	}
+	return &SignedWriter{w: w, signer: s, h: newStreamHash(s.KeyID())}, nil
+}
+
+func (sw *SignedWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.h.Write(p[:n])
+	return n, err
+}
+
+// Close writes the signature of the stream. It doesn't close the underlying
+// writer.
+func (sw *SignedWriter) Close() error {
+	sig, err := sw.signer.Sign(sw.h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature size %d", len(sig))
+	}
+	_, err = sw.w.Write(sig)
+	return err
+}
+
+// DetachedSignature returns a detached signature of the stream read from r.
+func DetachedSignature(r io.Reader, s Signer) ([]byte, error) {
+	h := newStreamHash(s.KeyID())
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := s.Sign(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature size %d", len(sig))
+	}
+
+	buf := &bytes.Buffer{}
+	err = writeSignatureHeader(buf, DETACHED_SIGNATURE_MAGIC, s.KeyID())
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(sig)
+	return buf.Bytes(), nil
+}
+
+func writeSignatureHeader(w io.Writer, magic MagicNumber, keyID string) error {
+	if len(keyID) > 255 {
+		return fmt.Errorf("key ID too long: %d bytes", len(keyID))
+	}
+	err := binary.Write(w, binary.BigEndian, magic)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append([]byte{byte(len(keyID))}, keyID...))
+	return err
+}
+
+func readSignatureHeader(r io.Reader, magic MagicNumber) (string, error) {
+	var got MagicNumber
+	err := binary.Read(r, binary.BigEndian, &got)
+	if err != nil {
+		return "", err
+	}
+	if got != magic {
+		return "", fmt.Errorf("Got magic number %x rather than expected value %x", got, magic)
+	}
+
+	var n uint8
+	err = binary.Read(r, binary.BigEndian, &n)
+	if err != nil {
+		return "", err
+	}
+	keyID := make([]byte, n)
+	_, err = io.ReadFull(r, keyID)
+	return string(keyID), err
+}
+
+// VerifyStream checks the signature of the stream read from r, and returns
+// the stream. If detached is nil, the stream must have been signed with a
+// SignedWriter, otherwise detached is its detached signature.
+//
+// The stream is stored in a temporary file until it is verified, so that no
+// data is returned before. The file is removed when the result is closed.
+func VerifyStream(r io.Reader, v Verifier, detached []byte) (io.ReadCloser, error) {
+	var keyID string
+	var sig []byte
+	var err error
+	if detached != nil {
+		keyID, sig, err = parseDetachedSignature(detached)
+	} else {
+		keyID, err = readSignatureHeader(r, SIGNED_MAGIC)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "librsync-verify-")
+	if err != nil {
+		return nil, err
+	}
+	tf := &tempFile{f}
+
+	h := newStreamHash(keyID)
+	w := io.MultiWriter(f, h)
+	if detached != nil {
+		_, err = io.Copy(w, r)
+	} else {
+		// The signature is at the end.
+		t := &tailWriter{w: w, tail: make([]byte, 0, ed25519.SignatureSize)}
+		_, err = io.Copy(t, r)
+		if err == nil && len(t.tail) < ed25519.SignatureSize {
+			err = io.ErrUnexpectedEOF
+		}
+		sig = t.tail
+	}
+	if err == nil {
+		err = v.Verify(keyID, h.Sum(nil), sig)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tf.Close()
+		return nil, err
+	}
+	return tf, nil
+}
+
+// verifiedStream returns r verified by VerifyStream if v is not nil, with a
+// function to call when done with it.
+func verifiedStream(r io.Reader, v Verifier, detached []byte) (io.Reader, func(), error) {
+	if v == nil {
+		if detached != nil {
+			return nil, nil, fmt.Errorf("detached signature given without a Verifier")
+		}
+		return r, func() {}, nil
+	}
+
+	verified, err := VerifyStream(r, v, detached)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bufio.NewReader(verified), func() { verified.Close() }, nil
+}
+
+func parseDetachedSignature(detached []byte) (string, []byte, error) {
+	r := bytes.NewReader(detached)
+	keyID, err := readSignatureHeader(r, DETACHED_SIGNATURE_MAGIC)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid detached signature: %w", err)
+	}
+	if r.Len() != ed25519.SignatureSize {
+		return "", nil, fmt.Errorf("invalid detached signature size")
+	}
+	return keyID, detached[len(detached)-ed25519.SignatureSize:], nil
+}
+
+// tailWriter writes to w all the data written to it, but the last cap(tail)
+// bytes, which are kept in tail.
+type tailWriter struct {
+	w    io.Writer
+	tail []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	keep := cap(t.tail)
+	if len(p) >= keep {
+		// Everything in tail, and the start of p, are not the tail anymore.
+		_, err := t.w.Write(t.tail)
+		if err != nil {
+			return 0, err
+		}
+		_, err = t.w.Write(p[:len(p)-keep])
+		if err != nil {
+			return 0, err
+		}
+		t.tail = append(t.tail[:0], p[len(p)-keep:]...)
+		return len(p), nil
+	}
+
+	if over := len(t.tail) + len(p) - keep; over > 0 {
+		_, err := t.w.Write(t.tail[:over])
+		if err != nil {
+			return 0, err
+		}
+		t.tail = t.tail[:copy(t.tail, t.tail[over:])]
+	}
+	t.tail = append(t.tail, p...)
+	return len(p), nil
+}
+
+// tempFile is a temporary file removed when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	removeTemp(f.File)
+	return nil
+}
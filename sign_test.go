@@ -0,0 +1,199 @@
+package librsync
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	mrand "math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedDeltaFixture() (old, new []byte) {
+	rnd := mrand.New(mrand.NewSource(1))
+	old = make([]byte, 64*1024)
+	rnd.Read(old)
+	new = append([]byte("prefix"), old...)
+	new[30000] ^= 0xff
+	return old, new
+}
+
+func generateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return pub, priv
+}
+
+func TestSignedDelta(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	pub, priv := generateKey(t)
+	otherPub, _ := generateKey(t)
+	old, new := signedDeltaFixture()
+
+	sig, err := Signature(bytes.NewReader(old), &bytes.Buffer{}, 512, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+
+	delta := &bytes.Buffer{}
+	sw, err := NewSignedWriter(delta, Ed25519Signer{priv})
+	r.NoError(err)
+	r.NoError(Delta(sig, bytes.NewReader(new), sw))
+	r.NoError(sw.Close())
+
+	output := &bytes.Buffer{}
+	opts := PatchOptions{Verifier: NewEd25519PublicKeys(otherPub, pub)}
+	r.NoError(PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output, opts))
+	a.Equal(new, output.Bytes())
+
+	// Signed deltas can't be applied without checking them.
+	err = Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), &bytes.Buffer{})
+	a.EqualError(err, "signed delta, must be applied with a Verifier")
+
+	// Nothing is written if the delta was tampered with.
+	for _, pos := range []int{30, delta.Len() / 2, delta.Len() - 1} {
+		tampered := append([]byte{}, delta.Bytes()...)
+		tampered[pos] ^= 1
+		output.Reset()
+		err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(tampered), output, opts)
+		a.Equal(ErrBadStreamSignature, err)
+		a.Zero(output.Len())
+	}
+
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()[:delta.Len()-100]), output, opts)
+	a.Equal(ErrBadStreamSignature, err)
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()[:20]), output, opts)
+	a.Error(err)
+
+	// Unknown keys are rejected.
+	opts.Verifier = NewEd25519PublicKeys(otherPub)
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output, opts)
+	a.EqualError(err, "stream signed with unknown key \""+Ed25519KeyID(pub)+"\"")
+
+	// The key ID is signed too, even if the other ID names the same key.
+	alias := "0123456789abcdef"
+	opts.Verifier = Ed25519PublicKeys{Ed25519KeyID(pub): pub, alias: pub}
+	tampered := append([]byte{}, delta.Bytes()...)
+	copy(tampered[5:], alias)
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(tampered), output, opts)
+	a.Equal(ErrBadStreamSignature, err)
+}
+
+func TestDetachedSignature(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	pub, priv := generateKey(t)
+	old, new := signedDeltaFixture()
+
+	sig, err := Signature(bytes.NewReader(old), &bytes.Buffer{}, 512, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+	delta := &bytes.Buffer{}
+	r.NoError(Delta(sig, bytes.NewReader(new), delta))
+
+	detached, err := DetachedSignature(bytes.NewReader(delta.Bytes()), Ed25519Signer{priv})
+	r.NoError(err)
+
+	output := &bytes.Buffer{}
+	opts := PatchOptions{Verifier: NewEd25519PublicKeys(pub), DetachedSignature: detached}
+	r.NoError(PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output, opts))
+	a.Equal(new, output.Bytes())
+
+	tampered := append([]byte{}, delta.Bytes()...)
+	tampered[len(tampered)/2] ^= 1
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(tampered), &bytes.Buffer{}, opts)
+	a.Equal(ErrBadStreamSignature, err)
+
+	opts.DetachedSignature = detached[:len(detached)-1]
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), &bytes.Buffer{}, opts)
+	a.Error(err)
+
+	err = PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), &bytes.Buffer{}, PatchOptions{DetachedSignature: detached})
+	a.Error(err)
+}
+
+func TestSignedSignature(t *testing.T) {
+	r := require.New(t)
+
+	pub, priv := generateKey(t)
+	old, _ := signedDeltaFixture()
+
+	plain := &bytes.Buffer{}
+	sig, err := Signature(bytes.NewReader(old), plain, 512, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+
+	signed := &bytes.Buffer{}
+	sw, err := NewSignedWriter(signed, Ed25519Signer{priv})
+	r.NoError(err)
+	_, err = sw.Write(plain.Bytes())
+	r.NoError(err)
+	r.NoError(sw.Close())
+
+	verifier := NewEd25519PublicKeys(pub)
+	readSig, err := ReadSignatureWithOptions(bytes.NewReader(signed.Bytes()), ReadSignatureOptions{Verifier: verifier})
+	r.NoError(err)
+	r.Equal(sig, readSig)
+
+	_, err = ReadSignature(bytes.NewReader(signed.Bytes()))
+	r.Error(err)
+
+	detached, err := DetachedSignature(bytes.NewReader(plain.Bytes()), Ed25519Signer{priv})
+	r.NoError(err)
+	opts := ReadSignatureOptions{Verifier: verifier, DetachedSignature: detached}
+	readSig, err = ReadSignatureWithOptions(bytes.NewReader(plain.Bytes()), opts)
+	r.NoError(err)
+	r.Equal(sig, readSig)
+
+	tampered := append([]byte{}, plain.Bytes()...)
+	tampered[100] ^= 1
+	_, err = ReadSignatureWithOptions(bytes.NewReader(tampered), opts)
+	r.Equal(ErrBadStreamSignature, err)
+}
+
+func TestTailWriter(t *testing.T) {
+	r := require.New(t)
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	rnd := mrand.New(mrand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		size := rnd.Intn(len(data))
+		head := &bytes.Buffer{}
+		tw := &tailWriter{w: head, tail: make([]byte, 0, 64)}
+		for rest := data[:size]; len(rest) > 0; {
+			n := rnd.Intn(200) + 1
+			if n > len(rest) {
+				n = len(rest)
+			}
+			tw.Write(rest[:n])
+			rest = rest[n:]
+		}
+
+		split := size - 64
+		if split < 0 {
+			split = 0
+		}
+		r.Equal(data[:split], append([]byte{}, head.Bytes()...))
+		r.Equal(data[split:size], append([]byte{}, tw.tail...))
+	}
+
+	// VerifyStream doesn't leave its temporary file behind.
+	pub, priv := generateKey(t)
+	signed := &bytes.Buffer{}
+	sw, err := NewSignedWriter(signed, Ed25519Signer{priv})
+	r.NoError(err)
+	sw.Write(data)
+	r.NoError(sw.Close())
+	verified, err := VerifyStream(signed, NewEd25519PublicKeys(pub), nil)
+	r.NoError(err)
+	got, err := ioutil.ReadAll(verified)
+	r.NoError(err)
+	r.Equal(data, got)
+	name := verified.(*tempFile).Name()
+	r.NoError(verified.Close())
+	r.NoFileExists(name)
+}
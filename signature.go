@@ -2,6 +2,7 @@ package librsync
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -21,6 +22,30 @@ type SignatureType struct {
 	StrongLen  uint32
 	StrongSigs [][]byte
 	Weak2block map[uint32]int
+
+	// Serialized sums of the blocks, the weak sum followed by the strong
+	// sum, if they are referenced from there rather than from StrongSigs, as
+	// with ReadSignatureMapped.
+	sums []byte
+}
+
+// StrongSum returns the strong sum of block i.
+func (s *SignatureType) StrongSum(i int) []byte {
+	if s.sums == nil {
+		return s.StrongSigs[i]
+	}
+	entryLen := 4 + int(s.StrongLen)
+	start := i*entryLen + 4
+	// The capacity is limited so that appending doesn't write to the sums.
+	return s.sums[start : start+int(s.StrongLen) : start+int(s.StrongLen)]
+}
+
+// NumBlocks returns the number of blocks in the signature.
+func (s *SignatureType) NumBlocks() int {
+	if s.sums == nil {
+		return len(s.StrongSigs)
+	}
+	return len(s.sums) / (4 + int(s.StrongLen))
 }
 
 func CalcStrongSum(data []byte, sigType MagicNumber, strongLen uint32) ([]byte, error) {
@@ -36,23 +61,53 @@ func CalcStrongSum(data []byte, sigType MagicNumber, strongLen uint32) ([]byte,
 	return nil, fmt.Errorf("Invalid sigType %#x", sigType)
 }
 
-func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
-	var maxStrongLen uint32
-
+// maxStrongLen returns the length of the hash used for the strong sums of
+// signatures of type sigType.
+func maxStrongLen(sigType MagicNumber) (uint32, error) {
 	switch sigType {
 	case BLAKE2_SIG_MAGIC:
-		maxStrongLen = BLAKE2_SUM_LENGTH
+		return BLAKE2_SUM_LENGTH, nil
 	case MD4_SIG_MAGIC:
-		maxStrongLen = MD4_SUM_LENGTH
-	default:
-		return nil, fmt.Errorf("invalid sigType %#x", sigType)
+		return MD4_SUM_LENGTH, nil
+	}
+	return 0, fmt.Errorf("invalid sigType %#x", sigType)
+}
+
+// ErrInvalidSignature is returned by CheckSignature for signatures which
+// can't be used to compute deltas.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// CheckSignature checks that sig can be used to compute deltas: its type must
+// be known, its strong sums no longer than its hash, and its block length
+// between 1 and maxBlockLen, unless maxBlockLen is 0.
+//
+// Signatures received from untrusted peers must be checked, as invalid ones
+// make computing deltas panic, and large blocks make it allocate as much
+// memory.
+func CheckSignature(sig *SignatureType, maxBlockLen uint32) error {
+	maxLen, err := maxStrongLen(sig.SigType)
+	if err != nil {
+		return fmt.Errorf("%w: unknown type %#x", ErrInvalidSignature, uint32(sig.SigType))
+	}
+	if sig.StrongLen > maxLen {
+		return fmt.Errorf("%w: strong sum length %d is above %d", ErrInvalidSignature, sig.StrongLen, maxLen)
 	}
+	if sig.BlockLen == 0 || (maxBlockLen > 0 && sig.BlockLen > maxBlockLen) {
+		return fmt.Errorf("%w: block length %d", ErrInvalidSignature, sig.BlockLen)
+	}
+	return nil
+}
 
-	if strongLen > maxStrongLen {
+func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
+	maxLen, err := maxStrongLen(sigType)
+	if err != nil {
+		return nil, err
+	}
+	if strongLen > maxLen {
 		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", strongLen, sigType)
 	}
 
-	err := binary.Write(output, binary.BigEndian, sigType)
+	err = binary.Write(output, binary.BigEndian, sigType)
 	if err != nil {
 		return nil, err
 	}
@@ -65,16 +120,58 @@ func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, si
 		return nil, err
 	}
 
-	block := make([]byte, blockLen)
+	ret := &SignatureType{
+		SigType:    sigType,
+		BlockLen:   blockLen,
+		StrongLen:  strongLen,
+		Weak2block: make(map[uint32]int),
+	}
+	err = writeBlockSums(input, output, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
 
-	var ret SignatureType
-	ret.Weak2block = make(map[uint32]int)
-	ret.SigType = sigType
-	ret.StrongLen = strongLen
-	ret.BlockLen = blockLen
+// writeBlockSums writes to output the weak and strong sums of every block of
+// input, adding them to sig.
+//
+// The sums of blocks of zeros are only computed once. If input is a file whose
+// holes can be found, blocks in holes are not even read.
+func writeBlockSums(input io.Reader, output io.Writer, sig *SignatureType) error {
+	block := make([]byte, sig.BlockLen)
+
+	sparse := newSparseInput(input)
+	if sparse != nil {
+		input = sparse
+	}
+	var zeroWeak uint32
+	var zeroStrong []byte
 
 	for {
-		n, err := io.ReadAtLeast(input, block, int(blockLen))
+		var n int
+		var err error
+		if sparse != nil {
+			hole, err := sparse.holeLen()
+			if err != nil {
+				return err
+			}
+			if hole >= int64(sig.BlockLen) {
+				err = sparse.skip(int64(sig.BlockLen))
+				if err != nil {
+					return err
+				}
+				for i := range block {
+					block[i] = 0
+				}
+				n = len(block)
+			}
+		}
+
+		if n == 0 {
+			n, err = io.ReadAtLeast(input, block, int(sig.BlockLen))
+		}
 		if err == io.EOF {
 			// We reached the end of the input, we are done with the signature
 			break
@@ -87,25 +184,48 @@ func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, si
 			// No real error, got data. Leave this `if` and checksum this block
 		} else if err != nil {
 			// Got a real error, report it back to the caller
-			return nil, err
+			return err
 		}
 
 		data := block[:n]
 
-		weak := WeakChecksum(data)
+		var weak uint32
+		var strong []byte
+		if n == len(block) && isZero(data) {
+			if zeroStrong == nil {
+				zeroWeak = WeakChecksum(data)
+				zeroStrong, _ = CalcStrongSum(data, sig.SigType, sig.StrongLen)
+			}
+			weak, strong = zeroWeak, zeroStrong
+		} else {
+			weak = WeakChecksum(data)
+			strong, _ = CalcStrongSum(data, sig.SigType, sig.StrongLen)
+		}
+
 		err = binary.Write(output, binary.BigEndian, weak)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		strong, _ := CalcStrongSum(data, sigType, strongLen)
 		output.Write(strong)
 
-		ret.Weak2block[weak] = len(ret.StrongSigs)
-		ret.StrongSigs = append(ret.StrongSigs, strong)
+		sig.Weak2block[weak] = len(sig.StrongSigs)
+		sig.StrongSigs = append(sig.StrongSigs, strong)
 	}
 
-	return &ret, nil
+	return nil
+}
+
+// ReadSignatureOptions controls how ReadSignatureWithOptions reads a
+// signature. The zero value gives the same behavior as ReadSignature.
+type ReadSignatureOptions struct {
+	// Verifier, if not nil, checks the ed25519 signature of the signature
+	// stream before reading it. The stream must then be signed with a
+	// SignedWriter, unless DetachedSignature is set.
+	Verifier Verifier
+
+	// DetachedSignature is the signature of the stream returned by
+	// DetachedSignature, checked by Verifier.
+	DetachedSignature []byte
 }
 
 // ReadSignature reads a signature from an io.Reader.
@@ -115,6 +235,9 @@ func ReadSignature(r io.Reader) (*SignatureType, error) {
 	if err != nil {
 		return nil, err
 	}
+	if magic == SIGNED_MAGIC {
+		return nil, fmt.Errorf("signed signature, must be read with a Verifier")
+	}
 
 	var blockLen uint32
 	err = binary.Read(r, binary.BigEndian, &blockLen)
@@ -159,6 +282,18 @@ func ReadSignature(r io.Reader) (*SignatureType, error) {
 	}, nil
 }
 
+// ReadSignatureWithOptions is like ReadSignature, but allows to verify the
+// signature stream. See ReadSignatureOptions for details.
+func ReadSignatureWithOptions(r io.Reader, opts ReadSignatureOptions) (*SignatureType, error) {
+	r, closeStream, err := verifiedStream(r, opts.Verifier, opts.DetachedSignature)
+	if err != nil {
+		return nil, err
+	}
+	defer closeStream()
+
+	return ReadSignature(r)
+}
+
 // ReadSignatureFile reads a signature from the file at path.
 func ReadSignatureFile(path string) (*SignatureType, error) {
 	f, err := os.Open(path)
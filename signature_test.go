@@ -66,3 +66,20 @@ func TestSignature(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckSignature(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(CheckSignature(signature(t, bytes.NewReader(nil)), 512))
+	a.NoError(CheckSignature(&SignatureType{SigType: MD4_SIG_MAGIC, BlockLen: 1 << 30, StrongLen: 16}, 0))
+
+	for _, sig := range []*SignatureType{
+		{SigType: BLAKE2_SIG_MAGIC, BlockLen: 0, StrongLen: 32},
+		{SigType: BLAKE2_SIG_MAGIC, BlockLen: 4096, StrongLen: 32},
+		{SigType: BLAKE2_SIG_MAGIC, BlockLen: 2048, StrongLen: 33},
+		{SigType: MD4_SIG_MAGIC, BlockLen: 2048, StrongLen: 17},
+		{SigType: DELTA_MAGIC, BlockLen: 2048, StrongLen: 8},
+	} {
+		a.ErrorIs(CheckSignature(sig, 2048), ErrInvalidSignature, "%+v", sig)
+	}
+}
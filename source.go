@@ -0,0 +1,301 @@
+package librsync
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BlockSource provides the basis data copied by the COPY commands of a delta,
+// see PatchFromSource. Its methods may be called concurrently.
+type BlockSource interface {
+	// ReadAt reads basis data as described by io.ReaderAt.
+	io.ReaderAt
+
+	// Hint tells that the n bytes at off will be read next, possibly in
+	// several ReadAt calls, so that the source can fetch them at once. It is
+	// only advisory.
+	Hint(off, n int64)
+}
+
+// Size of the chunks read from a BlockSource when copying data.
+const sourceChunkSize = 64 * 1024
+
+// NewReadSeekerSource returns a BlockSource reading from rs. Seeking is
+// avoided when reads are contiguous. rs must not be used by anything else
+// while the source is in use. A MappedFile is returned as is, as it needs no
+// seeking.
+func NewReadSeekerSource(rs io.ReadSeeker) BlockSource {
+	if m, ok := rs.(*MappedFile); ok {
+		return m
+	}
+	return &readSeekerSource{rs: rs, pos: -1}
+}
+
+type readSeekerSource struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+
+	// Position of rs, or -1 if unknown.
+	pos int64
+}
+
+func (s *readSeekerSource) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off != s.pos {
+		_, err := s.rs.Seek(off, io.SeekStart)
+		if err != nil {
+			s.pos = -1
+			return 0, err
+		}
+		s.pos = off
+	}
+
+	n, err := io.ReadFull(s.rs, p)
+	s.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *readSeekerSource) Hint(off, n int64) {}
+
+// NewReaderAtSource returns a BlockSource reading from ra.
+func NewReaderAtSource(ra io.ReaderAt) BlockSource {
+	return readerAtSource{ra}
+}
+
+type readerAtSource struct {
+	io.ReaderAt
+}
+
+func (readerAtSource) Hint(off, n int64) {}
+
+// NewCachedSource returns a BlockSource reading src in aligned blocks of
+// blockSize bytes, and keeping the last maxBlocks blocks used in memory.
+// Hints are passed on to src.
+func NewCachedSource(src BlockSource, blockSize, maxBlocks int) BlockSource {
+	if blockSize <= 0 {
+		blockSize = sourceChunkSize
+	}
+	if maxBlocks <= 0 {
+		maxBlocks = 1
+	}
+	return &cachedSource{
+		src:       src,
+		blockSize: int64(blockSize),
+		maxBlocks: maxBlocks,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+type cachedSource struct {
+	src       BlockSource
+	blockSize int64
+	maxBlocks int
+
+	mu     sync.Mutex
+	blocks map[int64]*list.Element
+	// Cached blocks, most recently used first.
+	lru *list.List
+}
+
+type cachedBlock struct {
+	idx  int64
+	data []byte
+}
+
+func (c *cachedSource) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		data, err := c.block(pos / c.blockSize)
+		if err != nil {
+			return read, err
+		}
+
+		start := pos % c.blockSize
+		if start >= int64(len(data)) {
+			return read, io.EOF
+		}
+		read += copy(p[read:], data[start:])
+	}
+	return read, nil
+}
+
+// block returns the data of the block with the given index, which is short
+// only at the end of the source.
+func (c *cachedSource) block(idx int64) ([]byte, error) {
+	if e, ok := c.blocks[idx]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedBlock).data, nil
+	}
+
+	data := make([]byte, c.blockSize)
+	n, err := c.src.ReadAt(data, idx*c.blockSize)
+	if n < len(data) && err != io.EOF {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if c.lru.Len() >= c.maxBlocks {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(*cachedBlock).idx)
+	}
+	c.blocks[idx] = c.lru.PushFront(&cachedBlock{idx: idx, data: data[:n]})
+	return data[:n], nil
+}
+
+func (c *cachedSource) Hint(off, n int64) {
+	c.src.Hint(off, n)
+}
+
+// ErrOutOfWindow is returned by a source created by NewStreamSource when data
+// before its look-back window is read.
+var ErrOutOfWindow = errors.New("basis data before the look-back window")
+
+// NewStreamSource returns a BlockSource reading r sequentially, which needs no
+// seeking, like a pipe. Data is read from r as far as needed, and the last
+// window bytes read are kept in memory to be read again. Reading data before
+// that fails with an error wrapping ErrOutOfWindow.
+//
+// A delta generated with DeltaOptions.OrderedCopies can be applied from such
+// a source with a window of zero. Other deltas need a window large enough for
+// the copies going backwards.
+func NewStreamSource(r io.Reader, window int) BlockSource {
+	if window < 0 {
+		window = 0
+	}
+	return &streamSource{r: r, window: make([]byte, window)}
+}
+
+type streamSource struct {
+	mu sync.Mutex
+	r  io.Reader
+
+	// Number of bytes read from r, and whether it reached its end.
+	pos int64
+	eof bool
+
+	// Last bytes read from r, the byte at offset off being at
+	// window[off%len(window)].
+	window []byte
+}
+
+func (s *streamSource) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := s.pos - int64(len(s.window))
+	if start < 0 {
+		start = 0
+	}
+	if off < start {
+		return 0, fmt.Errorf("%w: reading %d bytes at %d, window starts at %d", ErrOutOfWindow, len(p), off, start)
+	}
+
+	// Skip the data before off.
+	var skip []byte
+	for s.pos < off && !s.eof {
+		size := off - s.pos
+		if size > sourceChunkSize {
+			size = sourceChunkSize
+		}
+		if skip == nil {
+			skip = make([]byte, size)
+		}
+		_, err := s.fill(skip[:size])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos < s.pos {
+			// From the window.
+			i := int(pos % int64(len(s.window)))
+			end := len(s.window)
+			if avail := int(s.pos - pos); end-i > avail {
+				end = i + avail
+			}
+			read += copy(p[read:], s.window[i:end])
+			continue
+		}
+		if s.eof {
+			return read, io.EOF
+		}
+		n, err := s.fill(p[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// fill reads from r into p, keeping the data in the window.
+func (s *streamSource) fill(p []byte) (int, error) {
+	n, err := io.ReadFull(s.r, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		s.eof = true
+		err = nil
+	}
+
+	data := p[:n]
+	if len(data) > len(s.window) {
+		s.pos += int64(len(data) - len(s.window))
+		data = data[len(data)-len(s.window):]
+	}
+	for len(data) > 0 {
+		i := int(s.pos % int64(len(s.window)))
+		c := copy(s.window[i:], data)
+		data = data[c:]
+		s.pos += int64(c)
+	}
+	return n, err
+}
+
+func (s *streamSource) Hint(off, n int64) {}
+
+// copyFromSource writes to out n bytes read at pos in src, using buf.
+func copyFromSource(out io.Writer, src BlockSource, pos, n int64, buf []byte) (int64, error) {
+	src.Hint(pos, n)
+
+	var written int64
+	for written < n {
+		size := int64(len(buf))
+		if size > n-written {
+			size = n - written
+		}
+
+		nr, err := src.ReadAt(buf[:size], pos+written)
+		if nr > 0 {
+			nw, werr := out.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if int64(nr) < size {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
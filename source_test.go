@@ -0,0 +1,258 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingSource counts the reads and hints made to a source.
+type countingSource struct {
+	io.ReaderAt
+	reads, bytes int64
+	hints        int
+}
+
+func (c *countingSource) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.ReaderAt.ReadAt(p, off)
+	c.reads++
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *countingSource) Hint(off, n int64) {
+	c.hints++
+}
+
+// countingSeeker counts the seeks made to a ReadSeeker.
+type countingSeeker struct {
+	io.ReadSeeker
+	seeks int
+}
+
+func (c *countingSeeker) Seek(offset int64, whence int) (int64, error) {
+	c.seeks++
+	return c.ReadSeeker.Seek(offset, whence)
+}
+
+func TestPatchFromSource(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	for _, tt := range allTestCases {
+		t.Run(tt, func(t *testing.T) {
+			file, _, _, _, err := argsFromTestName(tt)
+			r.NoError(err)
+			base, err := ioutil.ReadFile("testdata/" + file + ".old")
+			r.NoError(err)
+			delta, err := ioutil.ReadFile("testdata/" + tt + ".delta")
+			r.NoError(err)
+			want, err := ioutil.ReadFile("testdata/" + file + ".new")
+			r.NoError(err)
+
+			src := &countingSource{ReaderAt: bytes.NewReader(base)}
+			out := &bytes.Buffer{}
+			r.NoError(PatchFromSource(src, bytes.NewReader(delta), out, PatchOptions{}))
+			a.Equal(string(want), out.String())
+
+			// Every copy is hinted and read in as few chunks as possible.
+			a.LessOrEqual(int64(src.hints), src.reads)
+			a.LessOrEqual(src.reads, int64(src.hints)+src.bytes/sourceChunkSize)
+
+			out.Reset()
+			r.NoError(PatchFromSource(NewCachedSource(NewReaderAtSource(bytes.NewReader(base)), 100, 3),
+				bytes.NewReader(delta), out, PatchOptions{}))
+			a.Equal(string(want), out.String())
+		})
+	}
+}
+
+func TestCachedSource(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+	rnd := rand.New(rand.NewSource(1))
+
+	// The new file repeats a part of the basis many times, without target
+	// copies, so the same basis data is copied over and over.
+	base := make([]byte, 256*1024)
+	rnd.Read(base)
+	var data []byte
+	for i := 0; i < 20; i++ {
+		data = append(data, base[8192:49152]...)
+	}
+	sig := signature(t, bytes.NewReader(base))
+	delta := &bytes.Buffer{}
+	r.NoError(DeltaBuff(sig, bytes.NewReader(data), delta, make([]byte, 0, OUTPUT_BUFFER_SIZE)))
+
+	plain := &countingSource{ReaderAt: bytes.NewReader(base)}
+	out := &bytes.Buffer{}
+	r.NoError(PatchFromSource(plain, bytes.NewReader(delta.Bytes()), out, PatchOptions{}))
+	r.Equal(data, out.Bytes())
+	a.Equal(int64(len(data)), plain.bytes)
+
+	// With a cache, each block of the basis is read once.
+	counted := &countingSource{ReaderAt: bytes.NewReader(base)}
+	cached := NewCachedSource(counted, 4096, 16)
+	out.Reset()
+	r.NoError(PatchFromSource(cached, bytes.NewReader(delta.Bytes()), out, PatchOptions{}))
+	r.Equal(data, out.Bytes())
+	a.Equal(int64(10), counted.reads)
+	a.Equal(int64(10*4096), counted.bytes)
+	a.Equal(plain.hints, counted.hints)
+
+	// A cache too small for the repeated data reads it again each time.
+	counted = &countingSource{ReaderAt: bytes.NewReader(base)}
+	out.Reset()
+	r.NoError(PatchFromSource(NewCachedSource(counted, 4096, 4), bytes.NewReader(delta.Bytes()), out, PatchOptions{}))
+	r.Equal(data, out.Bytes())
+	a.Equal(int64(20*10), counted.reads)
+}
+
+func TestCachedSourceReadAt(t *testing.T) {
+	r := require.New(t)
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	counted := &countingSource{ReaderAt: bytes.NewReader(data)}
+	src := NewCachedSource(counted, 64, 4)
+
+	buf := make([]byte, 100)
+	n, err := src.ReadAt(buf, 50)
+	r.NoError(err)
+	r.Equal(100, n)
+	r.Equal(data[50:150], buf)
+	r.Equal(int64(3), counted.reads)
+
+	n, err = src.ReadAt(buf[:10], 60)
+	r.NoError(err)
+	r.Equal(10, n)
+	r.Equal(int64(3), counted.reads)
+
+	// Reads past the end.
+	n, err = src.ReadAt(buf, 950)
+	r.Equal(io.EOF, err)
+	r.Equal(50, n)
+	r.Equal(data[950:], buf[:n])
+	n, err = src.ReadAt(buf, 1000)
+	r.Equal(io.EOF, err)
+	r.Equal(0, n)
+}
+
+func TestReadSeekerSource(t *testing.T) {
+	r := require.New(t)
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	seeker := &countingSeeker{ReadSeeker: bytes.NewReader(data)}
+	src := NewReadSeekerSource(seeker)
+
+	// Contiguous reads seek only once.
+	buf := make([]byte, 100)
+	for off := int64(100); off < 500; off += 100 {
+		n, err := src.ReadAt(buf, off)
+		r.NoError(err)
+		r.Equal(100, n)
+		r.Equal(data[off:off+100], buf)
+	}
+	r.Equal(1, seeker.seeks)
+
+	_, err := src.ReadAt(buf, 0)
+	r.NoError(err)
+	r.Equal(2, seeker.seeks)
+
+	n, err := src.ReadAt(buf, 950)
+	r.Equal(io.EOF, err)
+	r.Equal(50, n)
+}
+
+// readerOnly hides the other methods of an io.Reader.
+type readerOnly struct {
+	r io.Reader
+}
+
+func (r readerOnly) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func TestStreamSource(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	old, new, delta := makeImage(t, 4*1024*1024, DeltaOptions{})
+
+	// With ordered copies, the basis is read sequentially.
+	ordered := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(signature(t, bytes.NewReader(old)), bytes.NewReader(new), ordered,
+		DeltaOptions{OrderedCopies: true}))
+	dr, err := NewDeltaReader(bytes.NewReader(ordered.Bytes()))
+	r.NoError(err)
+	var end uint64
+	for op, err := dr.Next(); err == nil; op, err = dr.Next() {
+		if op.Kind == KIND_COPY {
+			r.GreaterOrEqual(op.Pos, end)
+			end = op.Pos + op.Len
+		}
+	}
+
+	out := &bytes.Buffer{}
+	src := NewStreamSource(readerOnly{bytes.NewReader(old)}, 0)
+	r.NoError(PatchFromSource(src, bytes.NewReader(ordered.Bytes()), out, PatchOptions{}))
+	a.True(bytes.Equal(new, out.Bytes()))
+
+	// Other deltas copy data going backwards, which must be in the window.
+	src = NewStreamSource(readerOnly{bytes.NewReader(old)}, 0)
+	err = PatchFromSource(src, bytes.NewReader(delta), &bytes.Buffer{}, PatchOptions{})
+	r.ErrorIs(err, ErrOutOfWindow)
+
+	out.Reset()
+	src = NewStreamSource(readerOnly{bytes.NewReader(old)}, len(old))
+	r.NoError(PatchFromSource(src, bytes.NewReader(delta), out, PatchOptions{}))
+	a.True(bytes.Equal(new, out.Bytes()))
+}
+
+func TestStreamSourceReadAt(t *testing.T) {
+	r := require.New(t)
+
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	src := NewStreamSource(readerOnly{bytes.NewReader(data)}, 100)
+
+	reads := []struct {
+		off, n int
+		err    error
+	}{
+		{10, 20, nil},
+		{0, 5, nil},
+		{500, 200, nil},
+		{650, 50, nil},
+		{599, 10, ErrOutOfWindow},
+		{600, 120, nil},
+		{990, 20, io.EOF},
+		{1000, 1, io.EOF},
+	}
+	for _, tt := range reads {
+		p := make([]byte, tt.n)
+		n, err := src.ReadAt(p, int64(tt.off))
+		if tt.err == nil {
+			r.NoError(err, "%+v", tt)
+		} else {
+			r.ErrorIs(err, tt.err, "%+v", tt)
+		}
+		if tt.err != ErrOutOfWindow {
+			end := tt.off + tt.n
+			if end > len(data) {
+				end = len(data)
+			}
+			r.Equal(data[tt.off:end], p[:n], "%+v", tt)
+		}
+	}
+}
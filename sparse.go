@@ -0,0 +1,258 @@
+package librsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// Size of the aligned blocks of zeros turned into holes when patching with
+// PatchOptions.Sparse, the usual block size of filesystems.
+const sparseBlockSize = 4096
+
+// errSparseUnsupported is returned when holes can't be found or punched,
+// because of the platform or the filesystem.
+var errSparseUnsupported = errors.New("sparse files not supported")
+
+// sparseInput reads a file knowing where its holes are, so that they can be
+// skipped instead of read.
+type sparseInput struct {
+	f *os.File
+
+	// Current offset of f.
+	pos int64
+
+	// Next hole at or after pos, or after it if holeStart == holeEnd.
+	holeStart, holeEnd int64
+}
+
+// newSparseInput returns a sparseInput reading r, if it is a file whose holes
+// can be found, starting at its current offset.
+func newSparseInput(r io.Reader) *sparseInput {
+	f, ok := r.(*os.File)
+	if !ok {
+		return nil
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	s := &sparseInput{f: f, pos: pos}
+	if s.findHole() != nil {
+		return nil
+	}
+	return s
+}
+
+func (s *sparseInput) Read(p []byte) (int, error) {
+	n, err := s.f.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+// holeLen returns the number of bytes at the current offset which are in a
+// hole.
+func (s *sparseInput) holeLen() (int64, error) {
+	if s.pos >= s.holeEnd {
+		err := s.findHole()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if s.pos < s.holeStart {
+		return 0, nil
+	}
+	return s.holeEnd - s.pos, nil
+}
+
+// findHole finds the next hole at or after the current offset.
+func (s *sparseInput) findHole() error {
+	start, err := nextHole(s.f, s.pos)
+	if err == io.EOF {
+		// Past the end of the file.
+		start = s.pos
+	} else if err != nil {
+		return err
+	}
+	end, err := nextData(s.f, start)
+	if err == io.EOF {
+		end, err = s.f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		return err
+	}
+	s.holeStart, s.holeEnd = start, end
+
+	_, err = s.f.Seek(s.pos, io.SeekStart)
+	return err
+}
+
+// skip moves the current offset n bytes forward.
+func (s *sparseInput) skip(n int64) error {
+	_, err := s.f.Seek(n, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	s.pos += n
+	return nil
+}
+
+// sparseWriter writes to w, leaving holes instead of aligned blocks of zeros.
+// Zeros are held back until the data after them is written, so that holes can
+// be made whatever the size of the writes.
+type sparseWriter struct {
+	w io.WriteSeeker
+
+	// File to punch holes into, if enabled. Otherwise holes are created by
+	// seeking, and w must read as zeros past its end.
+	punch *os.File
+
+	// Current offset of w, and whether the data before it ends with a hole.
+	off  int64
+	hole bool
+
+	// Number of zeros written after off, not yet written to w.
+	pending int64
+}
+
+// newSparseWriter returns a sparseWriter writing to w from its current offset,
+// punching holes if punch is set and w is a file which supports it.
+func newSparseWriter(w io.WriteSeeker, punch bool) (*sparseWriter, error) {
+	off, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	s := &sparseWriter{w: w, off: off}
+	if f, ok := w.(*os.File); ok && punch {
+		s.punch = f
+	}
+	return s, nil
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		// Data is checked up to the next aligned offset.
+		size := int(sparseBlockSize - (s.off+s.pending)%sparseBlockSize)
+		if size > len(p)-written {
+			size = len(p) - written
+		}
+		block := p[written : written+size]
+
+		if isZero(block) {
+			s.pending += int64(size)
+		} else {
+			err := s.flushZeros()
+			if err == nil {
+				_, err = s.write(block)
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// zeros writes n zeros.
+func (s *sparseWriter) zeros(n int64) {
+	s.pending += n
+}
+
+// flushZeros writes the pending zeros, as a hole where possible.
+func (s *sparseWriter) flushZeros() error {
+	n := s.pending
+	s.pending = 0
+
+	// Only whole blocks can be holes.
+	if head := (sparseBlockSize - s.off%sparseBlockSize) % sparseBlockSize; head > 0 {
+		if head > n {
+			head = n
+		}
+		_, err := writeFill(writerFunc(s.write), 0, head)
+		if err != nil {
+			return err
+		}
+		n -= head
+	}
+	holeLen := n - n%sparseBlockSize
+	if holeLen > 0 {
+		err := s.skip(holeLen)
+		if err != nil {
+			return err
+		}
+	}
+	if n > holeLen {
+		_, err := writeFill(writerFunc(s.write), 0, n-holeLen)
+		return err
+	}
+	return nil
+}
+
+// skip leaves a hole of n bytes.
+func (s *sparseWriter) skip(n int64) error {
+	if s.punch != nil {
+		err := punchHole(s.punch, s.off, n)
+		if err == errSparseUnsupported {
+			// Holes can't be punched: write the zeros.
+			s.punch = nil
+			_, err = writeFill(writerFunc(s.write), 0, n)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.w.Seek(n, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	s.off += n
+	s.hole = true
+	return nil
+}
+
+func (s *sparseWriter) write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.off += int64(n)
+	if n > 0 {
+		s.hole = false
+	}
+	return n, err
+}
+
+// flush writes the pending zeros, and makes sure the output extends over a
+// final hole, so that everything written can be read back.
+func (s *sparseWriter) flush() error {
+	err := s.flushZeros()
+	if err != nil || !s.hole {
+		return err
+	}
+	// Seeking doesn't extend the output, so write the last zero of the hole.
+	_, err = s.w.Seek(-1, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write([]byte{0})
+	if err != nil {
+		return err
+	}
+	s.hole = false
+	return nil
+}
+
+// Block of zeros to compare data with.
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// isZero tells if data is all zeros.
+func isZero(data []byte) bool {
+	for len(data) > len(zeroBlock) {
+		if !bytes.Equal(data[:len(zeroBlock)], zeroBlock) {
+			return false
+		}
+		data = data[len(zeroBlock):]
+	}
+	return bytes.Equal(data, zeroBlock[:len(data)])
+}
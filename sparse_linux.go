@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package librsync
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// nextData returns the offset of the first data at or after off in f, or
+// io.EOF if there is only a hole until its end.
+func nextData(f *os.File, off int64) (int64, error) {
+	return seekSparse(f, off, unix.SEEK_DATA)
+}
+
+// nextHole returns the offset of the first hole at or after off in f. The end
+// of the file counts as a hole.
+func nextHole(f *os.File, off int64) (int64, error) {
+	return seekSparse(f, off, unix.SEEK_HOLE)
+}
+
+func seekSparse(f *os.File, off int64, whence int) (int64, error) {
+	pos, err := f.Seek(off, whence)
+	if errors.Is(err, unix.ENXIO) {
+		return 0, io.EOF
+	} else if errors.Is(err, unix.EINVAL) {
+		return 0, errSparseUnsupported
+	}
+	return pos, err
+}
+
+// punchHole deallocates the n bytes of f at off, which then read as zeros,
+// without changing its size.
+func punchHole(f *os.File, off, n int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return errSparseUnsupported
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+package librsync
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the size of the disk space allocated to f.
+func allocatedSize(f *os.File) (int64, bool) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Blocks * 512, true
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package librsync
+
+import "os"
+
+func nextData(f *os.File, off int64) (int64, error) {
+	return 0, errSparseUnsupported
+}
+
+func nextHole(f *os.File, off int64) (int64, error) {
+	return 0, errSparseUnsupported
+}
+
+func punchHole(f *os.File, off, n int64) error {
+	return errSparseUnsupported
+}
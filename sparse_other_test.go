@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package librsync
+
+import "os"
+
+// allocatedSize returns the size of the disk space allocated to f, which isn't
+// known on this platform.
+func allocatedSize(f *os.File) (int64, bool) {
+	return 0, false
+}
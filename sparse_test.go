@@ -0,0 +1,163 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sparseFile creates a file of size bytes which is all holes, but for data
+// written at the given offsets, and returns its content.
+func sparseFile(t *testing.T, size int64, data map[int64][]byte) (*os.File, []byte) {
+	r := require.New(t)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	r.NoError(err)
+	t.Cleanup(func() { f.Close() })
+	r.NoError(f.Truncate(size))
+
+	content := make([]byte, size)
+	for off, d := range data {
+		_, err = f.WriteAt(d, off)
+		r.NoError(err)
+		copy(content[off:], d)
+	}
+	return f, content
+}
+
+func TestIsZero(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(isZero(nil))
+	a.True(isZero(make([]byte, 10)))
+	a.True(isZero(make([]byte, 3*sparseBlockSize+10)))
+	for _, i := range []int{0, 9, sparseBlockSize, 3*sparseBlockSize + 9} {
+		data := make([]byte, 3*sparseBlockSize+10)
+		data[i] = 1
+		a.False(isZero(data), i)
+	}
+}
+
+// TestSignatureSparse checks that the signature of a sparse file, whose holes
+// are skipped, is the same as that of its content.
+func TestSignatureSparse(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	random := make([]byte, 100*1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	f, content := sparseFile(t, 10*1024*1024+123, map[int64][]byte{
+		0:                random[:5000],
+		3*1024*1024 + 7:  random,
+		10 * 1024 * 1024: random[:123],
+	})
+
+	for _, blockLen := range []uint32{512, 2048, 4096, 10000} {
+		want := &bytes.Buffer{}
+		wantSig, err := Signature(bytes.NewReader(content), want, blockLen, 32, BLAKE2_SIG_MAGIC)
+		r.NoError(err)
+
+		_, err = f.Seek(0, io.SeekStart)
+		r.NoError(err)
+		got := &bytes.Buffer{}
+		gotSig, err := Signature(f, got, blockLen, 32, BLAKE2_SIG_MAGIC)
+		r.NoError(err)
+
+		a.Equal(want.Bytes(), got.Bytes(), blockLen)
+		a.Equal(wantSig.Weak2block, gotSig.Weak2block, blockLen)
+	}
+}
+
+// TestPatchSparse checks that patching a sparse image into a file leaves
+// holes, and that PunchHoles makes existing data read as zeros.
+func TestPatchSparse(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	random := make([]byte, 200*1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	_, old := sparseFile(t, 4*1024*1024, map[int64][]byte{
+		1000:            random[:100*1000],
+		2 * 1024 * 1024: random[100*1000:],
+	})
+	new := append([]byte{}, old...)
+	copy(new[500*1000:], random[:10000])
+	copy(new[1024*1024:], make([]byte, 100*1000))
+	new = append(new, make([]byte, 1024*1024)...)
+
+	sig := signature(t, bytes.NewReader(old))
+	delta := &bytes.Buffer{}
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(new), delta, DeltaOptions{Fill: true}))
+
+	patch := func(f *os.File, opts PatchOptions) []byte {
+		_, err := f.Seek(0, io.SeekStart)
+		r.NoError(err)
+		r.NoError(PatchWithOptions(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), f, opts))
+		got, err := ioutil.ReadFile(f.Name())
+		r.NoError(err)
+		return got
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "new"))
+	r.NoError(err)
+	defer f.Close()
+	a.True(bytes.Equal(new, patch(f, PatchOptions{Sparse: true})))
+	if allocated, ok := allocatedSize(f); ok {
+		a.Less(allocated, int64(len(new))/4)
+	}
+
+	// Patching over existing data only gives the right output when holes are
+	// punched in it.
+	garbage, err := os.Create(filepath.Join(t.TempDir(), "garbage"))
+	r.NoError(err)
+	defer garbage.Close()
+	_, err = garbage.Write(bytes.Repeat([]byte{0xff}, len(new)))
+	r.NoError(err)
+	a.False(bytes.Equal(new, patch(garbage, PatchOptions{Sparse: true})))
+	a.True(bytes.Equal(new, patch(garbage, PatchOptions{Sparse: true, PunchHoles: true})))
+
+	// Target copies read back the output, holes included.
+	delta.Reset()
+	r.NoError(DeltaWithOptions(sig, bytes.NewReader(new), delta, DeltaOptions{TargetCopies: true}))
+	r.NoError(f.Truncate(0))
+	a.True(bytes.Equal(new, patch(f, PatchOptions{Sparse: true})))
+}
+
+// TestSparseWriter checks that sparseWriter writes the same data as the one
+// written to it, whatever the alignment of the writes.
+func TestSparseWriter(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	data := make([]byte, 64*sparseBlockSize)
+	rand.New(rand.NewSource(1)).Read(data[:sparseBlockSize+10])
+	rand.New(rand.NewSource(2)).Read(data[20*sparseBlockSize-5 : 20*sparseBlockSize+5])
+
+	for _, chunk := range []int{1000, sparseBlockSize, 3*sparseBlockSize + 1, len(data)} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+		r.NoError(err)
+		w, err := newSparseWriter(f, false)
+		r.NoError(err)
+		for off := 0; off < len(data); off += chunk {
+			end := off + chunk
+			if end > len(data) {
+				end = len(data)
+			}
+			_, err = w.Write(data[off:end])
+			r.NoError(err)
+		}
+		r.NoError(w.flush())
+		r.NoError(f.Close())
+
+		got, err := ioutil.ReadFile(f.Name())
+		r.NoError(err)
+		a.True(bytes.Equal(data, got), chunk)
+	}
+}
@@ -0,0 +1,451 @@
+// Package store keeps the history of a file cheaply, in the style of
+// rdiff-backup.
+//
+// A store is a directory holding a full copy (the mirror) of the newest
+// version of the file, and a reverse delta for each older version, which turns
+// the following version back into it. Adding a version replaces the mirror and
+// stores a delta to the previous one; restoring an older version applies the
+// deltas from the newest version backwards.
+//
+// The index of versions is replaced atomically, so that a store interrupted
+// while adding a version keeps its previous state. A store must not be used
+// by several processes at once.
+package store
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// Version of the index format.
+const FORMAT_VERSION = 1
+
+const (
+	indexName     = "index.json"
+	mirrorPrefix  = "mirror."
+	deltaPrefix   = "delta."
+	tempPrefix    = "tmp."
+	indexTempName = tempPrefix + indexName
+)
+
+var (
+	ErrNotFound  = errors.New("store: version not found")
+	ErrNotAStore = errors.New("store: not a store")
+	ErrCorrupt   = errors.New("store: restored version doesn't match its checksum")
+)
+
+// Version describes a version of the file.
+type Version struct {
+	// ID identifies the version in the store. Newer versions have higher
+	// IDs.
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+
+	// SHA-256 of the version, in hexadecimal.
+	SHA256 string `json:"sha256"`
+}
+
+// Options controls the signatures used to compute the deltas of a store.
+type Options struct {
+	BlockLen  uint32               `json:"block_len"`
+	StrongLen uint32               `json:"strong_len"`
+	SigType   librsync.MagicNumber `json:"sig_type"`
+}
+
+// DefaultOptions are the options used by Create if none are given.
+var DefaultOptions = Options{
+	BlockLen:  2048,
+	StrongLen: 32,
+	SigType:   librsync.BLAKE2_SIG_MAGIC,
+}
+
+type index struct {
+	Format  int     `json:"format"`
+	Options Options `json:"options"`
+
+	// Versions, oldest first.
+	Versions []Version `json:"versions"`
+}
+
+// Store is a versioned store in a directory.
+type Store struct {
+	dir   string
+	index index
+}
+
+// Create creates an empty store in dir, which is created if needed and must
+// not contain a store already. opts may be nil.
+func Create(dir string, opts *Options) (*Store, error) {
+	if opts == nil {
+		opts = &DefaultOptions
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(filepath.Join(dir, indexName))
+	if err == nil {
+		return nil, fmt.Errorf("store: %s already contains a store", dir)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	s := &Store{dir: dir, index: index{Format: FORMAT_VERSION, Options: *opts}}
+	return s, s.writeIndex()
+}
+
+// Open opens the store in dir.
+func Open(dir string) (*Store, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, indexName))
+	if os.IsNotExist(err) {
+		return nil, ErrNotAStore
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir}
+	err = json.Unmarshal(data, &s.index)
+	if err != nil {
+		return nil, fmt.Errorf("store: invalid index: %w", err)
+	}
+	if s.index.Format != FORMAT_VERSION {
+		return nil, fmt.Errorf("store: unsupported format %d", s.index.Format)
+	}
+	return s, nil
+}
+
+// Versions returns the versions in the store, oldest first.
+func (s *Store) Versions() []Version {
+	return append([]Version{}, s.index.Versions...)
+}
+
+// Latest returns the newest version, or false if the store is empty.
+func (s *Store) Latest() (Version, bool) {
+	if len(s.index.Versions) == 0 {
+		return Version{}, false
+	}
+	return s.index.Versions[len(s.index.Versions)-1], true
+}
+
+// Add stores the data read from r as the newest version, created at t.
+func (s *Store) Add(r io.Reader, t time.Time) (Version, error) {
+	latest, hasLatest := s.Latest()
+	v := Version{ID: latest.ID + 1, Time: t}
+
+	mirror, err := s.tempFile()
+	if err != nil {
+		return v, err
+	}
+	defer os.Remove(mirror.Name())
+	defer mirror.Close()
+
+	// Write the new mirror, and its signature to compute the reverse delta.
+	h := sha256.New()
+	counter := &countingWriter{}
+	opts := s.index.Options
+	sig, err := librsync.Signature(io.TeeReader(r, io.MultiWriter(mirror, h, counter)), ioutil.Discard,
+		opts.BlockLen, opts.StrongLen, opts.SigType)
+	if err != nil {
+		return v, err
+	}
+	v.Size = counter.n
+	v.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	err = syncClose(mirror)
+	if err != nil {
+		return v, err
+	}
+
+	if hasLatest {
+		err = s.writeDelta(sig, latest)
+		if err != nil {
+			return v, err
+		}
+	}
+
+	err = s.rename(mirror.Name(), s.path(mirrorPrefix, v.ID))
+	if err != nil {
+		return v, err
+	}
+
+	s.index.Versions = append(s.index.Versions, v)
+	err = s.writeIndex()
+	if err != nil {
+		s.index.Versions = s.index.Versions[:len(s.index.Versions)-1]
+		return v, err
+	}
+
+	if hasLatest {
+		os.Remove(s.path(mirrorPrefix, latest.ID))
+	}
+	return v, nil
+}
+
+// writeDelta writes the reverse delta from the version with signature sig to
+// the previous newest version, stored in its mirror.
+func (s *Store) writeDelta(sig *librsync.SignatureType, prev Version) error {
+	old, err := os.Open(s.path(mirrorPrefix, prev.ID))
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	delta, err := s.tempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(delta.Name())
+	defer delta.Close()
+
+	w := bufio.NewWriter(delta)
+	litBuff := make([]byte, 0, librsync.OUTPUT_BUFFER_SIZE)
+	err = librsync.DeltaBuff(sig, bufio.NewReader(old), w, litBuff)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = syncClose(delta)
+	if err != nil {
+		return err
+	}
+	return s.rename(delta.Name(), s.path(deltaPrefix, prev.ID))
+}
+
+// Restore writes the version with the given ID to w. The data is checked
+// against the checksum of the version as it is written, so ErrCorrupt may be
+// returned after writing all of it.
+func (s *Store) Restore(id uint64, w io.Writer) error {
+	i := s.find(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	basis, err := os.Open(s.path(mirrorPrefix, s.index.Versions[len(s.index.Versions)-1].ID))
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	// Go back through the deltas, from the newest version to the one before
+	// the requested one, in temporary files.
+	var tmp *os.File
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	for j := len(s.index.Versions) - 2; j > i; j-- {
+		next, err := s.tempFile()
+		if err != nil {
+			return err
+		}
+		err = s.patch(basis, s.index.Versions[j].ID, next)
+		if err != nil {
+			next.Close()
+			os.Remove(next.Name())
+			return err
+		}
+
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		tmp, basis = next, next
+	}
+
+	v := s.index.Versions[i]
+	h := sha256.New()
+	out := io.MultiWriter(w, h)
+	if i == len(s.index.Versions)-1 {
+		_, err = io.Copy(out, basis)
+	} else {
+		err = s.patch(basis, v.ID, out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != v.SHA256 {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// patch applies the reverse delta of the version with the given ID to basis,
+// the following version.
+func (s *Store) patch(basis io.ReadSeeker, id uint64, out io.Writer) error {
+	delta, err := os.Open(s.path(deltaPrefix, id))
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+
+	bw := bufio.NewWriter(out)
+	err = librsync.Patch(basis, bufio.NewReader(delta), bw)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Prune removes the versions older than before, except the newest one, and
+// returns them.
+func (s *Store) Prune(before time.Time) ([]Version, error) {
+	n := 0
+	for n < len(s.index.Versions)-1 && s.index.Versions[n].Time.Before(before) {
+		n++
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	// Versions are removed from the index first, so that it never refers to
+	// missing deltas.
+	pruned := append([]Version{}, s.index.Versions[:n]...)
+	versions := s.index.Versions
+	s.index.Versions = versions[n:]
+	err := s.writeIndex()
+	if err != nil {
+		s.index.Versions = versions
+		return nil, err
+	}
+
+	for _, v := range pruned {
+		err = os.Remove(s.path(deltaPrefix, v.ID))
+		if err != nil && !os.IsNotExist(err) {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// Clean removes the files left by interrupted operations.
+func (s *Store) Clean() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{indexName: true}
+	if latest, ok := s.Latest(); ok {
+		known[filepath.Base(s.path(mirrorPrefix, latest.ID))] = true
+	}
+	for i, v := range s.index.Versions {
+		if i < len(s.index.Versions)-1 {
+			known[filepath.Base(s.path(deltaPrefix, v.ID))] = true
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if known[name] || e.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, mirrorPrefix) || strings.HasPrefix(name, deltaPrefix) ||
+			strings.HasPrefix(name, tempPrefix) {
+			err = os.Remove(filepath.Join(s.dir, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) find(id uint64) int {
+	for i, v := range s.index.Versions {
+		if v.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Store) path(prefix string, id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%d", prefix, id))
+}
+
+func (s *Store) tempFile() (*os.File, error) {
+	return ioutil.TempFile(s.dir, tempPrefix)
+}
+
+// writeIndex replaces the index with the current one.
+func (s *Store) writeIndex() error {
+	data, err := json.MarshalIndent(s.index, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, indexTempName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = syncClose(f)
+	if err != nil {
+		return err
+	}
+	return s.rename(path, filepath.Join(s.dir, indexName))
+}
+
+// rename renames a file of the store, and syncs the directory so that the
+// rename isn't lost in a crash.
+func (s *Store) rename(from, to string) error {
+	err := os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// syncClose flushes f to disk and closes it.
+func syncClose(f *os.File) error {
+	err := f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the entries of the directory dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeVersions returns successive versions of a file, each a small change of
+// the previous one.
+func makeVersions(n int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 256*1024)
+	rnd.Read(data)
+
+	versions := [][]byte{data}
+	for i := 1; i < n; i++ {
+		next := append([]byte{}, data...)
+		pos := rnd.Intn(len(next))
+		insert := make([]byte, rnd.Intn(5000))
+		rnd.Read(insert)
+		next = append(next[:pos], append(insert, next[pos:]...)...)
+		if i%3 == 0 {
+			next = next[:len(next)-10000]
+		}
+		versions = append(versions, next)
+		data = next
+	}
+	return versions
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestStore(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dir := t.TempDir()
+	s, err := Create(dir, nil)
+	r.NoError(err)
+	_, ok := s.Latest()
+	a.False(ok)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := makeVersions(6)
+	for i, data := range versions {
+		v, err := s.Add(bytes.NewReader(data), start.Add(time.Duration(i)*time.Hour))
+		r.NoError(err)
+		a.Equal(uint64(i+1), v.ID)
+		a.Equal(int64(len(data)), v.Size)
+	}
+
+	// Only the newest version is stored in full.
+	a.Equal([]string{"delta.1", "delta.2", "delta.3", "delta.4", "delta.5", "index.json", "mirror.6"}, listFiles(t, dir))
+	var deltaSize int64
+	for i := 1; i <= 5; i++ {
+		info, err := os.Stat(filepath.Join(dir, "delta."+string(rune('0'+i))))
+		r.NoError(err)
+		deltaSize += info.Size()
+	}
+	a.Less(deltaSize, int64(len(versions[0])/2))
+
+	s, err = Open(dir)
+	r.NoError(err)
+	listed := s.Versions()
+	r.Len(listed, len(versions))
+	for i, v := range listed {
+		a.True(start.Add(time.Duration(i) * time.Hour).Equal(v.Time))
+
+		out := &bytes.Buffer{}
+		r.NoError(s.Restore(v.ID, out))
+		a.Equal(versions[i], out.Bytes())
+	}
+
+	r.Equal(ErrNotFound, s.Restore(100, &bytes.Buffer{}))
+
+	// No temporary files are left behind.
+	a.Equal([]string{"delta.1", "delta.2", "delta.3", "delta.4", "delta.5", "index.json", "mirror.6"}, listFiles(t, dir))
+}
+
+func TestStorePrune(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	dir := t.TempDir()
+	s, err := Create(dir, &Options{BlockLen: 1024, StrongLen: 16, SigType: DefaultOptions.SigType})
+	r.NoError(err)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := makeVersions(4)
+	for i, data := range versions {
+		_, err := s.Add(bytes.NewReader(data), start.Add(time.Duration(i)*24*time.Hour))
+		r.NoError(err)
+	}
+
+	pruned, err := s.Prune(start.Add(36 * time.Hour))
+	r.NoError(err)
+	r.Len(pruned, 2)
+	a.Equal(uint64(1), pruned[0].ID)
+	a.Equal(uint64(2), pruned[1].ID)
+	a.Equal([]string{"delta.3", "index.json", "mirror.4"}, listFiles(t, dir))
+
+	s, err = Open(dir)
+	r.NoError(err)
+	r.Len(s.Versions(), 2)
+	for i, v := range s.Versions() {
+		out := &bytes.Buffer{}
+		r.NoError(s.Restore(v.ID, out))
+		a.Equal(versions[i+2], out.Bytes())
+	}
+
+	// The newest version is always kept.
+	pruned, err = s.Prune(start.Add(365 * 24 * time.Hour))
+	r.NoError(err)
+	r.Len(pruned, 1)
+	r.Len(s.Versions(), 1)
+	a.Equal(uint64(4), s.Versions()[0].ID)
+
+	// IDs keep increasing.
+	v, err := s.Add(bytes.NewReader(versions[0]), start.Add(365*24*time.Hour))
+	r.NoError(err)
+	a.Equal(uint64(5), v.ID)
+}
+
+func TestStoreErrors(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	_, err := Open(dir)
+	r.Equal(ErrNotAStore, err)
+
+	s, err := Create(dir, nil)
+	r.NoError(err)
+	_, err = Create(dir, nil)
+	r.Error(err)
+
+	versions := makeVersions(3)
+	for _, data := range versions {
+		_, err := s.Add(bytes.NewReader(data), time.Now())
+		r.NoError(err)
+	}
+
+	// Corrupt the mirror: the newest version is checked, and the older ones
+	// too since they are restored from it.
+	mirror := filepath.Join(dir, "mirror.3")
+	data, err := ioutil.ReadFile(mirror)
+	r.NoError(err)
+	data[100] ^= 0xff
+	r.NoError(ioutil.WriteFile(mirror, data, 0644))
+
+	for _, v := range s.Versions() {
+		r.Equal(ErrCorrupt, s.Restore(v.ID, ioutil.Discard), "version %d", v.ID)
+	}
+}
+
+func TestStoreClean(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+	s, err := Create(dir, nil)
+	r.NoError(err)
+	for _, data := range makeVersions(2) {
+		_, err := s.Add(bytes.NewReader(data), time.Now())
+		r.NoError(err)
+	}
+
+	// Leftovers of an interrupted Add.
+	for _, name := range []string{"tmp.123", "mirror.3", "delta.2", "unrelated"} {
+		r.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644))
+	}
+
+	r.NoError(s.Clean())
+	r.Equal([]string{"delta.1", "index.json", "mirror.2", "unrelated"}, listFiles(t, dir))
+}
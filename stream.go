@@ -0,0 +1,186 @@
+package librsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// DeltaOp is a single command of a delta, as read by DeltaReader or written by
+// DeltaWriter.
+type DeltaOp struct {
+	// One of KIND_LITERAL, KIND_COPY, KIND_TARGET_COPY or KIND_FILL.
+	// Compressed literals are represented as KIND_LITERAL.
+	Kind OpKind
+
+	// Position of the copied data, in the basis for KIND_COPY and in the
+	// output for KIND_TARGET_COPY.
+	Pos uint64
+
+	// Number of bytes added to the output.
+	Len uint64
+
+	// Data added to the output by KIND_LITERAL.
+	Data []byte
+
+	// Byte repeated by KIND_FILL.
+	Value byte
+}
+
+// DeltaReader decodes the commands of a delta, one at a time.
+type DeltaReader struct {
+	r      io.Reader
+	header deltaHeader
+	codec  LiteralCodec
+	done   bool
+}
+
+// NewDeltaReader returns a DeltaReader for the delta read from r. The delta
+// header is read immediately.
+func NewDeltaReader(r io.Reader) (*DeltaReader, error) {
+	header, err := readDeltaHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.has(DELTA_FLAG_IN_PLACE) {
+		return nil, errInPlaceDelta
+	}
+
+	d := &DeltaReader{r: r, header: header}
+	if header.has(DELTA_FLAG_COMPRESSED_LITERALS) {
+		d.codec, err = literalCodec(header.codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Flags returns the extensions used by the delta.
+func (d *DeltaReader) Flags() DeltaFlags {
+	return d.header.flags
+}
+
+// Next returns the next command of the delta, or io.EOF after its end.
+func (d *DeltaReader) Next() (DeltaOp, error) {
+	if d.done {
+		return DeltaOp{}, io.EOF
+	}
+
+	cmd, param1, param2, err := readCommand(d.r)
+	if err == io.EOF {
+		return DeltaOp{}, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return DeltaOp{}, err
+	}
+
+	if !d.header.allows(cmd.Kind) {
+		return DeltaOp{}, fmt.Errorf("Bogus command %x", cmd.Kind)
+	}
+	if param1 < 0 || param2 < 0 {
+		return DeltaOp{}, fmt.Errorf("invalid command parameters %d, %d", param1, param2)
+	}
+
+	switch cmd.Kind {
+	case KIND_END:
+		d.done = true
+		return DeltaOp{}, io.EOF
+	case KIND_LITERAL, KIND_LITERAL_Z:
+		// Grow the buffer as data arrives, rather than trusting the length.
+		var buf bytes.Buffer
+		if cmd.Kind == KIND_LITERAL {
+			_, err = io.CopyN(&buf, d.r, param1)
+		} else {
+			_, err = copyCompressedLiteral(&buf, d.r, d.codec, param1, param2)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return DeltaOp{}, err
+		}
+		return DeltaOp{Kind: KIND_LITERAL, Len: uint64(param1), Data: buf.Bytes()}, nil
+	case KIND_COPY, KIND_TARGET_COPY:
+		return DeltaOp{Kind: cmd.Kind, Pos: uint64(param1), Len: uint64(param2)}, nil
+	case KIND_FILL:
+		return DeltaOp{Kind: KIND_FILL, Value: byte(param1), Len: uint64(param2)}, nil
+	}
+
+	return DeltaOp{}, fmt.Errorf("Bogus command %x", cmd.Kind)
+}
+
+// DeltaWriter encodes a delta from individual commands. Consecutive commands
+// are merged when possible.
+type DeltaWriter struct {
+	header deltaHeader
+	m      match
+	stats  *DeltaStats
+	closed bool
+}
+
+// NewDeltaWriter returns a DeltaWriter writing to w a delta using the
+// extensions enabled in opts. The delta header is written immediately.
+func NewDeltaWriter(w io.Writer, opts DeltaOptions) (*DeltaWriter, error) {
+	header := opts.header()
+	err := writeDeltaHeader(w, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeltaWriter{
+		header: header,
+		m:      opts.newMatch(w, opts.LitBuff),
+		stats:  opts.Stats,
+	}, nil
+}
+
+// Write adds a command to the delta.
+func (d *DeltaWriter) Write(op DeltaOp) error {
+	if d.closed {
+		return fmt.Errorf("write to closed DeltaWriter")
+	}
+	if op.Kind == KIND_END || op.Kind == KIND_LITERAL_Z || !d.header.allows(op.Kind) {
+		return fmt.Errorf("command %x not enabled for this delta", op.Kind)
+	}
+
+	switch op.Kind {
+	case KIND_LITERAL:
+		for _, b := range op.Data {
+			err := d.m.add(MATCH_KIND_LITERAL, uint64(b), 1)
+			if err != nil {
+				return err
+			}
+		}
+	case KIND_COPY:
+		if op.Len > 0 {
+			return d.m.add(MATCH_KIND_COPY, op.Pos, op.Len)
+		}
+	case KIND_TARGET_COPY:
+		if op.Len > 0 {
+			return d.m.add(MATCH_KIND_TARGET_COPY, op.Pos, op.Len)
+		}
+	case KIND_FILL:
+		if op.Len > 0 {
+			return d.m.add(MATCH_KIND_FILL, uint64(op.Value), op.Len)
+		}
+	}
+	return nil
+}
+
+// Close writes any pending command and the end of the delta. It doesn't close
+// the underlying writer.
+func (d *DeltaWriter) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	err := d.m.flush()
+	if err != nil {
+		return err
+	}
+	if d.stats != nil {
+		*d.stats = d.m.stats
+	}
+	return d.m.write(uint64(OP_END), 1)
+}
@@ -0,0 +1,108 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDeltaReaderWriter reads the reference deltas command by command, writes
+// them back and checks that the result patches correctly.
+func TestDeltaReaderWriter(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	for _, tt := range allTestCases {
+		t.Run(tt, func(t *testing.T) {
+			file, _, _, _, err := argsFromTestName(tt)
+			r.NoError(err)
+
+			deltaFile, err := os.Open("testdata/" + tt + ".delta")
+			r.NoError(err)
+			defer deltaFile.Close()
+
+			dr, err := NewDeltaReader(deltaFile)
+			r.NoError(err)
+			a.Equal(DeltaFlags(0), dr.Flags())
+
+			delta := &bytes.Buffer{}
+			dw, err := NewDeltaWriter(delta, DeltaOptions{})
+			r.NoError(err)
+
+			var size uint64
+			for {
+				op, err := dr.Next()
+				if err == io.EOF {
+					break
+				}
+				r.NoError(err)
+				size += op.Len
+				r.NoError(dw.Write(op))
+			}
+			r.NoError(dw.Close())
+
+			wantNewFile, err := ioutil.ReadFile("testdata/" + file + ".new")
+			r.NoError(err)
+			a.Equal(uint64(len(wantNewFile)), size)
+
+			baseFile, err := os.Open("testdata/" + file + ".old")
+			r.NoError(err)
+			defer baseFile.Close()
+
+			output := &bytes.Buffer{}
+			r.NoError(Patch(baseFile, delta, output))
+
+			gotNewFile, err := ioutil.ReadAll(output)
+			r.NoError(err)
+
+			a.Equal(wantNewFile, gotNewFile)
+		})
+	}
+}
+
+func TestDeltaWriterExtensions(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	base := []byte("0123456789")
+	ops := []DeltaOp{
+		{Kind: KIND_COPY, Pos: 2, Len: 3},
+		{Kind: KIND_LITERAL, Data: []byte("abc"), Len: 3},
+		{Kind: KIND_FILL, Value: 'z', Len: 4},
+		{Kind: KIND_TARGET_COPY, Pos: 1, Len: 6},
+	}
+
+	// Not enabled
+	dw, err := NewDeltaWriter(ioutil.Discard, DeltaOptions{})
+	r.NoError(err)
+	a.Error(dw.Write(ops[2]))
+	a.Error(dw.Write(ops[3]))
+
+	delta := &bytes.Buffer{}
+	dw, err = NewDeltaWriter(delta, DeltaOptions{TargetCopies: true, Fill: true})
+	r.NoError(err)
+	for _, op := range ops {
+		r.NoError(dw.Write(op))
+	}
+	r.NoError(dw.Close())
+
+	dr, err := NewDeltaReader(bytes.NewReader(delta.Bytes()))
+	r.NoError(err)
+	a.Equal(DELTA_FLAG_TARGET_COPY|DELTA_FLAG_FILL, dr.Flags())
+	for _, want := range ops {
+		got, err := dr.Next()
+		r.NoError(err)
+		a.Equal(want, got)
+	}
+	_, err = dr.Next()
+	a.Equal(io.EOF, err)
+
+	output := &bytes.Buffer{}
+	r.NoError(Patch(bytes.NewReader(base), delta, output))
+	a.Equal("234abczzzz34abcz", output.String())
+}
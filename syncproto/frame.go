@@ -0,0 +1,219 @@
+package syncproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Frame types.
+const (
+	FRAME_HELLO     uint8 = iota + 1 // receiver: magic, version and proposed hashes
+	FRAME_ACCEPT                     // sender: version and chosen hash
+	FRAME_SIG                        // receiver: signature data
+	FRAME_SIG_END                    // receiver: end of signature
+	FRAME_DELTA                      // sender: delta data
+	FRAME_DELTA_END                  // sender: end of delta, with the SHA-256 of the new file
+	FRAME_DONE                       // receiver: SHA-256 of the patched file
+	FRAME_ERROR                      // either side: error message, ends the session
+)
+
+// Every frame starts with its type and the length of its payload.
+const frameHeaderSize = 5
+
+// Frames with larger payloads are rejected. Data frames are written with at
+// most maxDataFrame bytes.
+const (
+	maxFrameSize = 1024 * 1024
+	maxDataFrame = 32 * 1024
+)
+
+// RemoteError is an error reported by the other end of a session.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "syncproto: remote error: " + e.Message
+}
+
+type frameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: bufio.NewReader(r)}
+}
+
+// next reads a frame. Its payload is only valid until the next call.
+func (fr *frameReader) next() (typ uint8, payload []byte, err error) {
+	var header [frameHeaderSize]byte
+	_, err = io.ReadFull(fr.r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	typ = header[0]
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("syncproto: frame of %d bytes exceeds maximum of %d", size, maxFrameSize)
+	}
+	if cap(fr.buf) < int(size) {
+		fr.buf = make([]byte, size)
+	}
+	payload = fr.buf[:size]
+	_, err = io.ReadFull(fr.r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return typ, payload, err
+}
+
+// expect reads a frame of type typ, turning ERROR frames into a RemoteError.
+func (fr *frameReader) expect(typ uint8) ([]byte, error) {
+	t, payload, err := fr.next()
+	if err != nil {
+		return nil, err
+	}
+	if t == FRAME_ERROR {
+		return nil, &RemoteError{string(payload)}
+	}
+	if t != typ {
+		return nil, fmt.Errorf("syncproto: got frame type %d rather than expected %d", t, typ)
+	}
+	return payload, nil
+}
+
+// streamReader reads the payloads of a sequence of data frames as a stream,
+// until an end frame.
+type streamReader struct {
+	fr         *frameReader
+	data, end  uint8
+	pending    []byte
+	endPayload []byte
+	err        error
+}
+
+func (fr *frameReader) stream(data, end uint8) *streamReader {
+	return &streamReader{fr: fr, data: data, end: end}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		typ, payload, err := s.fr.next()
+		switch {
+		case err != nil:
+			s.err = err
+		case typ == s.data:
+			s.pending = payload
+		case typ == s.end:
+			s.endPayload = append([]byte{}, payload...)
+			s.err = io.EOF
+		case typ == FRAME_ERROR:
+			s.err = &RemoteError{string(payload)}
+		default:
+			s.err = fmt.Errorf("syncproto: got frame type %d rather than expected %d", typ, s.data)
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// drain skips the rest of the stream, so that the other end can write its
+// remaining frames before reading ours. It returns the error that ended the
+// stream, if it is not a clean end.
+func (s *streamReader) drain() error {
+	_, err := io.Copy(ioutil.Discard, s)
+	return err
+}
+
+type frameWriter struct {
+	w *bufio.Writer
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{w: bufio.NewWriter(w)}
+}
+
+// write writes a frame without flushing it.
+func (fw *frameWriter) write(typ uint8, payload []byte) error {
+	var header [frameHeaderSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err := fw.w.Write(header[:])
+	if err != nil {
+		return err
+	}
+	_, err = fw.w.Write(payload)
+	return err
+}
+
+// send writes a frame and flushes it.
+func (fw *frameWriter) send(typ uint8, payload []byte) error {
+	err := fw.write(typ, payload)
+	if err != nil {
+		return err
+	}
+	return fw.w.Flush()
+}
+
+// sendError reports err to the other end.
+func (fw *frameWriter) sendError(err error) error {
+	msg := err.Error()
+	if len(msg) > maxFrameSize {
+		msg = msg[:maxFrameSize]
+	}
+	return fw.send(FRAME_ERROR, []byte(msg))
+}
+
+// streamWriter writes data as a sequence of data frames.
+type streamWriter struct {
+	fw  *frameWriter
+	typ uint8
+	buf []byte
+}
+
+func (fw *frameWriter) stream(typ uint8) *streamWriter {
+	return &streamWriter{fw: fw, typ: typ, buf: make([]byte, 0, maxDataFrame)}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+		if len(s.buf) == cap(s.buf) {
+			err := s.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *streamWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	err := s.fw.write(s.typ, s.buf)
+	s.buf = s.buf[:0]
+	return err
+}
+
+// close writes pending data and the end frame, and flushes everything.
+func (s *streamWriter) close(end uint8, payload []byte) error {
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	return s.fw.send(end, payload)
+}
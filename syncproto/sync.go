@@ -0,0 +1,268 @@
+// Package syncproto implements a framed protocol to update a file on a remote
+// host, over any connection.
+//
+// The receiver holds the basis, and the sender holds the new file. A session
+// goes as follows:
+//
+//  1. The receiver sends HELLO, proposing the hashes it can use in signatures.
+//  2. The sender answers ACCEPT with the first proposed hash it allows, or
+//     ERROR if there is none.
+//  3. The receiver streams the signature of the basis in SIG frames, followed
+//     by SIG_END.
+//  4. The sender streams the delta in DELTA frames as it is generated,
+//     followed by DELTA_END with the SHA-256 of the new file.
+//  5. The receiver patches the basis as the delta arrives, checks the SHA-256
+//     of the result and sends DONE with it.
+//
+// Every frame is a type byte, followed by the length of its payload as a
+// big-endian uint32 and the payload itself. Either side can send ERROR with a
+// message instead of its next frame, which ends the session.
+package syncproto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// Version of the protocol.
+const VERSION = 1
+
+// Default of Options.MaxBlockLen.
+const DEFAULT_MAX_BLOCK_LEN = 1024 * 1024
+
+// Magic bytes at the start of HELLO frames.
+var magic = []byte("LRSP")
+
+var (
+	ErrNoCommonHash     = errors.New("syncproto: no common hash")
+	ErrChecksumMismatch = errors.New("syncproto: checksum mismatch")
+)
+
+// DefaultHashes are the hashes used when Options.Hashes is empty, in order of
+// preference.
+var DefaultHashes = []librsync.MagicNumber{librsync.BLAKE2_SIG_MAGIC, librsync.MD4_SIG_MAGIC}
+
+// Options configures either side of a session.
+type Options struct {
+	// Hashes proposed by the receiver, or allowed by the sender. If empty,
+	// DefaultHashes is used.
+	Hashes []librsync.MagicNumber
+
+	// Parameters of the signature sent by the receiver. If zero, 2048 byte
+	// blocks with the longest strong sums of the chosen hash are used.
+	BlockLen  uint32
+	StrongLen uint32
+
+	// Signatures with blocks larger than this are refused by the sender, as
+	// a block is kept in memory while computing the delta. If zero,
+	// DEFAULT_MAX_BLOCK_LEN is used.
+	MaxBlockLen uint32
+
+	// Options used by the receiver to apply the delta, for example to limit
+	// the output with MaxOutputSize and MaxOps.
+	PatchOptions librsync.PatchOptions
+}
+
+func (opts *Options) maxBlockLen() uint32 {
+	if opts.MaxBlockLen == 0 {
+		return DEFAULT_MAX_BLOCK_LEN
+	}
+	return opts.MaxBlockLen
+}
+
+func (opts *Options) hashes() []librsync.MagicNumber {
+	if len(opts.Hashes) == 0 {
+		return DefaultHashes
+	}
+	return opts.Hashes
+}
+
+// Receive updates a file with a sender at the other end of rw, writing to out
+// the new file computed from basis.
+func Receive(rw io.ReadWriter, basis io.ReadSeeker, out io.Writer, opts Options) error {
+	fr := newFrameReader(rw)
+	fw := newFrameWriter(rw)
+
+	hello := append([]byte{}, magic...)
+	hello = append(hello, VERSION, uint8(len(opts.hashes())))
+	for _, h := range opts.hashes() {
+		hello = appendUint32(hello, uint32(h))
+	}
+	err := fw.send(FRAME_HELLO, hello)
+	if err != nil {
+		return err
+	}
+
+	accept, err := fr.expect(FRAME_ACCEPT)
+	if err != nil {
+		return err
+	}
+	if len(accept) != 5 || accept[0] != VERSION {
+		return fmt.Errorf("syncproto: bad ACCEPT frame %x", accept)
+	}
+	hash := librsync.MagicNumber(binary.BigEndian.Uint32(accept[1:]))
+	if !contains(opts.hashes(), hash) {
+		return fmt.Errorf("syncproto: sender chose hash %#x, which wasn't proposed", uint32(hash))
+	}
+
+	blockLen, strongLen := opts.BlockLen, opts.StrongLen
+	if blockLen == 0 {
+		blockLen = 2048
+	}
+	if strongLen == 0 {
+		strongLen = librsync.BLAKE2_SUM_LENGTH
+		if hash == librsync.MD4_SIG_MAGIC {
+			strongLen = librsync.MD4_SUM_LENGTH
+		}
+	}
+
+	sw := fw.stream(FRAME_SIG)
+	_, err = librsync.Signature(basis, sw, blockLen, strongLen, hash)
+	if err == nil {
+		_, err = basis.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		fw.sendError(err)
+		return err
+	}
+	err = sw.close(FRAME_SIG_END, nil)
+	if err != nil {
+		return err
+	}
+
+	sr := fr.stream(FRAME_DELTA, FRAME_DELTA_END)
+	sum := sha256.New()
+	err = librsync.PatchWithOptions(basis, sr, io.MultiWriter(out, sum), opts.PatchOptions)
+	if sr.err != nil && sr.err != io.EOF {
+		return sr.err
+	}
+	if err != nil {
+		// Let the sender finish before reporting the error.
+		if derr := sr.drain(); derr != nil {
+			return derr
+		}
+		fw.sendError(err)
+		return err
+	}
+	err = sr.drain()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(sr.endPayload, sum.Sum(nil)) {
+		fw.sendError(ErrChecksumMismatch)
+		return ErrChecksumMismatch
+	}
+	return fw.send(FRAME_DONE, sum.Sum(nil))
+}
+
+// Send updates a file with a receiver at the other end of rw, so that it
+// matches input.
+func Send(rw io.ReadWriter, input io.Reader, opts Options) error {
+	fr := newFrameReader(rw)
+	fw := newFrameWriter(rw)
+
+	hello, err := fr.expect(FRAME_HELLO)
+	if err != nil {
+		return err
+	}
+	if len(hello) < len(magic)+2 || !bytes.Equal(hello[:len(magic)], magic) {
+		err = fmt.Errorf("syncproto: bad HELLO frame %x", hello)
+		fw.sendError(err)
+		return err
+	}
+	if version := hello[len(magic)]; version != VERSION {
+		err = fmt.Errorf("syncproto: unsupported protocol version %d", version)
+		fw.sendError(err)
+		return err
+	}
+	proposed := hello[len(magic)+2:]
+	if len(proposed) != 4*int(hello[len(magic)+1]) {
+		err = fmt.Errorf("syncproto: bad HELLO frame %x", hello)
+		fw.sendError(err)
+		return err
+	}
+
+	var hash librsync.MagicNumber
+	for ; len(proposed) > 0; proposed = proposed[4:] {
+		h := librsync.MagicNumber(binary.BigEndian.Uint32(proposed))
+		if contains(opts.hashes(), h) {
+			hash = h
+			break
+		}
+	}
+	if hash == 0 {
+		fw.sendError(ErrNoCommonHash)
+		return ErrNoCommonHash
+	}
+
+	accept := appendUint32([]byte{VERSION}, uint32(hash))
+	err = fw.send(FRAME_ACCEPT, accept)
+	if err != nil {
+		return err
+	}
+
+	sr := fr.stream(FRAME_SIG, FRAME_SIG_END)
+	sig, err := librsync.ReadSignature(sr)
+	if sr.err != nil && sr.err != io.EOF {
+		return sr.err
+	}
+	if err == nil && sig.SigType != hash {
+		err = fmt.Errorf("syncproto: got signature with hash %#x rather than %#x", uint32(sig.SigType), uint32(hash))
+	}
+	if err == nil {
+		err = librsync.CheckSignature(sig, opts.maxBlockLen())
+	}
+	if err == nil {
+		err = sr.drain()
+	}
+	if err != nil {
+		if derr := sr.drain(); derr != nil {
+			return derr
+		}
+		fw.sendError(err)
+		return err
+	}
+
+	sum := sha256.New()
+	sw := fw.stream(FRAME_DELTA)
+	err = librsync.DeltaBuff(sig, io.TeeReader(input, sum), sw, make([]byte, 0, librsync.OUTPUT_BUFFER_SIZE))
+	if err != nil {
+		fw.sendError(err)
+		return err
+	}
+	err = sw.close(FRAME_DELTA_END, sum.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	done, err := fr.expect(FRAME_DONE)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(done, sum.Sum(nil)) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+func contains(hashes []librsync.MagicNumber, h librsync.MagicNumber) bool {
+	for _, x := range hashes {
+		if x == h {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
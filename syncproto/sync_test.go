@@ -0,0 +1,183 @@
+package syncproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/balena-os/librsync-go"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// session runs Send and Receive at both ends of a net.Pipe.
+func session(basis io.ReadSeeker, input io.Reader, sendOpts, recvOpts Options) (out []byte, sendErr, recvErr error) {
+	sconn, rconn := net.Pipe()
+	defer sconn.Close()
+	defer rconn.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- Send(sconn, input, sendOpts)
+	}()
+
+	buf := &bytes.Buffer{}
+	recvErr = Receive(rconn, basis, buf, recvOpts)
+	sendErr = <-done
+	return buf.Bytes(), sendErr, recvErr
+}
+
+func TestSync(t *testing.T) {
+	basis := randomData(1, 300*1024)
+	newfile := append(append([]byte{}, basis[:100000]...), randomData(2, 5000)...)
+	newfile = append(newfile, basis[120000:]...)
+
+	for _, tc := range []struct {
+		name     string
+		sendOpts Options
+		recvOpts Options
+	}{
+		{"defaults", Options{}, Options{}},
+		{"md4", Options{}, Options{Hashes: []librsync.MagicNumber{librsync.MD4_SIG_MAGIC}}},
+		{"sender-preference", Options{Hashes: []librsync.MagicNumber{librsync.MD4_SIG_MAGIC}}, Options{}},
+		{"small-blocks", Options{}, Options{BlockLen: 256, StrongLen: 8}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+
+			out, sendErr, recvErr := session(bytes.NewReader(basis), bytes.NewReader(newfile), tc.sendOpts, tc.recvOpts)
+			r.NoError(sendErr)
+			r.NoError(recvErr)
+			r.Equal(newfile, out)
+		})
+	}
+}
+
+func TestSyncEmpty(t *testing.T) {
+	r := require.New(t)
+
+	out, sendErr, recvErr := session(bytes.NewReader(nil), bytes.NewReader(nil), Options{}, Options{})
+	r.NoError(sendErr)
+	r.NoError(recvErr)
+	r.Empty(out)
+
+	data := randomData(1, 10000)
+	out, sendErr, recvErr = session(bytes.NewReader(nil), bytes.NewReader(data), Options{}, Options{})
+	r.NoError(sendErr)
+	r.NoError(recvErr)
+	r.Equal(data, out)
+}
+
+func TestSyncNoCommonHash(t *testing.T) {
+	a := assert.New(t)
+
+	_, sendErr, recvErr := session(bytes.NewReader(nil), bytes.NewReader(nil),
+		Options{Hashes: []librsync.MagicNumber{librsync.BLAKE2_SIG_MAGIC}},
+		Options{Hashes: []librsync.MagicNumber{librsync.MD4_SIG_MAGIC}})
+	a.ErrorIs(sendErr, ErrNoCommonHash)
+
+	var remote *RemoteError
+	a.True(errors.As(recvErr, &remote))
+	a.Equal(ErrNoCommonHash.Error(), remote.Message)
+}
+
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+var errInput = errors.New("input failed")
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errInput
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestSyncSenderError(t *testing.T) {
+	a := assert.New(t)
+
+	data := randomData(1, 200*1024)
+	_, sendErr, recvErr := session(bytes.NewReader(data), &failingReader{bytes.NewReader(data), 100000}, Options{}, Options{})
+	a.ErrorIs(sendErr, errInput)
+
+	var remote *RemoteError
+	a.True(errors.As(recvErr, &remote))
+	a.Equal(errInput.Error(), remote.Message)
+}
+
+func TestSyncLimits(t *testing.T) {
+	a := assert.New(t)
+	var remote *RemoteError
+
+	// The receiver asks for blocks larger than the sender allows.
+	data := randomData(1, 200*1024)
+	_, sendErr, recvErr := session(bytes.NewReader(data), bytes.NewReader(data),
+		Options{MaxBlockLen: 2048}, Options{BlockLen: 4096})
+	a.ErrorIs(sendErr, librsync.ErrInvalidSignature)
+	a.True(errors.As(recvErr, &remote))
+
+	// The sender sends more than the receiver allows.
+	_, sendErr, recvErr = session(bytes.NewReader(nil), bytes.NewReader(data),
+		Options{}, Options{PatchOptions: librsync.PatchOptions{MaxOutputSize: 100 * 1024}})
+	a.ErrorIs(recvErr, librsync.ErrOutputTooLarge)
+	a.True(errors.As(sendErr, &remote))
+}
+
+func TestSyncBadHello(t *testing.T) {
+	r := require.New(t)
+
+	sconn, rconn := net.Pipe()
+	defer sconn.Close()
+	defer rconn.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- Send(sconn, bytes.NewReader(nil), Options{})
+	}()
+
+	fw := newFrameWriter(rconn)
+	r.NoError(fw.send(FRAME_HELLO, []byte("XXXX\x01\x00")))
+
+	_, err := newFrameReader(rconn).expect(FRAME_ACCEPT)
+	var remote *RemoteError
+	r.True(errors.As(err, &remote))
+	r.Contains(remote.Message, "bad HELLO frame")
+	r.Error(<-done)
+}
+
+func TestStreamFrames(t *testing.T) {
+	r := require.New(t)
+
+	data := randomData(1, 3*maxDataFrame+100)
+	buf := &bytes.Buffer{}
+	fw := newFrameWriter(buf)
+	sw := fw.stream(FRAME_DELTA)
+	_, err := sw.Write(data)
+	r.NoError(err)
+	r.NoError(sw.close(FRAME_DELTA_END, []byte("end")))
+	r.Equal(len(data)+5*frameHeaderSize+3, buf.Len())
+
+	sr := newFrameReader(buf).stream(FRAME_DELTA, FRAME_DELTA_END)
+	got, err := ioutil.ReadAll(sr)
+	r.NoError(err)
+	r.Equal(data, got)
+	r.Equal([]byte("end"), sr.endPayload)
+}
@@ -0,0 +1,563 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Tar archives are made of blocks of this size.
+const tarBlockSize = 512
+
+// Extended headers (PAX records, GNU long names) larger than this are
+// rejected.
+const maxTarExtHeaderSize = 1024 * 1024
+
+// Kinds of records in tar signatures.
+const (
+	tarSigEntry   uint8 = 0
+	tarSigTrailer uint8 = 1
+)
+
+// TarSignatureType is the signature of a tar archive, made of the signatures
+// of its entries.
+//
+// Each entry is split in two parts: its metadata, made of the entry's headers,
+// and its data, padded to the tar block size. Metadata is only ever copied
+// whole, while data is signed in blocks aligned to its start, so that
+// inserting or resizing an entry doesn't misalign the blocks of the following
+// ones.
+type TarSignatureType struct {
+	SigType   MagicNumber
+	BlockLen  uint32
+	StrongLen uint32
+
+	// Entries by path. If an archive holds the same path several times, the
+	// last one is used.
+	Entries map[string]*TarEntrySignature
+
+	// End of archive marker and anything after it.
+	Trailer *TarEntrySignature
+}
+
+// TarEntrySignature is the signature of an entry of a tar archive.
+type TarEntrySignature struct {
+	// Position and length of the metadata in the archive, and its BLAKE2 sum.
+	MetaOffset uint64
+	MetaLen    uint64
+	MetaSum    []byte
+
+	// Length of the padded data, which follows the metadata, and the
+	// signature of its blocks.
+	DataLen uint64
+	Blocks  *SignatureType
+}
+
+// DataOffset returns the position of the data of the entry in the archive.
+func (e *TarEntrySignature) DataOffset() uint64 {
+	return e.MetaOffset + e.MetaLen
+}
+
+// tarEntry is an entry of a tar archive being read.
+type tarEntry struct {
+	name    string
+	trailer bool
+
+	offset uint64
+	meta   []byte
+
+	dataLen uint64
+	data    io.Reader
+}
+
+// readTar splits the tar archive read from r into entries, calling fn for each
+// of them. The bytes left after the last entry are passed in a last entry,
+// with trailer set. fn doesn't need to read all the data of the entries.
+func readTar(r io.Reader, fn func(e *tarEntry) error) error {
+	br := bufio.NewReader(r)
+
+	var offset uint64
+	var meta []byte
+	var longName, paxPath string
+
+	for {
+		block := make([]byte, tarBlockSize)
+		n, err := io.ReadFull(br, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			meta = append(meta, block[:n]...)
+			break
+		} else if err != nil {
+			return err
+		}
+		meta = append(meta, block...)
+
+		if isZeroBlock(block) {
+			break
+		}
+
+		pos := offset + uint64(len(meta)) - tarBlockSize
+		size, err := parseTarHeader(block)
+		if err != nil {
+			return fmt.Errorf("tar header at %d: %w", pos, err)
+		}
+
+		typeflag := block[156]
+		switch typeflag {
+		case 'x', 'g', 'L', 'K':
+			if size > maxTarExtHeaderSize {
+				return fmt.Errorf("tar header at %d: extended header of %d bytes is too large", pos, size)
+			}
+			ext := make([]byte, tarPadded(size))
+			_, err = io.ReadFull(br, ext)
+			if err != nil {
+				return fmt.Errorf("tar header at %d: %w", pos, err)
+			}
+			meta = append(meta, ext...)
+
+			switch typeflag {
+			case 'x':
+				if path, ok := paxRecord(ext[:size], "path"); ok {
+					paxPath = path
+				}
+			case 'L':
+				longName = cString(ext[:size])
+			}
+			continue
+		case 'S':
+			// Old GNU sparse files may have extension blocks with more of the
+			// sparse map.
+			for extended := block[482] != 0; extended; {
+				ext := make([]byte, tarBlockSize)
+				_, err = io.ReadFull(br, ext)
+				if err != nil {
+					return fmt.Errorf("tar header at %d: %w", pos, err)
+				}
+				meta = append(meta, ext...)
+				extended = ext[504] != 0
+			}
+		}
+
+		name := cString(block[0:100])
+		if string(block[257:263]) == "ustar\x00" {
+			if prefix := cString(block[345:500]); prefix != "" {
+				name = prefix + "/" + name
+			}
+		}
+		if longName != "" {
+			name = longName
+		}
+		if paxPath != "" {
+			name = paxPath
+		}
+
+		// The data goes with its padding, so that the metadata of the next
+		// entry doesn't change with the size of this one.
+		data := &io.LimitedReader{R: br, N: int64(tarPadded(size))}
+		e := &tarEntry{
+			name:    name,
+			offset:  offset,
+			meta:    meta,
+			dataLen: tarPadded(size),
+			data:    data,
+		}
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, data)
+		if err != nil {
+			return err
+		}
+		if data.N != 0 {
+			return fmt.Errorf("tar entry at %d: %w", pos, io.ErrUnexpectedEOF)
+		}
+
+		offset += uint64(len(meta)) + e.dataLen
+		meta = nil
+		longName, paxPath = "", ""
+	}
+
+	// The trailer is diffed like data: its length varies with the blocking of
+	// the archive, but it's mostly made of zeros.
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	trailer := append(meta, rest...)
+	return fn(&tarEntry{
+		trailer: true,
+		offset:  offset,
+		dataLen: uint64(len(trailer)),
+		data:    bytes.NewReader(trailer),
+	})
+}
+
+// parseTarHeader checks the checksum of a tar header block, and returns the
+// size of the data following it.
+func parseTarHeader(block []byte) (uint64, error) {
+	chksum, err := parseTarNumber(block[148:156])
+	if err != nil {
+		return 0, err
+	}
+	var unsigned, signed int64
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		unsigned += int64(b)
+		signed += int64(int8(b))
+	}
+	if chksum != uint64(unsigned) && chksum != uint64(signed) {
+		return 0, fmt.Errorf("bad checksum")
+	}
+	return parseTarNumber(block[124:136])
+}
+
+// parseTarNumber parses a numeric field of a tar header, in octal or in the
+// base-256 GNU extension.
+func parseTarNumber(field []byte) (uint64, error) {
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		if field[0]&0x40 != 0 {
+			return 0, fmt.Errorf("negative number in tar header")
+		}
+		var n uint64
+		for i, b := range field {
+			if i == 0 {
+				b &= 0x7f
+			}
+			if n > (1<<64-1)>>8 {
+				return 0, fmt.Errorf("number overflow in tar header")
+			}
+			n = n<<8 | uint64(b)
+		}
+		return n, nil
+	}
+
+	s := strings.Trim(string(field), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q in tar header", s)
+	}
+	return n, nil
+}
+
+// paxRecord returns the value of a record of PAX extended header data.
+func paxRecord(data []byte, key string) (string, bool) {
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return "", false
+		}
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || n <= sp || n > len(data) {
+			return "", false
+		}
+		record := string(data[sp+1 : n])
+		data = data[n:]
+
+		record = strings.TrimSuffix(record, "\n")
+		if eq := strings.IndexByte(record, '='); eq >= 0 && record[:eq] == key {
+			return record[eq+1:], true
+		}
+	}
+	return "", false
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func isZeroBlock(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func tarPadded(size uint64) uint64 {
+	return (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+func tarMetaSum(meta []byte) []byte {
+	sum := blake2b.Sum256(meta)
+	return sum[:]
+}
+
+// TarSignature is like Signature, but for a tar archive. Deltas generated by
+// TarDelta against the signature copy unchanged entries whole, and only diff
+// each changed entry against the previous version of the same path.
+//
+// If input isn't a tar archive, an error is returned.
+func TarSignature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*TarSignatureType, error) {
+	maxLen, err := maxStrongLen(sigType)
+	if err != nil {
+		return nil, err
+	}
+	if strongLen > maxLen {
+		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", strongLen, sigType)
+	}
+
+	for _, v := range []uint32{uint32(TAR_SIG_MAGIC), uint32(sigType), blockLen, strongLen} {
+		err = binary.Write(output, binary.BigEndian, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ret := &TarSignatureType{
+		SigType:   sigType,
+		BlockLen:  blockLen,
+		StrongLen: strongLen,
+		Entries:   make(map[string]*TarEntrySignature),
+	}
+
+	err = readTar(input, func(e *tarEntry) error {
+		entry := &TarEntrySignature{
+			MetaOffset: e.offset,
+			MetaLen:    uint64(len(e.meta)),
+			MetaSum:    tarMetaSum(e.meta),
+			DataLen:    e.dataLen,
+			Blocks: &SignatureType{
+				SigType:    sigType,
+				BlockLen:   blockLen,
+				StrongLen:  strongLen,
+				Weak2block: make(map[uint32]int),
+			},
+		}
+
+		kind := tarSigEntry
+		if e.trailer {
+			kind = tarSigTrailer
+			ret.Trailer = entry
+		} else {
+			ret.Entries[e.name] = entry
+		}
+
+		err := binary.Write(output, binary.BigEndian, kind)
+		if err != nil {
+			return err
+		}
+		if !e.trailer {
+			err = binary.Write(output, binary.BigEndian, uint32(len(e.name)))
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(output, e.name)
+			if err != nil {
+				return err
+			}
+		}
+		for _, v := range []uint64{entry.MetaOffset, entry.MetaLen, entry.DataLen} {
+			err = binary.Write(output, binary.BigEndian, v)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = output.Write(entry.MetaSum)
+		if err != nil {
+			return err
+		}
+
+		return writeBlockSums(e.data, output, entry.Blocks)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// ReadTarSignature reads a signature generated by TarSignature.
+func ReadTarSignature(r io.Reader) (*TarSignatureType, error) {
+	var header [4]uint32
+	err := binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	if MagicNumber(header[0]) != TAR_SIG_MAGIC {
+		return nil, fmt.Errorf("Got magic number %x rather than expected value %x", header[0], TAR_SIG_MAGIC)
+	}
+
+	ret := &TarSignatureType{
+		SigType:   MagicNumber(header[1]),
+		BlockLen:  header[2],
+		StrongLen: header[3],
+		Entries:   make(map[string]*TarEntrySignature),
+	}
+	err = CheckSignature(&SignatureType{SigType: ret.SigType, BlockLen: ret.BlockLen, StrongLen: ret.StrongLen}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var kind uint8
+		err = binary.Read(r, binary.BigEndian, &kind)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var name string
+		switch kind {
+		case tarSigEntry:
+			var nameLen uint32
+			err = binary.Read(r, binary.BigEndian, &nameLen)
+			if err != nil {
+				return nil, err
+			}
+			if nameLen > maxTarExtHeaderSize {
+				return nil, fmt.Errorf("invalid entry name length %d", nameLen)
+			}
+			b := make([]byte, nameLen)
+			_, err = io.ReadFull(r, b)
+			if err != nil {
+				return nil, err
+			}
+			name = string(b)
+		case tarSigTrailer:
+		default:
+			return nil, fmt.Errorf("invalid tar signature record %d", kind)
+		}
+
+		var fields [3]uint64
+		err = binary.Read(r, binary.BigEndian, &fields)
+		if err != nil {
+			return nil, err
+		}
+		entry := &TarEntrySignature{
+			MetaOffset: fields[0],
+			MetaLen:    fields[1],
+			MetaSum:    make([]byte, blake2b.Size256),
+			DataLen:    fields[2],
+			Blocks: &SignatureType{
+				SigType:    ret.SigType,
+				BlockLen:   ret.BlockLen,
+				StrongLen:  ret.StrongLen,
+				Weak2block: make(map[uint32]int),
+			},
+		}
+		_, err = io.ReadFull(r, entry.MetaSum)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks := (entry.DataLen + uint64(ret.BlockLen) - 1) / uint64(ret.BlockLen)
+		for i := uint64(0); i < blocks; i++ {
+			var weak uint32
+			err = binary.Read(r, binary.BigEndian, &weak)
+			if err != nil {
+				return nil, err
+			}
+			strong := make([]byte, ret.StrongLen)
+			_, err = io.ReadFull(r, strong)
+			if err != nil {
+				return nil, err
+			}
+			entry.Blocks.Weak2block[weak] = len(entry.Blocks.StrongSigs)
+			entry.Blocks.StrongSigs = append(entry.Blocks.StrongSigs, strong)
+		}
+
+		if kind == tarSigTrailer {
+			ret.Trailer = entry
+		} else {
+			ret.Entries[name] = entry
+		}
+	}
+
+	return ret, nil
+}
+
+// TarDelta is like DeltaWithOptions, but for a tar archive, against the
+// signature of the previous version of the archive. The delta is applied with
+// Patch, to the previous version of the archive.
+//
+// The metadata of each entry is copied whole if unchanged, and sent as literal
+// data otherwise. The data of each entry is diffed against the data of the
+// entry with the same path in the previous version, if any. Target copies,
+// filters, ordered copies and checkpoints aren't supported.
+func TarDelta(sig *TarSignatureType, input io.Reader, output io.Writer, opts DeltaOptions) error {
+	if opts.TargetCopies {
+		return fmt.Errorf("target copies aren't supported by tar deltas")
+	}
+	if opts.Filter != nil {
+		return fmt.Errorf("filters aren't supported by tar deltas")
+	}
+	if opts.OrderedCopies {
+		return fmt.Errorf("ordered copies aren't supported by tar deltas")
+	}
+	if opts.Checkpoint != nil {
+		return fmt.Errorf("checkpoints aren't supported by tar deltas")
+	}
+
+	litBuff, err := opts.litBuff()
+	if err != nil {
+		return err
+	}
+
+	err = writeDeltaHeader(output, opts.header())
+	if err != nil {
+		return err
+	}
+
+	m := opts.newMatch(output, litBuff)
+	err = readTar(input, func(e *tarEntry) error {
+		old := sig.Entries[e.name]
+		if e.trailer {
+			old = sig.Trailer
+		}
+
+		if old != nil && old.MetaLen > 0 && bytes.Equal(old.MetaSum, tarMetaSum(e.meta)) {
+			err := m.add(MATCH_KIND_COPY, old.MetaOffset, old.MetaLen)
+			if err != nil {
+				return err
+			}
+		} else {
+			for _, b := range e.meta {
+				err := m.add(MATCH_KIND_LITERAL, uint64(b), 1)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if old == nil {
+			// Only the blocks of the entry's previous version are
+			// considered, so there is nothing to match.
+			old = &TarEntrySignature{Blocks: &SignatureType{
+				SigType:   sig.SigType,
+				BlockLen:  sig.BlockLen,
+				StrongLen: sig.StrongLen,
+			}}
+		}
+		return scan(old.Blocks, bufio.NewReader(e.data), &m, old.DataOffset(), nil, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := m.flush(); err != nil {
+		return err
+	}
+
+	if opts.Stats != nil {
+		*opts.Stats = m.stats
+	}
+
+	return binary.Write(output, binary.BigEndian, OP_END)
+}
@@ -0,0 +1,169 @@
+package librsync
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tarFile struct {
+	name  string
+	data  []byte
+	mtime time.Time
+}
+
+func makeTar(t *testing.T, format tar.Format, files []tarFile) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, f := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Mode:     0644,
+			Size:     int64(len(f.data)),
+			ModTime:  f.mtime,
+			Format:   format,
+		}))
+		_, err := tw.Write(f.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func tarFiles() []tarFile {
+	rnd := rand.New(rand.NewSource(1))
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var files []tarFile
+	for i, size := range []int{0, 100, 511, 512, 3000, 20000, 70000, 5} {
+		data := make([]byte, size)
+		rnd.Read(data)
+		files = append(files, tarFile{
+			name:  strings.Repeat("dir/", i*10) + "file" + string(rune('a'+i)),
+			data:  data,
+			mtime: mtime,
+		})
+	}
+	return files
+}
+
+// TestTarDelta checks that tar deltas reassemble the new archive exactly, and
+// only send what changed.
+func TestTarDelta(t *testing.T) {
+	for _, format := range []tar.Format{tar.FormatUSTAR, tar.FormatPAX, tar.FormatGNU} {
+		t.Run(format.String(), func(t *testing.T) {
+			r := require.New(t)
+			a := assert.New(t)
+
+			oldFiles := tarFiles()
+			if format == tar.FormatUSTAR {
+				// USTAR can't hold names that long.
+				for i := range oldFiles {
+					oldFiles[i].name = oldFiles[i].name[len(oldFiles[i].name)-5:]
+				}
+			}
+			old := makeTar(t, format, oldFiles)
+
+			inserted := make([]byte, 1234)
+			rand.New(rand.NewSource(2)).Read(inserted)
+			newFiles := append([]tarFile{{name: "inserted", data: inserted}}, oldFiles...)
+			newFiles[4].data = append([]byte{}, newFiles[4].data...)
+			newFiles[4].data[0] ^= 0xff
+			newFiles[6].data = append([]byte("prepended"), newFiles[6].data...)
+			newFiles[5].mtime = newFiles[5].mtime.Add(time.Hour)
+			newFiles = append(newFiles[:7], newFiles[8:]...)
+			newTar := makeTar(t, format, newFiles)
+
+			sigBuf := &bytes.Buffer{}
+			sig, err := TarSignature(bytes.NewReader(old), sigBuf, 2048, 32, BLAKE2_SIG_MAGIC)
+			r.NoError(err)
+			a.Len(sig.Entries, len(oldFiles))
+
+			readSig, err := ReadTarSignature(bytes.NewReader(sigBuf.Bytes()))
+			r.NoError(err)
+			a.Equal(sig, readSig)
+
+			var stats DeltaStats
+			delta := &bytes.Buffer{}
+			r.NoError(TarDelta(readSig, bytes.NewReader(newTar), delta, DeltaOptions{Stats: &stats}))
+
+			output := &bytes.Buffer{}
+			r.NoError(Patch(bytes.NewReader(old), bytes.NewReader(delta.Bytes()), output))
+			a.Equal(newTar, output.Bytes())
+
+			// The inserted file, the changed headers and the blocks around
+			// changes in data.
+			a.Less(stats.LitBytes, uint64(len(inserted)+8*1024))
+
+			plainSig, err := Signature(bytes.NewReader(old), &bytes.Buffer{}, 2048, 32, BLAKE2_SIG_MAGIC)
+			r.NoError(err)
+			plainDelta := &bytes.Buffer{}
+			r.NoError(Delta(plainSig, bytes.NewReader(newTar), plainDelta))
+			a.Less(delta.Len(), plainDelta.Len())
+		})
+	}
+}
+
+func TestTarDeltaUnchanged(t *testing.T) {
+	r := require.New(t)
+
+	old := makeTar(t, tar.FormatPAX, tarFiles())
+	sig, err := TarSignature(bytes.NewReader(old), &bytes.Buffer{}, 2048, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+
+	var stats DeltaStats
+	delta := &bytes.Buffer{}
+	r.NoError(TarDelta(sig, bytes.NewReader(old), delta, DeltaOptions{Stats: &stats}))
+	r.Equal(uint64(1), stats.CopyCmds)
+	r.Equal(uint64(len(old)), stats.CopyBytes)
+	r.Equal(uint64(0), stats.LitBytes)
+}
+
+func TestTarDeltaUnsupportedOptions(t *testing.T) {
+	r := require.New(t)
+
+	old := makeTar(t, tar.FormatPAX, tarFiles())
+	sig, err := TarSignature(bytes.NewReader(old), &bytes.Buffer{}, 2048, 32, BLAKE2_SIG_MAGIC)
+	r.NoError(err)
+
+	for _, opts := range []DeltaOptions{
+		{TargetCopies: true},
+		{OrderedCopies: true},
+		{Checkpoint: func(*DeltaCheckpoint) error { return nil }},
+	} {
+		r.Error(TarDelta(sig, bytes.NewReader(old), &bytes.Buffer{}, opts))
+	}
+}
+
+func TestTarSignatureInvalid(t *testing.T) {
+	r := require.New(t)
+
+	notTar := bytes.Repeat([]byte("not a tar archive"), 100)
+	_, err := TarSignature(bytes.NewReader(notTar), &bytes.Buffer{}, 512, 32, BLAKE2_SIG_MAGIC)
+	r.Error(err)
+
+	_, err = ReadTarSignature(bytes.NewReader(notTar))
+	r.Error(err)
+
+	// Headers which can't be used to compute deltas.
+	for _, header := range [][3]uint32{
+		{uint32(BLAKE2_SIG_MAGIC), 0, 32},
+		{uint32(BLAKE2_SIG_MAGIC), 512, 64},
+		{uint32(MD4_SIG_MAGIC), 512, 17},
+		{0x12345678, 512, 8},
+	} {
+		buf := &bytes.Buffer{}
+		r.NoError(binary.Write(buf, binary.BigEndian, TAR_SIG_MAGIC))
+		r.NoError(binary.Write(buf, binary.BigEndian, header))
+		_, err = ReadTarSignature(buf)
+		r.ErrorIs(err, ErrInvalidSignature, "%v", header)
+	}
+}
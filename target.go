@@ -0,0 +1,169 @@
+package librsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Size of the chunks used when copying data from the output to itself.
+const targetCopyChunkSize = 64 * 1024
+
+// Target blocks are verified with a full BLAKE2 sum, regardless of the strong
+// sum used by the signature: there is no signature size to be saved here.
+const (
+	targetSigType   = BLAKE2_SIG_MAGIC
+	targetStrongLen = BLAKE2_SUM_LENGTH
+)
+
+type targetBlock struct {
+	weak   uint32
+	pos    uint64
+	strong [targetStrongLen]byte
+}
+
+// targetIndex indexes the blocks of the new file while a delta is generated,
+// so that later occurrences of the same data can be encoded as target copies.
+type targetIndex struct {
+	blockLen uint32
+
+	// Maximum number of blocks indexed, or 0 for no limit.
+	maxBlocks int
+
+	// Block of the new file being accumulated and its position.
+	block []byte
+	pos   uint64
+
+	// Complete blocks which were not entirely encoded yet, and thus cannot be
+	// referenced.
+	pending []targetBlock
+
+	weak2block map[uint32]targetBlock
+
+	// Last length passed to emitted.
+	emittedTo uint64
+}
+
+func newTargetIndex(blockLen uint32, maxBlocks int) *targetIndex {
+	return &targetIndex{
+		blockLen:   blockLen,
+		maxBlocks:  maxBlocks,
+		block:      make([]byte, 0, blockLen),
+		weak2block: make(map[uint32]targetBlock),
+	}
+}
+
+// add appends the next byte of the new file.
+func (t *targetIndex) add(b byte) {
+	t.block = append(t.block, b)
+	if len(t.block) < int(t.blockLen) {
+		return
+	}
+
+	block := targetBlock{weak: WeakChecksum(t.block), pos: t.pos}
+	strong, _ := CalcStrongSum(t.block, targetSigType, targetStrongLen)
+	copy(block.strong[:], strong)
+	t.pending = append(t.pending, block)
+	t.pos += uint64(t.blockLen)
+	t.block = t.block[:0]
+}
+
+// emitted tells that the first n bytes of the new file have been encoded, so
+// that the blocks within them can be referenced. Once the index is full, only
+// blocks replacing indexed ones with the same weak sum are added.
+func (t *targetIndex) emitted(n uint64) {
+	t.emittedTo = n
+	i := 0
+	for ; i < len(t.pending) && t.pending[i].pos+uint64(t.blockLen) <= n; i++ {
+		b := t.pending[i]
+		if _, ok := t.weak2block[b.weak]; ok || t.maxBlocks <= 0 || len(t.weak2block) < t.maxBlocks {
+			t.weak2block[b.weak] = b
+		}
+	}
+	t.pending = append(t.pending[:0], t.pending[i:]...)
+}
+
+// find looks for an already encoded block of the new file with the given
+// contents, returning its position.
+func (t *targetIndex) find(weak uint32, data []byte) (uint64, bool) {
+	b, ok := t.weak2block[weak]
+	if !ok {
+		return 0, false
+	}
+	strong, _ := CalcStrongSum(data, targetSigType, targetStrongLen)
+	if !bytes.Equal(b.strong[:], strong) {
+		return 0, false
+	}
+	return b.pos, true
+}
+
+// readable tells if the output ra can be read back for target copies. Files
+// opened for writing only implement io.ReaderAt too, but fail to read, so a
+// byte is read to check.
+func readable(ra io.ReaderAt) bool {
+	var b [1]byte
+	_, err := ra.ReadAt(b[:], 0)
+	return err == nil || err == io.EOF
+}
+
+// outputHistory keeps a copy of everything written through it, so that target
+// copies can be served when the output itself cannot be read back.
+type outputHistory struct {
+	w    io.Writer
+	data []byte
+}
+
+func (h *outputHistory) Write(p []byte) (int, error) {
+	h.data = append(h.data, p...)
+	return h.w.Write(p)
+}
+
+func (h *outputHistory) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(h.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// copyTarget writes to out n bytes found at pos in target, which holds the
+// first written bytes sent to out. The source and destination ranges
+// may overlap, in which case data is copied in chunks small enough so that
+// each byte is written before being read.
+func copyTarget(out io.Writer, target io.ReaderAt, pos, n, written int64) error {
+	if pos < 0 || n < 0 || pos >= written {
+		return fmt.Errorf("target copy of %d bytes from %d, but output has only %d bytes", n, pos, written)
+	}
+
+	buf := make([]byte, targetCopyChunkSize)
+	for n > 0 {
+		size := int64(len(buf))
+		if size > n {
+			size = n
+		}
+		if size > written-pos {
+			size = written - pos
+		}
+
+		nr, err := target.ReadAt(buf[:size], pos)
+		if int64(nr) < size {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		_, err = out.Write(buf[:size])
+		if err != nil {
+			return err
+		}
+
+		pos += size
+		written += size
+		n -= size
+	}
+
+	return nil
+}
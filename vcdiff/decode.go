@@ -0,0 +1,273 @@
+package vcdiff
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// ToDelta converts the VCDIFF read from r into a librsync delta, written to w.
+//
+// VCDIFF files using only ADD instructions and COPY instructions from a source
+// segment are converted to plain librsync deltas. RUN instructions and copies
+// from the target need librsync-go extensions (FILL commands and target
+// copies). As the delta header depends on this, the converted delta is kept
+// in memory until the whole input has been read.
+func ToDelta(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	err := readHeader(br)
+	if err != nil {
+		return err
+	}
+
+	var ops []librsync.DeltaOp
+	var start uint64
+	var cache addrCache
+
+	for {
+		ind, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		win, err := readWindow(br, ind)
+		if err != nil {
+			return err
+		}
+		ops, err = win.decode(ops, start, &cache)
+		if err != nil {
+			return err
+		}
+		start += win.targetLen
+	}
+
+	var opts librsync.DeltaOptions
+	for _, op := range ops {
+		switch op.Kind {
+		case librsync.KIND_TARGET_COPY:
+			opts.TargetCopies = true
+		case librsync.KIND_FILL:
+			opts.Fill = true
+		}
+	}
+
+	dw, err := librsync.NewDeltaWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		err = dw.Write(op)
+		if err != nil {
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+func readHeader(br *bufio.Reader) error {
+	var hdr [5]byte
+	_, err := io.ReadFull(br, hdr[:])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:4], magic) {
+		return ErrBadMagic
+	}
+
+	ind := hdr[4]
+	if ind&(VCD_DECOMPRESS|VCD_CODETABLE) != 0 || ind&^(VCD_DECOMPRESS|VCD_CODETABLE|VCD_APPHEADER) != 0 {
+		return ErrUnsupported
+	}
+	if ind&VCD_APPHEADER != 0 {
+		size, err := readVarint(br)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(ioutil.Discard, br, int64(size))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type window struct {
+	ind       byte
+	srcLen    uint64
+	srcPos    uint64
+	targetLen uint64
+
+	data, inst, addr []byte
+}
+
+func readWindow(br *bufio.Reader, ind byte) (*window, error) {
+	if ind&^(VCD_SOURCE|VCD_TARGET|VCD_ADLER32) != 0 {
+		return nil, ErrUnsupported
+	}
+	if ind&VCD_SOURCE != 0 && ind&VCD_TARGET != 0 {
+		return nil, ErrCorrupt
+	}
+
+	win := &window{ind: ind}
+	var err error
+
+	if ind&(VCD_SOURCE|VCD_TARGET) != 0 {
+		win.srcLen, err = readVarint(br)
+		if err != nil {
+			return nil, err
+		}
+		win.srcPos, err = readVarint(br)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deltaLen, err := readVarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Grow the buffer as data arrives, rather than trusting the length.
+	var enc bytes.Buffer
+	_, err = io.CopyN(&enc, br, int64(deltaLen))
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	er := bytes.NewReader(enc.Bytes())
+	win.targetLen, err = readVarint(er)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	deltaInd, err := er.ReadByte()
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	if deltaInd != 0 {
+		// Secondary compression of the sections.
+		return nil, ErrUnsupported
+	}
+
+	var lens [3]uint64
+	for i := range lens {
+		lens[i], err = readVarint(er)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+	}
+
+	if ind&VCD_ADLER32 != 0 {
+		// We don't have the target data to verify the checksum.
+		var sum [4]byte
+		_, err = io.ReadFull(er, sum[:])
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+	}
+
+	rest := enc.Bytes()[len(enc.Bytes())-er.Len():]
+	if uint64(len(rest)) != lens[0]+lens[1]+lens[2] {
+		return nil, ErrCorrupt
+	}
+	win.data = rest[:lens[0]]
+	win.inst = rest[lens[0] : lens[0]+lens[1]]
+	win.addr = rest[lens[0]+lens[1]:]
+
+	return win, nil
+}
+
+// decode appends to ops the commands of the window, which starts at position
+// start of the target.
+func (win *window) decode(ops []librsync.DeltaOp, start uint64, cache *addrCache) ([]librsync.DeltaOp, error) {
+	cache.reset()
+
+	inst := bytes.NewReader(win.inst)
+	addrs := bytes.NewReader(win.addr)
+	data := win.data
+
+	// Position within the target window.
+	var pos uint64
+
+	for inst.Len() > 0 {
+		code, _ := inst.ReadByte()
+
+		for _, in := range codeTable[code] {
+			if in.typ == NOOP {
+				continue
+			}
+
+			size := uint64(in.size)
+			if size == 0 {
+				var err error
+				size, err = readVarint(inst)
+				if err != nil {
+					return nil, ErrCorrupt
+				}
+			}
+			if size > win.targetLen-pos {
+				return nil, ErrCorrupt
+			}
+
+			switch in.typ {
+			case ADD:
+				if size > uint64(len(data)) {
+					return nil, ErrCorrupt
+				}
+				ops = append(ops, librsync.DeltaOp{Kind: librsync.KIND_LITERAL, Len: size, Data: data[:size]})
+				data = data[size:]
+			case RUN:
+				if len(data) == 0 {
+					return nil, ErrCorrupt
+				}
+				ops = append(ops, librsync.DeltaOp{Kind: librsync.KIND_FILL, Len: size, Value: data[0]})
+				data = data[1:]
+			case COPY:
+				addr, err := cache.decode(win.srcLen+pos, in.mode, addrs)
+				if err != nil {
+					return nil, err
+				}
+				ops = win.appendCopy(ops, start, addr, size)
+			}
+
+			pos += size
+		}
+	}
+
+	if pos != win.targetLen {
+		return nil, ErrCorrupt
+	}
+	return ops, nil
+}
+
+// appendCopy appends to ops the commands copying size bytes from addr.
+func (win *window) appendCopy(ops []librsync.DeltaOp, start, addr, size uint64) []librsync.DeltaOp {
+	if addr < win.srcLen {
+		n := win.srcLen - addr
+		if n > size {
+			n = size
+		}
+
+		// The source segment comes from the target with VCD_TARGET.
+		kind := librsync.KIND_COPY
+		if win.ind&VCD_TARGET != 0 {
+			kind = librsync.KIND_TARGET_COPY
+		}
+		ops = append(ops, librsync.DeltaOp{Kind: kind, Pos: win.srcPos + addr, Len: n})
+
+		addr += n
+		size -= n
+	}
+
+	if size > 0 {
+		ops = append(ops, librsync.DeltaOp{Kind: librsync.KIND_TARGET_COPY, Pos: start + addr - win.srcLen, Len: size})
+	}
+	return ops
+}
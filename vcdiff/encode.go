@@ -0,0 +1,213 @@
+package vcdiff
+
+import (
+	"io"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// Options controls how FromDelta generates VCDIFF.
+type Options struct {
+	// WindowSize is the maximum number of target bytes encoded by each
+	// window. Zero means DefaultWindowSize.
+	WindowSize uint64
+}
+
+// FromDelta converts the librsync delta read from delta into VCDIFF, written
+// to w. opts may be nil.
+//
+// Commands are split into windows of at most opts.WindowSize target bytes,
+// each with a source segment covering all the data it copies from the basis.
+// Target copies must stay within a single window, otherwise
+// ErrTargetCopyInWindow is returned. Deltas of gzip files generated by
+// librsync.GzipDelta, or using a librsync.Filter, can't be converted.
+func FromDelta(delta io.Reader, w io.Writer, opts *Options) error {
+	dr, err := librsync.NewDeltaReader(delta)
+	if err != nil {
+		return err
+	}
+	if dr.Flags()&(librsync.DELTA_FLAG_GZIP|librsync.DELTA_FLAG_FILTER) != 0 {
+		// The commands apply to decompressed or filtered data.
+		return ErrUnsupported
+	}
+
+	windowSize := uint64(DefaultWindowSize)
+	if opts != nil && opts.WindowSize != 0 {
+		windowSize = opts.WindowSize
+	}
+
+	// Header, without any optional feature.
+	_, err = w.Write([]byte{magic[0], magic[1], magic[2], magic[3], 0})
+	if err != nil {
+		return err
+	}
+
+	e := &windowEncoder{w: w, size: windowSize}
+	for {
+		op, err := dr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		err = e.add(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.flush()
+}
+
+// windowEncoder accumulates delta commands and writes them as VCDIFF windows.
+type windowEncoder struct {
+	w    io.Writer
+	size uint64
+
+	// Position of the window within the target, and the commands in it.
+	start     uint64
+	ops       []librsync.DeltaOp
+	targetLen uint64
+}
+
+// add appends a command to the window, splitting it between windows as needed.
+func (e *windowEncoder) add(op librsync.DeltaOp) error {
+	for op.Len > 0 {
+		if e.targetLen == e.size {
+			err := e.flush()
+			if err != nil {
+				return err
+			}
+		}
+
+		part := op
+		if room := e.size - e.targetLen; part.Len > room {
+			part.Len = room
+		}
+
+		switch op.Kind {
+		case librsync.KIND_LITERAL:
+			part.Data = op.Data[:part.Len]
+			op.Data = op.Data[part.Len:]
+		case librsync.KIND_COPY, librsync.KIND_TARGET_COPY:
+			op.Pos += part.Len
+		}
+		op.Len -= part.Len
+
+		e.ops = append(e.ops, part)
+		e.targetLen += part.Len
+	}
+	return nil
+}
+
+// flush writes the pending commands as a window.
+func (e *windowEncoder) flush() error {
+	if len(e.ops) == 0 {
+		return nil
+	}
+
+	// The source segment covers all copies from the basis.
+	var srcStart, srcEnd uint64
+	hasSource := false
+	for _, op := range e.ops {
+		if op.Kind != librsync.KIND_COPY {
+			continue
+		}
+		if !hasSource || op.Pos < srcStart {
+			srcStart = op.Pos
+		}
+		if !hasSource || op.Pos+op.Len > srcEnd {
+			srcEnd = op.Pos + op.Len
+		}
+		hasSource = true
+	}
+	srcLen := srcEnd - srcStart
+
+	var data, inst, addrs []byte
+
+	// Address of the next target byte. Addresses start with the source
+	// segment, followed by the target window.
+	here := srcLen
+
+	for _, op := range e.ops {
+		switch op.Kind {
+		case librsync.KIND_LITERAL:
+			data = append(data, op.Data...)
+			inst = appendInstruction(inst, ADD, op.Len, 0)
+		case librsync.KIND_FILL:
+			data = append(data, op.Value)
+			inst = appendInstruction(inst, RUN, op.Len, 0)
+		case librsync.KIND_COPY, librsync.KIND_TARGET_COPY:
+			var addr uint64
+			if op.Kind == librsync.KIND_COPY {
+				addr = op.Pos - srcStart
+			} else {
+				if op.Pos < e.start {
+					return ErrTargetCopyInWindow
+				}
+				addr = srcLen + op.Pos - e.start
+			}
+
+			// Pick the address mode with the shortest encoding.
+			mode, v := uint8(VCD_SELF), addr
+			if varintLen(here-addr) < varintLen(addr) {
+				mode, v = VCD_HERE, here-addr
+			}
+			inst = appendInstruction(inst, COPY, op.Len, mode)
+			addrs = appendVarint(addrs, v)
+		}
+		here += op.Len
+	}
+
+	var win []byte
+	if hasSource {
+		win = append(win, VCD_SOURCE)
+		win = appendVarint(win, srcLen)
+		win = appendVarint(win, srcStart)
+	} else {
+		win = append(win, 0)
+	}
+
+	var enc []byte
+	enc = appendVarint(enc, e.targetLen)
+	enc = append(enc, 0) // Delta_Indicator: no compressed sections
+	enc = appendVarint(enc, uint64(len(data)))
+	enc = appendVarint(enc, uint64(len(inst)))
+	enc = appendVarint(enc, uint64(len(addrs)))
+
+	win = appendVarint(win, uint64(len(enc)+len(data)+len(inst)+len(addrs)))
+	win = append(win, enc...)
+
+	for _, b := range [][]byte{win, data, inst, addrs} {
+		_, err := e.w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.start += e.targetLen
+	e.targetLen = 0
+	e.ops = e.ops[:0]
+	return nil
+}
+
+// appendInstruction appends to inst the code of a single instruction, followed
+// by its size unless the default code table has a code including it.
+func appendInstruction(inst []byte, typ uint8, size uint64, mode uint8) []byte {
+	switch typ {
+	case RUN:
+		return appendVarint(append(inst, 0), size)
+	case ADD:
+		if size >= 1 && size <= 17 {
+			return append(inst, byte(1+size))
+		}
+		return appendVarint(append(inst, 1), size)
+	case COPY:
+		code := 19 + 16*mode
+		if size >= 4 && size <= 18 {
+			return append(inst, code+byte(size-3))
+		}
+		return appendVarint(append(inst, code), size)
+	}
+	return inst
+}
@@ -0,0 +1,210 @@
+// Package vcdiff converts deltas between the librsync format and VCDIFF, as
+// specified by RFC 3284 and produced by tools like xdelta3 and open-vcdiff.
+//
+// librsync COPY commands map to VCDIFF COPY instructions from the source
+// segment, and LITERAL commands map to ADD instructions. The librsync-go
+// extensions map to VCDIFF features too: FILL commands become RUN
+// instructions, and target copies become COPY instructions from the target
+// window (this only works for copies within the same window).
+//
+// Only the default code table is supported, and secondary compression of the
+// VCDIFF sections is not.
+package vcdiff
+
+import (
+	"errors"
+	"io"
+)
+
+// Magic bytes at the start of every VCDIFF file.
+var magic = []byte{0xd6, 0xc3, 0xc4, 0x00}
+
+// Bits of the header indicator.
+const (
+	VCD_DECOMPRESS = 0x01
+	VCD_CODETABLE  = 0x02
+	VCD_APPHEADER  = 0x04 // xdelta3 extension
+)
+
+// Bits of the window indicator.
+const (
+	VCD_SOURCE  = 0x01
+	VCD_TARGET  = 0x02
+	VCD_ADLER32 = 0x04 // xdelta3 extension
+)
+
+// Instruction types.
+const (
+	NOOP = iota
+	ADD
+	RUN
+	COPY
+)
+
+// Address modes, in the default cache configuration.
+const (
+	VCD_SELF = 0
+	VCD_HERE = 1
+
+	nearSize = 4
+	sameSize = 3
+)
+
+// DefaultWindowSize is the default maximum number of target bytes encoded by
+// each VCDIFF window.
+const DefaultWindowSize = 8 * 1024 * 1024
+
+var (
+	ErrBadMagic           = errors.New("vcdiff: bad magic number")
+	ErrUnsupported        = errors.New("vcdiff: unsupported feature")
+	ErrCorrupt            = errors.New("vcdiff: corrupt data")
+	ErrTargetCopyInWindow = errors.New("vcdiff: target copy crosses window boundary")
+)
+
+type instruction struct {
+	typ  uint8
+	size uint8
+	mode uint8
+}
+
+// The default code table, from section 5.6 of RFC 3284.
+var codeTable = defaultCodeTable()
+
+func defaultCodeTable() (t [256][2]instruction) {
+	i := 0
+	t[i][0] = instruction{RUN, 0, 0}
+	i++
+	for size := 0; size <= 17; size++ {
+		t[i][0] = instruction{ADD, uint8(size), 0}
+		i++
+	}
+	for mode := 0; mode <= 8; mode++ {
+		t[i][0] = instruction{COPY, 0, uint8(mode)}
+		i++
+		for size := 4; size <= 18; size++ {
+			t[i][0] = instruction{COPY, uint8(size), uint8(mode)}
+			i++
+		}
+	}
+	for mode := 0; mode <= 5; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				t[i][0] = instruction{ADD, uint8(addSize), 0}
+				t[i][1] = instruction{COPY, uint8(copySize), uint8(mode)}
+				i++
+			}
+		}
+	}
+	for mode := 6; mode <= 8; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			t[i][0] = instruction{ADD, uint8(addSize), 0}
+			t[i][1] = instruction{COPY, 4, uint8(mode)}
+			i++
+		}
+	}
+	for mode := 0; mode <= 8; mode++ {
+		t[i][0] = instruction{COPY, 4, uint8(mode)}
+		t[i][1] = instruction{ADD, 1, 0}
+		i++
+	}
+	return
+}
+
+// addrCache is the address cache of section 5.1 of RFC 3284.
+type addrCache struct {
+	near     [nearSize]uint64
+	nextSlot int
+	same     [sameSize * 256]uint64
+}
+
+func (c *addrCache) reset() {
+	*c = addrCache{}
+}
+
+func (c *addrCache) update(addr uint64) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % nearSize
+	c.same[addr%(sameSize*256)] = addr
+}
+
+// decode reads from addrs the address of a COPY at here, with the given mode.
+func (c *addrCache) decode(here uint64, mode uint8, addrs io.ByteReader) (uint64, error) {
+	var addr uint64
+
+	switch {
+	case mode == VCD_SELF:
+		v, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+		addr = v
+	case mode == VCD_HERE:
+		v, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+		if v > here {
+			return 0, ErrCorrupt
+		}
+		addr = here - v
+	case mode < 2+nearSize:
+		v, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+		addr = c.near[mode-2] + v
+	case mode < 2+nearSize+sameSize:
+		b, err := addrs.ReadByte()
+		if err != nil {
+			return 0, ErrCorrupt
+		}
+		addr = c.same[int(mode-2-nearSize)*256+int(b)]
+	default:
+		return 0, ErrCorrupt
+	}
+
+	if addr >= here {
+		return 0, ErrCorrupt
+	}
+	c.update(addr)
+	return addr, nil
+}
+
+// appendVarint appends v to b, encoded as a VCDIFF integer: base 128, most
+// significant digit first, with the high bit set on all bytes but the last.
+func appendVarint(b []byte, v uint64) []byte {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, tmp[i:]...)
+}
+
+func varintLen(v uint64) int {
+	n := 1
+	for v >>= 7; v > 0; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+func readVarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if v > (1<<64-1)>>7 {
+			return 0, ErrCorrupt
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, ErrCorrupt
+}
@@ -0,0 +1,165 @@
+package vcdiff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/balena-os/librsync-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var allTestCases = []string{
+	"000-blake2-11-23",
+	"001-blake2-776-31",
+	"002-md4-128-16",
+	"003-blake2-1024-13",
+	"004-blake2-2222-31",
+	"005-md4-999-14",
+	"006-blake2-2-32",
+	"007-blake2-4-32",
+	"008-md4-111-11",
+	"009-blake2-2048-26",
+	"010-blake2-7-6",
+	"011-md4-3-9",
+}
+
+func patch(t *testing.T, base []byte, delta []byte) []byte {
+	output := &bytes.Buffer{}
+	err := librsync.Patch(bytes.NewReader(base), bytes.NewReader(delta), output)
+	require.NoError(t, err)
+
+	got, err := ioutil.ReadAll(output)
+	require.NoError(t, err)
+	return got
+}
+
+// TestRoundTrip converts the reference deltas to VCDIFF and back, using
+// windows of several sizes, and checks that they still patch correctly.
+func TestRoundTrip(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	for _, windowSize := range []uint64{0, 1, 100, 4096} {
+		for _, tt := range allTestCases {
+			t.Run(tt, func(t *testing.T) {
+				file := strings.Split(tt, "-")[0]
+
+				delta, err := ioutil.ReadFile("../testdata/" + tt + ".delta")
+				r.NoError(err)
+				base, err := ioutil.ReadFile("../testdata/" + file + ".old")
+				r.NoError(err)
+				want, err := ioutil.ReadFile("../testdata/" + file + ".new")
+				r.NoError(err)
+
+				vcd := &bytes.Buffer{}
+				r.NoError(FromDelta(bytes.NewReader(delta), vcd, &Options{WindowSize: windowSize}))
+				a.Equal(magic, vcd.Bytes()[:4])
+
+				converted := &bytes.Buffer{}
+				r.NoError(ToDelta(vcd, converted))
+				a.Equal(uint32(librsync.DELTA_MAGIC), readMagic(converted.Bytes()))
+				a.Equal(want, patch(t, base, converted.Bytes()))
+			})
+		}
+	}
+}
+
+func readMagic(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// TestRoundTripExtensions checks the conversion of FILL commands and target
+// copies.
+func TestRoundTripExtensions(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	base := []byte("0123456789")
+	delta := &bytes.Buffer{}
+	dw, err := librsync.NewDeltaWriter(delta, librsync.DeltaOptions{TargetCopies: true, Fill: true})
+	r.NoError(err)
+	for _, op := range []librsync.DeltaOp{
+		{Kind: librsync.KIND_COPY, Pos: 2, Len: 3},
+		{Kind: librsync.KIND_LITERAL, Data: []byte("abc"), Len: 3},
+		{Kind: librsync.KIND_FILL, Value: 'z', Len: 100},
+		{Kind: librsync.KIND_TARGET_COPY, Pos: 1, Len: 6},
+	} {
+		r.NoError(dw.Write(op))
+	}
+	r.NoError(dw.Close())
+	want := patch(t, base, delta.Bytes())
+
+	vcd := &bytes.Buffer{}
+	r.NoError(FromDelta(bytes.NewReader(delta.Bytes()), vcd, nil))
+	converted := &bytes.Buffer{}
+	r.NoError(ToDelta(bytes.NewReader(vcd.Bytes()), converted))
+	a.Equal(uint32(librsync.DELTA_EXT_MAGIC), readMagic(converted.Bytes()))
+	a.Equal(want, patch(t, base, converted.Bytes()))
+
+	// The target copy would cross windows.
+	err = FromDelta(bytes.NewReader(delta.Bytes()), ioutil.Discard, &Options{WindowSize: 50})
+	a.Equal(ErrTargetCopyInWindow, err)
+}
+
+// TestDecodeHandcrafted decodes a VCDIFF file using the features we don't
+// generate ourselves: combined instructions and the address cache.
+func TestDecodeHandcrafted(t *testing.T) {
+	r := require.New(t)
+	a := assert.New(t)
+
+	source := []byte("abcdefghijklmnop")
+	vcd := []byte{
+		0xd6, 0xc3, 0xc4, 0x00, 0x00, // header
+		VCD_SOURCE, 16, 0, // source segment: 16 bytes at 0
+		21,                           // length of the delta encoding
+		33,                           // target window length
+		0,                            // delta indicator
+		6,                            // data length
+		6,                            // instructions length
+		4,                            // addresses length
+		'w', 'x', 'y', 'z', 'z', '!', // data
+		20,   // COPY 4, mode SELF
+		184,  // ADD 4 + COPY 4, mode HERE
+		76,   // COPY 12, mode near[1]
+		0, 4, // RUN 4
+		253, // COPY 4, mode same[0] + ADD 1
+		0,   // addr 0
+		20,  // addr 24 - 20 = 4
+		20,  // addr near[1] + 20 = 24
+		4,   // addr same[4] = 4
+	}
+
+	delta := &bytes.Buffer{}
+	r.NoError(ToDelta(bytes.NewReader(vcd), delta))
+	a.Equal("abcdwxyzefghefghefghefghzzzzefgh!", string(patch(t, source, delta.Bytes())))
+
+	// Truncated
+	err := ToDelta(bytes.NewReader(vcd[:len(vcd)-1]), ioutil.Discard)
+	a.Error(err)
+
+	// Bad magic
+	err = ToDelta(bytes.NewReader([]byte{1, 2, 3, 4, 0}), ioutil.Discard)
+	a.Equal(ErrBadMagic, err)
+
+	// Custom code table
+	err = ToDelta(bytes.NewReader([]byte{0xd6, 0xc3, 0xc4, 0x00, VCD_CODETABLE}), ioutil.Discard)
+	a.Equal(ErrUnsupported, err)
+}
+
+func TestVarint(t *testing.T) {
+	a := assert.New(t)
+
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1 << 40, 1<<64 - 1} {
+		b := appendVarint(nil, v)
+		a.Equal(varintLen(v), len(b))
+		got, err := readVarint(bytes.NewReader(b))
+		a.NoError(err)
+		a.Equal(v, got)
+	}
+
+	// Example from RFC 3284
+	a.Equal([]byte{0xba, 0xef, 0x9a, 0x15}, appendVarint(nil, 123456789))
+}
@@ -0,0 +1,312 @@
+package zsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/balena-os/circbuf"
+	"github.com/balena-os/librsync-go"
+)
+
+// Default of Client.MaxBlockLen.
+const DEFAULT_MAX_BLOCK_LEN = 1024 * 1024
+
+// Output is where a Client reconstructs the target. *os.File satisfies it.
+type Output interface {
+	io.WriterAt
+	io.ReaderAt
+}
+
+// Client reconstructs targets described by control files.
+type Client struct {
+	// HTTP client used for all requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Maximum number of bytes requested by a single range request. Adjacent
+	// missing blocks are merged into one request up to this size. If zero,
+	// there is no limit.
+	MaxRangeSize int64
+
+	// Control files with blocks larger than this are refused, as a block is
+	// kept in memory while scanning the seed and fetching. If zero,
+	// DEFAULT_MAX_BLOCK_LEN is used.
+	MaxBlockLen uint32
+}
+
+// SyncStats reports how a target was reconstructed.
+type SyncStats struct {
+	SeedBlocks    int64
+	FetchedBlocks int64
+	FetchedBytes  int64
+	Requests      int64
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// checkControl checks that the blocks of ctrl aren't too large to be kept in
+// memory.
+func (c *Client) checkControl(ctrl *Control) error {
+	maxBlockLen := c.MaxBlockLen
+	if maxBlockLen == 0 {
+		maxBlockLen = DEFAULT_MAX_BLOCK_LEN
+	}
+	err := librsync.CheckSignature(ctrl.Signature, maxBlockLen)
+	if err != nil {
+		return fmt.Errorf("zsync: %w", err)
+	}
+	return nil
+}
+
+// FetchControl downloads and reads the control file at rawurl. The URL of
+// the target is resolved relative to rawurl, or set to rawurl without its
+// ".zsync" extension if the control file has no URL header.
+func (c *Client) FetchControl(ctx context.Context, rawurl string) (*Control, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("zsync: fetching %s: %s", rawurl, resp.Status)
+	}
+
+	ctrl, err := ReadControl(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkControl(ctrl)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if ctrl.URL == "" {
+		target := *base
+		target.Path = strings.TrimSuffix(base.Path, ".zsync")
+		ctrl.URL = target.String()
+		return ctrl, nil
+	}
+	ref, err := url.Parse(ctrl.URL)
+	if err != nil {
+		return nil, fmt.Errorf("zsync: bad URL header: %w", err)
+	}
+	ctrl.URL = base.ResolveReference(ref).String()
+
+	return ctrl, nil
+}
+
+// Sync reconstructs the target described by ctrl into out. The blocks found
+// in seed are copied from it, and the other ones are fetched from ctrl.URL.
+// seed may be nil, in which case the whole target is fetched.
+//
+// out should be empty or at most as long as the target. The result is verified
+// against the SHA-256 of the control file.
+func (c *Client) Sync(ctx context.Context, ctrl *Control, seed io.Reader, out Output) (*SyncStats, error) {
+	stats := &SyncStats{}
+	err := c.checkControl(ctrl)
+	if err != nil {
+		return stats, err
+	}
+	have := make([]bool, ctrl.blocks())
+
+	if seed != nil {
+		err := c.scanSeed(ctrl, seed, out, have, stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	for i := int64(0); i < int64(len(have)); {
+		if have[i] {
+			i++
+			continue
+		}
+
+		first := i
+		start, end := ctrl.blockRange(i)
+		for i++; i < int64(len(have)) && !have[i]; i++ {
+			_, next := ctrl.blockRange(i)
+			if c.MaxRangeSize > 0 && next-start > c.MaxRangeSize {
+				break
+			}
+			end = next
+		}
+
+		err := c.fetch(ctx, ctrl, first, start, end, out, stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, verify(ctrl, out)
+}
+
+// scanSeed looks for the blocks of the target in seed, writing the ones found
+// to out.
+func (c *Client) scanSeed(ctrl *Control, seed io.Reader, out Output, have []bool, stats *SyncStats) error {
+	sig := ctrl.Signature
+
+	// Identical blocks share a single entry in Weak2block, so find all the
+	// blocks with the same contents.
+	sameBlocks := make(map[string][]int64)
+	for i, strong := range sig.StrongSigs {
+		sameBlocks[string(strong)] = append(sameBlocks[string(strong)], int64(i))
+	}
+
+	r := bufio.NewReader(seed)
+	weakSum := librsync.NewRollsum()
+	block, _ := circbuf.NewBuffer(int64(sig.BlockLen))
+
+	for {
+		in, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var prevByte byte
+		if block.TotalWritten() > 0 {
+			prevByte, err = block.Get(0)
+			if err != nil {
+				return err
+			}
+		}
+		block.WriteByte(in)
+		weakSum.Rollin(in)
+
+		if block.TotalWritten() < int64(sig.BlockLen) {
+			continue
+		}
+		if block.TotalWritten() > int64(sig.BlockLen) {
+			weakSum.Rollout(prevByte)
+		}
+
+		idx, ok := sig.Weak2block[weakSum.Digest()]
+		if !ok {
+			continue
+		}
+		data := block.Bytes()
+		strong, err := librsync.CalcStrongSum(data, sig.SigType, sig.StrongLen)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(strong, sig.StrongSigs[idx]) {
+			continue
+		}
+
+		for _, i := range sameBlocks[string(strong)] {
+			start, end := ctrl.blockRange(i)
+			if have[i] || end-start != int64(len(data)) {
+				continue
+			}
+			_, err = out.WriteAt(data, start)
+			if err != nil {
+				return err
+			}
+			have[i] = true
+			stats.SeedBlocks++
+		}
+
+		weakSum.Reset()
+		block.Reset()
+	}
+}
+
+// fetch downloads the range [start, end) of the target, starting at block
+// first, and writes it to out after checking the sum of each block.
+func (c *Client) fetch(ctx context.Context, ctrl *Control, first, start, end int64, out Output, stats *SyncStats) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ctrl.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	stats.Requests++
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var rstart, rend, size int64
+		_, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &rstart, &rend, &size)
+		if err != nil || rstart != start || rend != end-1 {
+			return fmt.Errorf("zsync: asked for bytes %d-%d of %s, got %q",
+				start, end-1, ctrl.URL, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The server ignored the range, skip to the data we asked for.
+		_, err = io.CopyN(ioutil.Discard, resp.Body, start)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("zsync: fetching %s: %s", ctrl.URL, resp.Status)
+	}
+
+	sig := ctrl.Signature
+	buf := make([]byte, sig.BlockLen)
+	for i := first; start < end; i++ {
+		_, bend := ctrl.blockRange(i)
+		data := buf[:bend-start]
+
+		_, err = io.ReadFull(resp.Body, data)
+		if err != nil {
+			return fmt.Errorf("zsync: reading block %d of %s: %w", i, ctrl.URL, err)
+		}
+		strong, err := librsync.CalcStrongSum(data, sig.SigType, sig.StrongLen)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(strong, sig.StrongSigs[i]) {
+			return fmt.Errorf("zsync: block %d of %s doesn't match the control file", i, ctrl.URL)
+		}
+		_, err = out.WriteAt(data, start)
+		if err != nil {
+			return err
+		}
+
+		stats.FetchedBlocks++
+		stats.FetchedBytes += int64(len(data))
+		start = bend
+	}
+
+	return nil
+}
+
+// verify checks the SHA-256 of the reconstructed target.
+func verify(ctrl *Control, out Output) error {
+	hash := sha256.New()
+	_, err := io.Copy(hash, io.NewSectionReader(out, 0, ctrl.Length))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), ctrl.SHA256) {
+		return fmt.Errorf("zsync: SHA-256 of %s doesn't match the control file", ctrl.Filename)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Package zsync publishes files so that clients can update local copies using
+// plain HTTP servers, in the style of zsync.
+//
+// The publisher generates a control file with WriteControl, and serves it
+// along with the target file. Clients read the control file, find which blocks
+// of the target they already have in a local seed file (usually an older
+// version of the target), and fetch the remaining ones with HTTP range
+// requests.
+//
+// Control files follow the layout of zsync control files: a text header,
+// followed by the block sums. The block sums are a librsync signature of the
+// target, so control files are not compatible with the original zsync tools.
+package zsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// Version written to the "zsync" header of control files.
+const VERSION = "librsync-go-1"
+
+// Control describes a target file.
+type Control struct {
+	Version  string
+	Filename string
+	MTime    time.Time
+	Length   int64
+
+	// URL of the target, possibly relative to the control file.
+	URL string
+
+	// SHA-256 of the whole target.
+	SHA256 []byte
+
+	// Signature of the target, with a sum for every block.
+	Signature *librsync.SignatureType
+}
+
+// ControlOptions sets the contents of a control file generated by
+// WriteControl.
+type ControlOptions struct {
+	Filename string
+	MTime    time.Time
+	URL      string
+
+	// Parameters of the signature, as in librsync.Signature.
+	BlockLen  uint32
+	StrongLen uint32
+	SigType   librsync.MagicNumber
+}
+
+// WriteControl writes to w the control file for the target read from r.
+func WriteControl(w io.Writer, r io.Reader, opts ControlOptions) (*Control, error) {
+	hash := sha256.New()
+	counter := &countingWriter{}
+	sigBuf := &bytes.Buffer{}
+
+	sig, err := librsync.Signature(io.TeeReader(r, io.MultiWriter(hash, counter)), sigBuf,
+		opts.BlockLen, opts.StrongLen, opts.SigType)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Control{
+		Version:   VERSION,
+		Filename:  opts.Filename,
+		MTime:     opts.MTime,
+		Length:    counter.n,
+		URL:       opts.URL,
+		SHA256:    hash.Sum(nil),
+		Signature: sig,
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "zsync: %s\n", c.Version)
+	if c.Filename != "" {
+		fmt.Fprintf(bw, "Filename: %s\n", c.Filename)
+	}
+	if !c.MTime.IsZero() {
+		fmt.Fprintf(bw, "MTime: %s\n", c.MTime.UTC().Format(time.RFC1123Z))
+	}
+	fmt.Fprintf(bw, "Blocksize: %d\n", sig.BlockLen)
+	fmt.Fprintf(bw, "Length: %d\n", c.Length)
+	if c.URL != "" {
+		fmt.Fprintf(bw, "URL: %s\n", c.URL)
+	}
+	fmt.Fprintf(bw, "SHA-256: %s\n", hex.EncodeToString(c.SHA256))
+	fmt.Fprintf(bw, "\n")
+
+	_, err = bw.Write(sigBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return c, bw.Flush()
+}
+
+// ReadControl reads a control file.
+func ReadControl(r io.Reader) (*Control, error) {
+	br := bufio.NewReader(r)
+	c := &Control{}
+	blockLen := int64(-1)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("zsync: reading control header: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return nil, fmt.Errorf("zsync: bad control header line %q", line)
+		}
+		key, value := line[:i], line[i+2:]
+
+		switch key {
+		case "zsync":
+			c.Version = value
+		case "Filename":
+			c.Filename = value
+		case "MTime":
+			c.MTime, err = time.Parse(time.RFC1123Z, value)
+		case "Blocksize":
+			blockLen, err = strconv.ParseInt(value, 10, 32)
+		case "Length":
+			c.Length, err = strconv.ParseInt(value, 10, 64)
+		case "URL":
+			c.URL = value
+		case "SHA-256":
+			c.SHA256, err = hex.DecodeString(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("zsync: bad %s header: %w", key, err)
+		}
+	}
+
+	if c.Version != VERSION {
+		return nil, fmt.Errorf("zsync: unsupported control file version %q", c.Version)
+	}
+	if len(c.SHA256) != sha256.Size {
+		return nil, fmt.Errorf("zsync: missing SHA-256 header")
+	}
+
+	sig, err := librsync.ReadSignature(br)
+	if err != nil {
+		return nil, err
+	}
+	// Control files come from the network: a zero block length would make
+	// computing the number of blocks divide by zero.
+	err = librsync.CheckSignature(sig, 0)
+	if err != nil {
+		return nil, fmt.Errorf("zsync: %w", err)
+	}
+	if int64(sig.BlockLen) != blockLen {
+		return nil, fmt.Errorf("zsync: Blocksize %d doesn't match signature block size %d", blockLen, sig.BlockLen)
+	}
+	c.Signature = sig
+	if c.Length < 0 || int64(len(sig.StrongSigs)) != c.blocks() {
+		return nil, fmt.Errorf("zsync: Length %d doesn't match %d blocks", c.Length, len(sig.StrongSigs))
+	}
+
+	return c, nil
+}
+
+// blocks returns the number of blocks in the target.
+func (c *Control) blocks() int64 {
+	blockLen := int64(c.Signature.BlockLen)
+	return (c.Length + blockLen - 1) / blockLen
+}
+
+// blockRange returns the range of the target covered by block i.
+func (c *Control) blockRange(i int64) (start, end int64) {
+	start = i * int64(c.Signature.BlockLen)
+	end = start + int64(c.Signature.BlockLen)
+	if end > c.Length {
+		end = c.Length
+	}
+	return
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,270 @@
+package zsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/balena-os/librsync-go"
+)
+
+// memOutput is an in-memory Output.
+type memOutput struct {
+	data []byte
+}
+
+func (m *memOutput) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *memOutput) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(m.data).ReadAt(p, off)
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// seedAndTarget returns an old version of a file and a new version, with some
+// data changed, inserted and removed.
+func seedAndTarget() (seed, target []byte) {
+	seed = randomData(1, 256*1024)
+
+	target = append(target, seed[:50000]...)
+	target = append(target, randomData(2, 3000)...)
+	target = append(target, seed[50000:120000]...)
+	target = append(target, seed[130000:]...)
+	copy(target[200000:], "some changed bytes")
+
+	return seed, target
+}
+
+func writeControl(t *testing.T, target []byte, opts ControlOptions) []byte {
+	if opts.BlockLen == 0 {
+		opts.BlockLen = 1024
+		opts.StrongLen = 16
+		opts.SigType = librsync.BLAKE2_SIG_MAGIC
+	}
+	ctrl := &bytes.Buffer{}
+	_, err := WriteControl(ctrl, bytes.NewReader(target), opts)
+	require.NoError(t, err)
+	return ctrl.Bytes()
+}
+
+type server struct {
+	*httptest.Server
+	requests int64
+}
+
+// newServer serves target at /file and its control file at /file.zsync. If
+// ranges is false, Range headers are ignored.
+func newServer(t *testing.T, target, ctrl []byte, ranges bool) *server {
+	s := &server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.zsync", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ctrl)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.requests, 1)
+		if !ranges {
+			w.Write(target)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(target))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestControl(t *testing.T) {
+	r := require.New(t)
+
+	_, target := seedAndTarget()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := writeControl(t, target, ControlOptions{
+		Filename:  "file",
+		MTime:     mtime,
+		URL:       "file",
+		BlockLen:  2048,
+		StrongLen: 8,
+		SigType:   librsync.MD4_SIG_MAGIC,
+	})
+	r.True(bytes.HasPrefix(data, []byte("zsync: librsync-go-1\nFilename: file\n")))
+
+	ctrl, err := ReadControl(bytes.NewReader(data))
+	r.NoError(err)
+	r.Equal("file", ctrl.Filename)
+	r.True(mtime.Equal(ctrl.MTime))
+	r.Equal("file", ctrl.URL)
+	r.Equal(int64(len(target)), ctrl.Length)
+	r.Equal(uint32(2048), ctrl.Signature.BlockLen)
+	r.Equal(librsync.MD4_SIG_MAGIC, ctrl.Signature.SigType)
+	r.Len(ctrl.Signature.StrongSigs, (len(target)+2047)/2048)
+
+	_, err = ReadControl(bytes.NewReader(bytes.Replace(data, []byte("Blocksize: 2048"), []byte("Blocksize: 1024"), 1)))
+	r.Error(err)
+	_, err = ReadControl(bytes.NewReader(bytes.Replace(data, []byte("zsync: librsync-go-1"), []byte("zsync: 0.6.2"), 1)))
+	r.Error(err)
+
+	// Invalid signatures are rejected.
+	sigStart := bytes.Index(data, []byte("\n\n")) + 2
+	zeroBlocks := bytes.Replace(data, []byte("Blocksize: 2048"), []byte("Blocksize: 0"), 1)
+	sigStart -= len(data) - len(zeroBlocks)
+	binary.BigEndian.PutUint32(zeroBlocks[sigStart+4:], 0)
+	_, err = ReadControl(bytes.NewReader(zeroBlocks))
+	r.ErrorIs(err, librsync.ErrInvalidSignature)
+
+	longSums := append([]byte{}, data...)
+	sigStart = bytes.Index(longSums, []byte("\n\n")) + 2
+	binary.BigEndian.PutUint32(longSums[sigStart+8:], 17)
+	longSums = longSums[:sigStart+12+21]
+	_, err = ReadControl(bytes.NewReader(longSums))
+	r.ErrorIs(err, librsync.ErrInvalidSignature)
+}
+
+func TestSync(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		ranges       bool
+		maxRangeSize int64
+	}{
+		{"ranges", true, 0},
+		{"max-range-size", true, 2048},
+		{"no-range-support", false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+			a := assert.New(t)
+
+			seed, target := seedAndTarget()
+			srv := newServer(t, target, writeControl(t, target, ControlOptions{}), tc.ranges)
+
+			c := &Client{HTTPClient: srv.Client(), MaxRangeSize: tc.maxRangeSize}
+			ctrl, err := c.FetchControl(context.Background(), srv.URL+"/file.zsync")
+			r.NoError(err)
+			r.Equal(srv.URL+"/file", ctrl.URL)
+
+			out := &memOutput{}
+			stats, err := c.Sync(context.Background(), ctrl, bytes.NewReader(seed), out)
+			r.NoError(err)
+			r.Equal(target, out.data)
+
+			a.Equal(int64(len(ctrl.Signature.StrongSigs)), stats.SeedBlocks+stats.FetchedBlocks)
+			a.Less(stats.FetchedBytes, int64(len(target)/20))
+			a.Equal(atomic.LoadInt64(&srv.requests), stats.Requests)
+			if tc.maxRangeSize > 0 {
+				a.Greater(stats.Requests, stats.FetchedBytes/tc.maxRangeSize)
+			}
+		})
+	}
+}
+
+func TestSyncWithoutSeed(t *testing.T) {
+	r := require.New(t)
+
+	_, target := seedAndTarget()
+	srv := newServer(t, target, writeControl(t, target, ControlOptions{URL: "file"}), true)
+
+	c := &Client{HTTPClient: srv.Client()}
+	ctrl, err := c.FetchControl(context.Background(), srv.URL+"/file.zsync")
+	r.NoError(err)
+
+	out := &memOutput{}
+	stats, err := c.Sync(context.Background(), ctrl, nil, out)
+	r.NoError(err)
+	r.Equal(target, out.data)
+	r.Equal(int64(len(target)), stats.FetchedBytes)
+	r.Equal(int64(1), stats.Requests)
+}
+
+func TestSyncRepeatedBlocks(t *testing.T) {
+	r := require.New(t)
+
+	block := randomData(3, 1024)
+	target := bytes.Repeat(block, 10)
+	srv := newServer(t, target, writeControl(t, target, ControlOptions{}), true)
+
+	c := &Client{HTTPClient: srv.Client()}
+	ctrl, err := c.FetchControl(context.Background(), srv.URL+"/file.zsync")
+	r.NoError(err)
+
+	out := &memOutput{}
+	stats, err := c.Sync(context.Background(), ctrl, bytes.NewReader(block), out)
+	r.NoError(err)
+	r.Equal(target, out.data)
+	r.Equal(int64(10), stats.SeedBlocks)
+	r.Equal(int64(0), stats.Requests)
+}
+
+func TestSyncCorruptServer(t *testing.T) {
+	r := require.New(t)
+
+	seed, target := seedAndTarget()
+	ctrl := writeControl(t, target, ControlOptions{})
+	corrupt := append([]byte{}, target...)
+	corrupt[51000] ^= 0xff
+	srv := newServer(t, corrupt, ctrl, true)
+
+	c := &Client{HTTPClient: srv.Client()}
+	parsed, err := c.FetchControl(context.Background(), srv.URL+"/file.zsync")
+	r.NoError(err)
+
+	_, err = c.Sync(context.Background(), parsed, bytes.NewReader(seed), &memOutput{})
+	r.Error(err)
+	r.Contains(err.Error(), "doesn't match the control file")
+}
+
+func TestSyncCanceled(t *testing.T) {
+	r := require.New(t)
+
+	_, target := seedAndTarget()
+	srv := newServer(t, target, writeControl(t, target, ControlOptions{}), true)
+
+	c := &Client{HTTPClient: srv.Client()}
+	ctrl, err := c.FetchControl(context.Background(), srv.URL+"/file.zsync")
+	r.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Sync(ctx, ctrl, nil, &memOutput{})
+	r.ErrorIs(err, context.Canceled)
+}
+
+func TestSyncMaxBlockLen(t *testing.T) {
+	r := require.New(t)
+
+	_, target := seedAndTarget()
+	data := writeControl(t, target, ControlOptions{})
+	srv := newServer(t, target, data, true)
+
+	// Blocks larger than the limit are refused, whether the control file is
+	// fetched or read separately.
+	c := &Client{HTTPClient: srv.Client(), MaxBlockLen: 512}
+	_, err := c.FetchControl(context.Background(), srv.URL+"/file.zsync")
+	r.ErrorIs(err, librsync.ErrInvalidSignature)
+
+	ctrl, err := ReadControl(bytes.NewReader(data))
+	r.NoError(err)
+	ctrl.URL = srv.URL + "/file"
+	_, err = c.Sync(context.Background(), ctrl, nil, &memOutput{})
+	r.ErrorIs(err, librsync.ErrInvalidSignature)
+
+	c.MaxBlockLen = 1024
+	_, err = c.Sync(context.Background(), ctrl, nil, &memOutput{})
+	r.NoError(err)
+}